@@ -0,0 +1,210 @@
+package carp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const (
+	AccessLogFormatCommon   = "common"
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJson     = "json"
+)
+
+const _CommonLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogEntry contains all values of an access log entry. It is the data of custom access log templates.
+type AccessLogEntry struct {
+	Time             time.Time
+	ClientIp         string
+	Method           string
+	RequestUri       string
+	Protocol         string
+	Status           int
+	Size             int64
+	Referer          string
+	UserAgent        string
+	Duration         time.Duration
+	RequestId        string
+	Username         string
+	ServiceAccount   bool
+	Throttled        bool
+	UpstreamDuration time.Duration
+}
+
+type accessLogFormatter func(entry AccessLogEntry) ([]byte, error)
+
+// newAccessLogHandler creates the access log handler with the output returned by the given function. The function
+// is only called if an access-log-format is configured. The handler is the outermost one of the chain, so that every
+// request is logged; the client ip and the request id are reported by the inner handlers. Requests whose handler
+// panics are logged with status code 500 before the panic is passed on.
+func newAccessLogHandler(configuration Configuration, handler http.Handler, outputFunc func() (io.Writer, error)) (http.Handler, error) {
+	if configuration.AccessLogFormat == "" {
+		log.Info("No access-log-format configured. Not writing an access log.")
+		return handler, nil
+	}
+
+	formatter, err := newAccessLogFormatter(configuration.AccessLogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := outputFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		request, info := withRequestInfo(request)
+		statusWriter := &statusResponseWriter{
+			ResponseWriter: writer,
+			statusCode:     http.StatusOK,
+		}
+
+		defer func() {
+			recovered := recover()
+			if recovered != nil {
+				statusWriter.statusCode = http.StatusInternalServerError
+			}
+
+			writeAccessLogEntry(output, formatter, request, start, statusWriter, info.snapshot())
+
+			if recovered != nil {
+				panic(recovered)
+			}
+		}()
+
+		handler.ServeHTTP(statusWriter, request)
+	}), nil
+}
+
+// writeAccessLogEntry formats the served request and writes it to the output.
+func writeAccessLogEntry(output io.Writer, formatter accessLogFormatter, request *http.Request, start time.Time, statusWriter *statusResponseWriter, data requestInfoData) {
+	entry := AccessLogEntry{
+		Time:             start,
+		ClientIp:         valueOrDefault(data.clientIp, ClientIP(request)),
+		Method:           request.Method,
+		RequestUri:       request.RequestURI,
+		Protocol:         request.Proto,
+		Status:           statusWriter.statusCode,
+		Size:             statusWriter.bytesWritten,
+		Referer:          request.Referer(),
+		UserAgent:        request.UserAgent(),
+		Duration:         time.Since(start),
+		RequestId:        data.requestId,
+		Username:         data.username,
+		ServiceAccount:   data.serviceAccount,
+		Throttled:        data.throttled,
+		UpstreamDuration: data.upstreamDuration,
+	}
+
+	line, err := formatter(entry)
+	if err != nil {
+		log.Errorf("failed to format access log entry: %s", err.Error())
+		return
+	}
+
+	if _, err = output.Write(line); err != nil {
+		log.Errorf("failed to write access log entry: %s", err.Error())
+	}
+}
+
+func newAccessLogFormatter(format string) (accessLogFormatter, error) {
+	switch format {
+	case AccessLogFormatCommon:
+		return func(entry AccessLogEntry) ([]byte, error) {
+			return []byte(commonLogLine(entry) + "\n"), nil
+		}, nil
+	case AccessLogFormatCombined:
+		return func(entry AccessLogEntry) ([]byte, error) {
+			line := fmt.Sprintf("%s %s %s\n", commonLogLine(entry), strconv.Quote(entry.Referer), strconv.Quote(entry.UserAgent))
+			return []byte(line), nil
+		}, nil
+	case AccessLogFormatJson:
+		return formatJsonAccessLogEntry, nil
+	default:
+		tmpl, err := template.New("access-log").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse access-log-format template: %w", err)
+		}
+
+		return func(entry AccessLogEntry) ([]byte, error) {
+			buffer := new(bytes.Buffer)
+			if err := tmpl.Execute(buffer, entry); err != nil {
+				return nil, err
+			}
+			buffer.WriteByte('\n')
+			return buffer.Bytes(), nil
+		}, nil
+	}
+}
+
+// commonLogLine formats the entry in the Common Log Format with the principal as authenticated user.
+func commonLogLine(entry AccessLogEntry) string {
+	size := "-"
+	if entry.Size > 0 {
+		size = strconv.FormatInt(entry.Size, 10)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		valueOrDefault(entry.ClientIp, "-"),
+		valueOrDefault(entry.Username, "-"),
+		entry.Time.Format(_CommonLogTimeFormat),
+		entry.Method, entry.RequestUri, entry.Protocol,
+		entry.Status,
+		size,
+	)
+}
+
+type jsonAccessLogEntry struct {
+	Time               string  `json:"time"`
+	ClientIp           string  `json:"client_ip"`
+	Method             string  `json:"method"`
+	RequestUri         string  `json:"request_uri"`
+	Protocol           string  `json:"protocol"`
+	Status             int     `json:"status"`
+	Size               int64   `json:"size"`
+	Referer            string  `json:"referer,omitempty"`
+	UserAgent          string  `json:"user_agent,omitempty"`
+	DurationMs         float64 `json:"duration"`
+	RequestId          string  `json:"request_id,omitempty"`
+	Username           string  `json:"username,omitempty"`
+	ServiceAccount     bool    `json:"service_account"`
+	Throttled          bool    `json:"throttled"`
+	UpstreamDurationMs float64 `json:"upstream_duration"`
+}
+
+func formatJsonAccessLogEntry(entry AccessLogEntry) ([]byte, error) {
+	data, err := json.Marshal(jsonAccessLogEntry{
+		Time:               entry.Time.Format(time.RFC3339Nano),
+		ClientIp:           entry.ClientIp,
+		Method:             entry.Method,
+		RequestUri:         entry.RequestUri,
+		Protocol:           entry.Protocol,
+		Status:             entry.Status,
+		Size:               entry.Size,
+		Referer:            entry.Referer,
+		UserAgent:          entry.UserAgent,
+		DurationMs:         milliseconds(entry.Duration),
+		RequestId:          entry.RequestId,
+		Username:           entry.Username,
+		ServiceAccount:     entry.ServiceAccount,
+		Throttled:          entry.Throttled,
+		UpstreamDurationMs: milliseconds(entry.UpstreamDuration),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
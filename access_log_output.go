@@ -0,0 +1,216 @@
+package carp
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+const (
+	AccessLogOutputStdout = "stdout"
+	AccessLogOutputFile   = "file"
+	AccessLogOutputSyslog = "syslog"
+)
+
+const (
+	_DefaultAccessLogMaxSize    = 100
+	_DefaultAccessLogMaxBackups = 3
+	_DefaultAccessLogSyslogTag  = "carp"
+)
+
+func newAccessLogOutput(configuration Configuration) (io.WriteCloser, error) {
+	switch valueOrDefault(configuration.AccessLogOutput, AccessLogOutputStdout) {
+	case AccessLogOutputStdout:
+		return nopCloser{os.Stdout}, nil
+	case AccessLogOutputFile:
+		maxSize := configuration.AccessLogMaxSize
+		if maxSize == 0 {
+			maxSize = _DefaultAccessLogMaxSize
+		}
+		maxBackups := configuration.AccessLogMaxBackups
+		if maxBackups == 0 {
+			maxBackups = _DefaultAccessLogMaxBackups
+		}
+		return newRotatingFile(configuration.AccessLogFile, int64(maxSize)*1024*1024, maxBackups)
+	case AccessLogOutputSyslog:
+		writer, err := syslog.Dial(
+			configuration.AccessLogSyslogNetwork,
+			configuration.AccessLogSyslogAddress,
+			syslog.LOG_INFO|syslog.LOG_DAEMON,
+			valueOrDefault(configuration.AccessLogSyslogTag, _DefaultAccessLogSyslogTag),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		return writer, nil
+	default:
+		return nil, fmt.Errorf("unknown access-log-output: %s", configuration.AccessLogOutput)
+	}
+}
+
+// accessLogOutputKey contains all configuration values which are used to create the access log output.
+type accessLogOutputKey struct {
+	output        string
+	file          string
+	maxSize       int
+	maxBackups    int
+	syslogNetwork string
+	syslogAddress string
+	syslogTag     string
+}
+
+func newAccessLogOutputKey(configuration Configuration) accessLogOutputKey {
+	return accessLogOutputKey{
+		output:        configuration.AccessLogOutput,
+		file:          configuration.AccessLogFile,
+		maxSize:       configuration.AccessLogMaxSize,
+		maxBackups:    configuration.AccessLogMaxBackups,
+		syslogNetwork: configuration.AccessLogSyslogNetwork,
+		syslogAddress: configuration.AccessLogSyslogAddress,
+		syslogTag:     configuration.AccessLogSyslogTag,
+	}
+}
+
+// getOrCreateAccessLogOutput returns the access log output for the configuration. The outputs are kept on reload,
+// so that the requests of a replaced handler chain can still be logged, and closed on shutdown.
+func (state *handlerState) getOrCreateAccessLogOutput(configuration Configuration) (io.Writer, error) {
+	key := newAccessLogOutputKey(configuration)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if output, ok := state.accessLogOutputs[key]; ok {
+		return output, nil
+	}
+
+	output, err := newAccessLogOutput(configuration)
+	if err != nil {
+		return nil, err
+	}
+	state.accessLogOutputs[key] = output
+
+	return output, nil
+}
+
+func (state *handlerState) closeAccessLogOutputs() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for key, output := range state.accessLogOutputs {
+		if err := output.Close(); err != nil {
+			log.Errorf("failed to close access log: %s", err.Error())
+		}
+		delete(state.accessLogOutputs, key)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingFile is a file which is rotated as soon as it would exceed its maximum size. The rotated files are
+// renamed to <path>.1, <path>.2, ... and only maxBackups of them are kept.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file %s: %w", rf.path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat access log file %s: %w", rf.path, err)
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+
+	return nil
+}
+
+func (rf *rotatingFile) Write(data []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, fmt.Errorf("access log file %s is closed", rf.path)
+	}
+
+	if rf.size > 0 && rf.size+int64(len(data)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(data)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return fmt.Errorf("failed to close access log file %s: %w", rf.path, err)
+	}
+	rf.file = nil
+
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(rf.backupPath(i), rf.backupPath(i+1))
+	}
+
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.path, rf.backupPath(1)); err != nil {
+			return fmt.Errorf("failed to rotate access log file %s: %w", rf.path, err)
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return fmt.Errorf("failed to rotate access log file %s: %w", rf.path, err)
+	}
+
+	return rf.open()
+}
+
+func (rf *rotatingFile) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", rf.path, index)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,205 @@
+package carp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogHandler(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:             time.Date(2024, time.October, 10, 13, 55, 36, 0, time.UTC),
+		ClientIp:         "192.0.2.1",
+		Method:           http.MethodGet,
+		RequestUri:       "/foo?bar=baz",
+		Protocol:         "HTTP/1.1",
+		Status:           http.StatusOK,
+		Size:             2326,
+		Referer:          "https://example.com/",
+		UserAgent:        "curl/8.0",
+		Duration:         1500 * time.Microsecond,
+		Username:         "tester",
+		UpstreamDuration: 1200 * time.Millisecond,
+	}
+
+	t.Run("should format combined log format", func(t *testing.T) {
+		formatter, err := newAccessLogFormatter(AccessLogFormatCombined)
+		require.NoError(t, err)
+
+		line, err := formatter(entry)
+		require.NoError(t, err)
+
+		assert.Equal(t, `192.0.2.1 - tester [10/Oct/2024:13:55:36 +0000] "GET /foo?bar=baz HTTP/1.1" 200 2326 "https://example.com/" "curl/8.0"`+"\n", string(line))
+	})
+
+	t.Run("should format common log format", func(t *testing.T) {
+		formatter, err := newAccessLogFormatter(AccessLogFormatCommon)
+		require.NoError(t, err)
+
+		line, err := formatter(entry)
+		require.NoError(t, err)
+
+		assert.Equal(t, `192.0.2.1 - tester [10/Oct/2024:13:55:36 +0000] "GET /foo?bar=baz HTTP/1.1" 200 2326`+"\n", string(line))
+	})
+
+	t.Run("should format json", func(t *testing.T) {
+		formatter, err := newAccessLogFormatter(AccessLogFormatJson)
+		require.NoError(t, err)
+
+		line, err := formatter(entry)
+		require.NoError(t, err)
+
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &result))
+		assert.Equal(t, "tester", result["username"])
+		assert.Equal(t, "/foo?bar=baz", result["request_uri"])
+		assert.Equal(t, 1.5, result["duration"])
+		assert.Equal(t, 1200.0, result["upstream_duration"])
+	})
+
+	t.Run("should format custom template", func(t *testing.T) {
+		formatter, err := newAccessLogFormatter("{{.Method}} {{.RequestUri}} {{.Status}} {{.Username}}")
+		require.NoError(t, err)
+
+		line, err := formatter(entry)
+		require.NoError(t, err)
+
+		assert.Equal(t, "GET /foo?bar=baz 200 tester\n", string(line))
+	})
+
+	t.Run("should fail for invalid template", func(t *testing.T) {
+		_, err := newAccessLogFormatter("{{.Method")
+
+		assert.ErrorContains(t, err, "failed to parse access-log-format template")
+	})
+
+	t.Run("should log service account and throttled requests of the handler chain", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("denied"))
+		}))
+		defer backend.Close()
+
+		logFile := filepath.Join(t.TempDir(), "access.log")
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		configuration.ServiceAccountNameRegex = "^service_account_.*$"
+		configuration.LimiterTokenRate = 1
+		configuration.LimiterBurstSize = 1
+		configuration.AccessLogFormat = AccessLogFormatJson
+		configuration.AccessLogOutput = AccessLogOutputFile
+		configuration.AccessLogFile = logFile
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := createHandlersForConfig(ctx, configuration, newHandlerState())
+		require.NoError(t, err)
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		for i := 0; i < 2; i++ {
+			req, lErr := http.NewRequest(http.MethodGet, server.URL+"/foo", nil)
+			require.NoError(t, lErr)
+			req.SetBasicAuth("service_account_foo", "wrong")
+			req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.10")
+			resp, lErr := server.Client().Do(req)
+			require.NoError(t, lErr)
+			_ = resp.Body.Close()
+		}
+
+		data, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 2)
+
+		var first, second jsonAccessLogEntry
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+
+		assert.Equal(t, "198.51.100.10", first.ClientIp)
+		assert.Equal(t, "service_account_foo", first.Username)
+		assert.NotEmpty(t, first.RequestId)
+		assert.Equal(t, http.StatusUnauthorized, first.Status)
+		assert.Equal(t, int64(6), first.Size)
+		assert.True(t, first.ServiceAccount)
+		assert.False(t, first.Throttled)
+		assert.Equal(t, http.StatusTooManyRequests, second.Status)
+		assert.False(t, second.ServiceAccount)
+		assert.True(t, second.Throttled)
+		assert.Zero(t, second.UpstreamDurationMs)
+	})
+
+	t.Run("should log requests whose handler panics", func(t *testing.T) {
+		var output strings.Builder
+		handler, err := newAccessLogHandler(Configuration{AccessLogFormat: AccessLogFormatCommon}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}), func() (io.Writer, error) {
+			return &output, nil
+		})
+		require.NoError(t, err)
+
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo", nil))
+		})
+		assert.Contains(t, output.String(), `"GET /foo HTTP/1.1" 500 -`)
+	})
+
+	t.Run("should return handler without access-log-format", func(t *testing.T) {
+		delegate := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		handler, err := newAccessLogHandler(Configuration{}, delegate, func() (io.Writer, error) {
+			t.Fatal("the output must not be created without access-log-format")
+			return nil, nil
+		})
+
+		require.NoError(t, err)
+		assert.NotNil(t, handler)
+	})
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Run("should rotate file and keep max backups", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "access.log")
+		file, err := newRotatingFile(path, 10, 2)
+		require.NoError(t, err)
+		defer file.Close()
+
+		for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+			_, err = file.Write([]byte(line))
+			require.NoError(t, err)
+		}
+
+		assertFileContent := func(path string, expected string) {
+			data, lErr := os.ReadFile(path)
+			require.NoError(t, lErr)
+			assert.Equal(t, expected, string(data))
+		}
+		assertFileContent(path, "fourth\n")
+		assertFileContent(path+".1", "third\n")
+		assertFileContent(path+".2", "second\n")
+		assert.NoFileExists(t, path+".3")
+	})
+
+	t.Run("should fail writing after close", func(t *testing.T) {
+		file, err := newRotatingFile(filepath.Join(t.TempDir(), "access.log"), 10, 1)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		_, err = file.Write([]byte("foo"))
+
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,213 @@
+package carp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const _DefaultAccessRulesGroupAttribute = "groups"
+
+// AccessRule restricts the requests of CAS-authenticated users to a path of the target. The first rule which matches
+// the path and method of a request decides whether the request is allowed. Requests which match no rule are allowed.
+type AccessRule struct {
+	// PathPrefix matches requests whose path starts with the prefix
+	PathPrefix string `yaml:"path-prefix"`
+	// PathRegex matches requests whose path matches the regular expression
+	PathRegex string `yaml:"path-regex"`
+	// Methods restricts the rule to the HTTP methods; the rule matches all methods if empty
+	Methods []string `yaml:"methods"`
+	// Groups allows users which are member of at least one of the groups
+	Groups []string `yaml:"groups"`
+	// Attributes allows users which have all attributes with the given values
+	Attributes map[string]string `yaml:"attributes"`
+}
+
+type accessRule struct {
+	AccessRule
+	pattern pathPattern
+}
+
+// accessRules enforces the access-rules for authenticated requests.
+type accessRules struct {
+	rules          []accessRule
+	groupAttribute string
+	deniedPage     []byte
+}
+
+// AccessDeniedResponse is the JSON body of a request which is denied by the access-rules.
+type AccessDeniedResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Path    string `json:"path"`
+}
+
+func newAccessRules(configuration Configuration) (*accessRules, error) {
+	compiled, err := compileAccessRules(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &accessRules{
+		rules:          compiled,
+		groupAttribute: valueOrDefault(configuration.AccessRulesGroupAttribute, _DefaultAccessRulesGroupAttribute),
+	}
+
+	if configuration.AccessDeniedPage != "" {
+		page, err := os.ReadFile(configuration.AccessDeniedPage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read access-denied-page: %w", err)
+		}
+		rules.deniedPage = page
+	}
+
+	return rules, nil
+}
+
+func compileAccessRules(configuration Configuration) ([]accessRule, error) {
+	var rules []accessRule
+
+	for i, rule := range configuration.AccessRules {
+		pattern, err := newPathPattern(rule.PathPrefix, rule.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access-rules[%d]: %w", i, err)
+		}
+		rules = append(rules, accessRule{AccessRule: rule, pattern: pattern})
+	}
+
+	return rules, nil
+}
+
+// restricts reports whether the request is subject to an access rule, so that it must not be forwarded anonymously.
+// Requests with a path which is not canonical are restricted if there are rules.
+func (r *accessRules) restricts(req *http.Request) bool {
+	if r == nil || len(r.rules) == 0 {
+		return false
+	}
+
+	if !isCanonicalPath(req) {
+		return true
+	}
+
+	for _, rule := range r.rules {
+		if rule.matches(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowed checks the request of the user against the first matching rule. All requests are allowed if there are no
+// rules; requests with a path which is not canonical are denied if there are rules, so that they can not bypass them.
+func (r *accessRules) isAllowed(req *http.Request, attributes UserAttibutes) bool {
+	if r == nil || len(r.rules) == 0 {
+		return true
+	}
+
+	if !isCanonicalPath(req) {
+		return false
+	}
+
+	for _, rule := range r.rules {
+		if rule.matches(req) {
+			return rule.isSatisfiedBy(attributes, r.groupAttribute)
+		}
+	}
+	return true
+}
+
+func (rule accessRule) matches(req *http.Request) bool {
+	if !rule.pattern.matches(req.URL.Path) {
+		return false
+	}
+
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, method := range rule.Methods {
+		if strings.EqualFold(method, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule accessRule) isSatisfiedBy(attributes UserAttibutes, groupAttribute string) bool {
+	if len(rule.Groups) > 0 && !containsAny(attributes[groupAttribute], rule.Groups) {
+		return false
+	}
+
+	for name, value := range rule.Attributes {
+		if !containsAny(attributes[name], []string{value}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsAny(values []string, expected []string) bool {
+	for _, value := range values {
+		for _, e := range expected {
+			if value == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeAccessDenied answers the request with status code 403. Requests which accept JSON get an
+// AccessDeniedResponse, all others the access-denied-page.
+func (r *accessRules) writeAccessDenied(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		err := json.NewEncoder(w).Encode(AccessDeniedResponse{
+			Status:  http.StatusForbidden,
+			Message: "access denied",
+			Path:    req.URL.Path,
+		})
+		if err != nil {
+			log.Errorf("failed to write access denied response: %s", err.Error())
+		}
+		return
+	}
+
+	if r.deniedPage == nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	if _, err := w.Write(r.deniedPage); err != nil {
+		log.Errorf("failed to write access denied page: %s", err.Error())
+	}
+}
+
+func validateAccessRules(configuration Configuration) []error {
+	var errs []error
+
+	for i, rule := range configuration.AccessRules {
+		if (rule.PathPrefix == "") == (rule.PathRegex == "") {
+			errs = append(errs, fmt.Errorf("access-rules[%d]: exactly one of path-prefix and path-regex is required", i))
+		}
+
+		if _, err := newPathPattern(rule.PathPrefix, rule.PathRegex); err != nil {
+			errs = append(errs, fmt.Errorf("access-rules[%d]: %w", i, err))
+		}
+
+		for _, method := range rule.Methods {
+			if method == "" || strings.ContainsAny(method, " \t") {
+				errs = append(errs, fmt.Errorf("access-rules[%d]: invalid method: %q", i, method))
+			}
+		}
+	}
+
+	return errs
+}
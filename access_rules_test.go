@@ -0,0 +1,115 @@
+package carp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessRules_isAllowed(t *testing.T) {
+	rules, err := newAccessRules(Configuration{AccessRules: []AccessRule{
+		{PathPrefix: "/nexus/service/rest/v1/security", Groups: []string{"admin"}},
+		{PathRegex: "^/nexus/repository/[^/]+/upload$", Methods: []string{"POST", "put"}, Attributes: map[string]string{"department": "dev"}},
+		{PathPrefix: "/nexus/service/rest/v1/status"},
+		{PathPrefix: "/nexus/service/rest", Groups: []string{"admin", "nexus-users"}},
+	}})
+	require.NoError(t, err)
+
+	admin := UserAttibutes{"groups": {"users", "admin"}}
+	developer := UserAttibutes{"groups": {"nexus-users"}, "department": {"dev"}}
+	guest := UserAttibutes{}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		attributes UserAttibutes
+		want       bool
+	}{
+		{"admin may reach security", http.MethodGet, "/nexus/service/rest/v1/security/users", admin, true},
+		{"developer may not reach security", http.MethodGet, "/nexus/service/rest/v1/security/users", developer, false},
+		{"developer may upload", http.MethodPut, "/nexus/repository/releases/upload", developer, true},
+		{"admin may not upload without department", http.MethodPost, "/nexus/repository/releases/upload", admin, false},
+		{"rule does not match other methods", http.MethodGet, "/nexus/repository/releases/upload", guest, true},
+		{"rule without requirements allows everyone", http.MethodGet, "/nexus/service/rest/v1/status", guest, true},
+		{"first matching rule decides", http.MethodGet, "/nexus/service/rest/v1/repositories", guest, false},
+		{"path without rule is allowed", http.MethodGet, "/nexus/", guest, true},
+		{"prefix matches whole segments only", http.MethodGet, "/nexus/service/rest/v1/securityX", developer, true},
+		{"dot segment does not bypass rule", http.MethodGet, "/nexus/service/rest/v1/./security/users", developer, false},
+		{"empty segment does not bypass rule", http.MethodGet, "//nexus/service/rest/v1/security/users", developer, false},
+		{"parent segment does not bypass rule", http.MethodGet, "/nexus/x/../service/rest/v1/security/users", developer, false},
+		{"encoded dot segment does not bypass rule", http.MethodGet, "/nexus/service/rest/v1/%2e/security/users", developer, false},
+		{"encoded slash does not bypass rule", http.MethodGet, "/nexus/service/rest/v1%2fsecurity/users", developer, false},
+		{"encoded backslash does not bypass rule", http.MethodGet, "/nexus/service/rest/v1%5csecurity/users", developer, false},
+		{"path which is not canonical is denied for all users", http.MethodGet, "/nexus/./service/rest/v1/status", admin, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+
+			assert.Equal(t, tt.want, rules.isAllowed(r, tt.attributes))
+		})
+	}
+
+	t.Run("should read groups from configured attribute", func(t *testing.T) {
+		rules, err := newAccessRules(Configuration{
+			AccessRulesGroupAttribute: "memberOf",
+			AccessRules:               []AccessRule{{PathPrefix: "/", Groups: []string{"admin"}}},
+		})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+
+		assert.True(t, rules.isAllowed(r, UserAttibutes{"memberOf": {"admin"}}))
+		assert.False(t, rules.isAllowed(r, admin))
+	})
+
+	t.Run("should allow all requests without rules", func(t *testing.T) {
+		var rules *accessRules
+
+		assert.True(t, rules.isAllowed(httptest.NewRequest(http.MethodGet, "/foo", nil), guest))
+	})
+}
+
+func TestAccessRules_writeAccessDenied(t *testing.T) {
+	t.Run("should write json for json requests", func(t *testing.T) {
+		rules, err := newAccessRules(Configuration{})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		r.Header.Set("Accept", "application/json, text/plain")
+		w := httptest.NewRecorder()
+
+		rules.writeAccessDenied(w, r)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var response AccessDeniedResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, AccessDeniedResponse{Status: http.StatusForbidden, Message: "access denied", Path: "/foo"}, response)
+	})
+
+	t.Run("should write configured page", func(t *testing.T) {
+		page := filepath.Join(t.TempDir(), "403.html")
+		require.NoError(t, os.WriteFile(page, []byte("<h1>Forbidden</h1>"), 0644))
+		rules, err := newAccessRules(Configuration{AccessDeniedPage: page})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+
+		rules.writeAccessDenied(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "<h1>Forbidden</h1>", w.Body.String())
+	})
+
+	t.Run("should fail for missing page", func(t *testing.T) {
+		_, err := newAccessRules(Configuration{AccessDeniedPage: filepath.Join(t.TempDir(), "missing.html")})
+
+		assert.ErrorContains(t, err, "failed to read access-denied-page")
+	})
+}
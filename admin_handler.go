@@ -0,0 +1,225 @@
+package carp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const _AdminRealm = "carp admin"
+
+// AdminReloadResponse is the answer of the admin API to a reload of the configuration.
+type AdminReloadResponse struct {
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// AdminErrorResponse is the answer of the admin API to a failed request.
+type AdminErrorResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// adminHandler serves the admin API on the admin-port. Requests are authorized by the admin-token as bearer token
+// or by basic auth of a CAS user which is member of the admin-group. Basic auth is throttled by the cas-rest limiter.
+// The metrics endpoint is served here instead of on the public port if a metrics-path is configured.
+type adminHandler struct {
+	server            *Server
+	token             string
+	group             string
+	groupAttribute    string
+	casAuthentication http.Handler
+	metricsPath       string
+	metricsEndpoint   http.Handler
+	mux               *http.ServeMux
+}
+
+func newAdminHandler(server *Server, configuration Configuration) (http.Handler, error) {
+	h := &adminHandler{
+		server:         server,
+		token:          configuration.AdminToken,
+		group:          configuration.AdminGroup,
+		groupAttribute: valueOrDefault(configuration.AccessRulesGroupAttribute, _DefaultAccessRulesGroupAttribute),
+		metricsPath:    configuration.MetricsPath,
+		mux:            http.NewServeMux(),
+	}
+
+	if h.metricsPath != "" {
+		h.metricsEndpoint = promhttp.HandlerFor(server.state.metrics.registry, promhttp.HandlerOpts{})
+	}
+
+	if h.group != "" {
+		clients, err := server.state.getOrCreateCasClients(configuration)
+		if err != nil {
+			return nil, err
+		}
+		casAuthentication := clients.restAuthenticator.Handle(http.HandlerFunc(h.serveCasAuthenticated), valueOrDefault(configuration.RequestIdHeader, _DefaultRequestIdHeader))
+
+		// basic auth shares the limiter and the ban list of the CAS REST authentication of the proxy, so that the
+		// admin-port can not be used to guess passwords or to lock accounts in CAS
+		throttling := server.state.getOrCreateThrottling(configuration)
+		policy := newBanPolicy(configuration)
+		h.casAuthentication = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			throttleCasRestAuthentication(configuration, throttling, policy, casAuthentication, w, r)
+		})
+	}
+
+	h.mux.HandleFunc("GET /throttling/buckets", h.listBuckets)
+	h.mux.HandleFunc("DELETE /throttling/buckets/{key}", h.resetBucket)
+	h.mux.HandleFunc("GET /throttling/bans", h.listBans)
+	h.mux.HandleFunc("DELETE /throttling/bans/{key}", h.unban)
+	h.mux.HandleFunc("GET /sessions", h.listSessions)
+	h.mux.HandleFunc("DELETE /sessions/{id}", h.invalidateSession)
+	h.mux.HandleFunc("GET /configuration", h.showConfiguration)
+	h.mux.HandleFunc("POST /configuration/reload", h.reload)
+
+	return h, nil
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token != "" && isAdminToken(r, h.token) {
+		h.serveAuthorized(w, r)
+		return
+	}
+
+	if _, _, ok := r.BasicAuth(); ok && h.casAuthentication != nil {
+		h.casAuthentication.ServeHTTP(w, r)
+		return
+	}
+
+	newRequestLogger(r).withStatus(http.StatusUnauthorized).info("Reject unauthenticated admin request")
+	w.Header().Set("WWW-Authenticate", adminChallenge(h.token != "", h.casAuthentication != nil))
+	writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+}
+
+// serveCasAuthenticated serves requests which passed the CAS REST authentication if the user is member of the
+// admin-group.
+func (h *adminHandler) serveCasAuthenticated(w http.ResponseWriter, r *http.Request) {
+	if !casIsAuthenticated(r) {
+		newRequestLogger(r).withStatus(http.StatusUnauthorized).info("Reject unauthenticated admin request")
+		w.Header().Set("WWW-Authenticate", adminChallenge(h.token != "", true))
+		writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	username := casUsername(r)
+	logger := newRequestLogger(r).withUsername(username)
+	if !containsAny(UserAttibutes(casAttributes(r))[h.groupAttribute], []string{h.group}) {
+		logger.withStatus(http.StatusForbidden).info("Reject admin request of user without admin-group")
+		writeAdminError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	h.serveAuthorized(w, r)
+}
+
+func (h *adminHandler) serveAuthorized(w http.ResponseWriter, r *http.Request) {
+	if h.metricsEndpoint != nil && r.Method == http.MethodGet && r.URL.Path == h.metricsPath {
+		h.metricsEndpoint.ServeHTTP(w, r)
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func isAdminToken(r *http.Request, token string) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+func adminChallenge(token bool, basic bool) string {
+	var challenges []string
+	if token {
+		challenges = append(challenges, "Bearer realm=\""+_AdminRealm+"\"")
+	}
+	if basic {
+		challenges = append(challenges, "Basic realm=\""+_AdminRealm+"\"")
+	}
+	return strings.Join(challenges, ", ")
+}
+
+func (h *adminHandler) listBuckets(w http.ResponseWriter, _ *http.Request) {
+	writeAdminResponse(w, http.StatusOK, h.server.ThrottlingBuckets())
+}
+
+func (h *adminHandler) resetBucket(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	h.server.ResetThrottlingBucket(key)
+	newRequestLogger(r).withUsername(casUsername(r)).info("Reset throttling bucket " + key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) listBans(w http.ResponseWriter, _ *http.Request) {
+	writeAdminResponse(w, http.StatusOK, h.server.Bans())
+}
+
+func (h *adminHandler) unban(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !h.server.Unban(key) {
+		writeAdminError(w, http.StatusNotFound, "ban not found")
+		return
+	}
+
+	newRequestLogger(r).withUsername(casUsername(r)).info("Lifted ban of " + key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) listSessions(w http.ResponseWriter, _ *http.Request) {
+	sessions, err := h.server.Sessions()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, sessions)
+}
+
+func (h *adminHandler) invalidateSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	invalidated, err := h.server.InvalidateSession(id)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !invalidated {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	newRequestLogger(r).withUsername(casUsername(r)).info("Invalidated session " + id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) showConfiguration(w http.ResponseWriter, _ *http.Request) {
+	writeAdminResponse(w, http.StatusOK, maskedConfiguration(h.server.Configuration()))
+}
+
+func (h *adminHandler) reload(w http.ResponseWriter, r *http.Request) {
+	newRequestLogger(r).withUsername(casUsername(r)).info("Reload configuration")
+
+	restartRequired, err := h.server.ReloadConfiguration()
+	if err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if restartRequired == nil {
+		restartRequired = []string{}
+	}
+	writeAdminResponse(w, http.StatusOK, AdminReloadResponse{RestartRequired: restartRequired})
+}
+
+func writeAdminError(w http.ResponseWriter, statusCode int, message string) {
+	writeAdminResponse(w, statusCode, AdminErrorResponse{Status: statusCode, Message: message})
+}
+
+func writeAdminResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("failed to write admin response: %s", err.Error())
+	}
+}
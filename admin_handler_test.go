@@ -0,0 +1,266 @@
+package carp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudogu/go-cas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAdminTestServer(t *testing.T, configuration Configuration) *Server {
+	srv, err := NewServer(configuration)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		srv.cancelJobs()
+	})
+	return srv
+}
+
+func adminRequest(srv *Server, method string, path string, authorize func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if authorize != nil {
+		authorize(req)
+	}
+	recorder := httptest.NewRecorder()
+	srv.serveAdminHTTP(recorder, req)
+	return recorder
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	configuration := validTestConfiguration(t)
+	configuration.AdminPort = configuration.Port + 1
+	configuration.AdminToken = "admin-secret"
+	configuration.IdentityAssertionSecret = "a-secret-with-at-least-32-bytes!"
+	configuration.ServiceAccountNameRegex = "^service_account_"
+	configuration.LimiterTokenRate = 1
+	configuration.LimiterBurstSize = 2
+	configuration.LimiterBanThreshold = 1
+	configuration.MetricsPath = "/metrics"
+	srv := newAdminTestServer(t, configuration)
+	authorized := bearer("admin-secret")
+
+	t.Run("should reject requests without token", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/configuration", nil)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `Bearer realm="carp admin"`, w.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("should reject requests with wrong token", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/configuration", bearer("wrong"))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("should show configuration with masked secrets", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/configuration", authorized)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var values map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &values))
+		assert.Equal(t, configuration.CasUrl, values["cas-url"])
+		assert.Equal(t, _MaskedConfigurationValue, values["admin-token"])
+		assert.Equal(t, _MaskedConfigurationValue, values["identity-assertion-secret"])
+		assert.NotContains(t, w.Body.String(), "admin-secret")
+	})
+
+	t.Run("should list and reset throttling buckets", func(t *testing.T) {
+		throttling := srv.state.getOrCreateThrottling(configuration)
+		key := _ServiceAccountLimiterKeyPrefix + "10.0.0.1:service_account_test"
+		throttling.store.Allow(key, Limit{TokenRate: 1, BurstSize: 2})
+
+		w := adminRequest(srv, http.MethodGet, "/throttling/buckets", authorized)
+		require.Equal(t, http.StatusOK, w.Code)
+		var buckets []ThrottlingBucket
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &buckets))
+		require.Len(t, buckets, 1)
+		assert.Equal(t, key, buckets[0].Key)
+		assert.Less(t, buckets[0].Tokens, 2.0)
+
+		w = adminRequest(srv, http.MethodDelete, "/throttling/buckets/"+url.PathEscape(key), authorized)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, srv.ThrottlingBuckets())
+	})
+
+	t.Run("should list and lift bans", func(t *testing.T) {
+		throttling := srv.state.getOrCreateThrottling(configuration)
+		key := _ServiceAccountLimiterKeyPrefix + "10.0.0.2:service_account_test"
+		_, banned := throttling.bans.recordThrottle(key, newBanPolicy(configuration))
+		require.True(t, banned)
+
+		w := adminRequest(srv, http.MethodGet, "/throttling/bans", authorized)
+		require.Equal(t, http.StatusOK, w.Code)
+		var bans []Ban
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bans))
+		require.Len(t, bans, 1)
+		assert.Equal(t, key, bans[0].Key)
+
+		w = adminRequest(srv, http.MethodDelete, "/throttling/bans/"+url.PathEscape(key), authorized)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, srv.Bans())
+
+		w = adminRequest(srv, http.MethodDelete, "/throttling/bans/"+url.PathEscape(key), authorized)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should list and invalidate sessions", func(t *testing.T) {
+		clients, err := srv.state.getOrCreateCasClients(configuration)
+		require.NoError(t, err)
+		authenticated := time.Now().UTC().Truncate(time.Second)
+		require.NoError(t, clients.tickets.Write("ST-1", &cas.AuthenticationResponse{User: "tricia", AuthenticationDate: authenticated}))
+
+		w := adminRequest(srv, http.MethodGet, "/sessions", authorized)
+		require.Equal(t, http.StatusOK, w.Code)
+		var sessions []Session
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "tricia", sessions[0].Username)
+		assert.Equal(t, authenticated, sessions[0].AuthenticationDate)
+		assert.NotContains(t, w.Body.String(), "ST-1")
+
+		w = adminRequest(srv, http.MethodDelete, "/sessions/"+sessions[0].Id, authorized)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		_, err = clients.tickets.Read("ST-1")
+		assert.ErrorIs(t, err, cas.ErrInvalidTicket)
+
+		w = adminRequest(srv, http.MethodDelete, "/sessions/"+sessions[0].Id, authorized)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should answer unknown paths with 404", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/unknown", authorized)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should serve metrics to authorized requests only", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/metrics", nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = adminRequest(srv, http.MethodGet, "/metrics", authorized)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "carp_throttling_clients")
+	})
+}
+
+func TestAdminHandler_reload(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "carp.yml")
+	oldArgs := os.Args
+	os.Args = []string{"carp", confPath}
+	defer func() { os.Args = oldArgs }()
+
+	configuration := validTestConfiguration(t)
+	configuration.AdminPort = configuration.Port + 1
+	configuration.AdminToken = "admin-secret"
+	srv := newAdminTestServer(t, configuration)
+
+	content := fmt.Sprintf(`cas-url: https://cas.example.com/cas
+service-url: https://dogu.example.com/dogu
+target-url: http://localhost:9090
+principal-header: X-CARP-Authentication
+port: %d
+admin-port: %d
+admin-token: admin-secret
+`, configuration.Port, configuration.AdminPort)
+	require.NoError(t, os.WriteFile(confPath, []byte(content), 0600))
+
+	w := adminRequest(srv, http.MethodPost, "/configuration/reload", bearer("admin-secret"))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"restartRequired":[]}`, w.Body.String())
+	assert.Equal(t, "http://localhost:9090", srv.Configuration().Target)
+}
+
+func TestAdminHandler_casGroup(t *testing.T) {
+	var grantingTicketRequests atomic.Int32
+	casServer := newFakeCasRestServer(t, &grantingTicketRequests)
+
+	configuration := validTestConfiguration(t)
+	configuration.CasUrl = casServer.URL + "/cas"
+	configuration.AdminPort = configuration.Port + 1
+	configuration.AdminGroup = "admins"
+	configuration.CasRestLimiterTokenRate = 1
+	configuration.CasRestLimiterBurstSize = 2
+	srv := newAdminTestServer(t, configuration)
+
+	basic := func(username string, password string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	t.Run("should allow members of admin-group", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/throttling/bans", basic("admin", "secret"))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("should forbid users without admin-group", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/throttling/bans", basic("tricia", "secret"))
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("should reject wrong password", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/throttling/bans", basic("admin", "wrong"))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("should throttle wrong passwords", func(t *testing.T) {
+		grantingTicketRequests.Store(0)
+
+		assert.Equal(t, http.StatusUnauthorized, adminRequest(srv, http.MethodGet, "/throttling/bans", basic("arthur", "wrong")).Code)
+		assert.Equal(t, http.StatusUnauthorized, adminRequest(srv, http.MethodGet, "/throttling/bans", basic("arthur", "guess")).Code)
+		assert.Equal(t, http.StatusTooManyRequests, adminRequest(srv, http.MethodGet, "/throttling/bans", basic("arthur", "secret")).Code)
+
+		assert.Equal(t, int32(2), grantingTicketRequests.Load())
+	})
+
+	t.Run("should reject bearer token without admin-token", func(t *testing.T) {
+		w := adminRequest(srv, http.MethodGet, "/throttling/bans", bearer(""))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `Basic realm="carp admin"`, w.Header().Get("WWW-Authenticate"))
+	})
+}
+
+func TestServer_adminListener(t *testing.T) {
+	configuration := validTestConfiguration(t)
+	configuration.AdminPort = validTestConfiguration(t).Port
+	configuration.AdminToken = "admin-secret"
+	srv, err := NewServer(configuration)
+	require.NoError(t, err)
+
+	require.NoError(t, srv.Start(context.Background()))
+	require.NotNil(t, srv.AdminAddr())
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/throttling/bans", srv.AdminAddr().String()), nil)
+	require.NoError(t, err)
+	bearer("admin-secret")(req)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	_, err = http.DefaultClient.Do(req)
+	assert.Error(t, err)
+}
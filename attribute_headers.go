@@ -0,0 +1,113 @@
+package carp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	AttributeHeaderMultiValueJoin   = "join"
+	AttributeHeaderMultiValueRepeat = "repeat"
+)
+
+const (
+	AttributeHeaderEncodingBase64  = "base64"
+	AttributeHeaderEncodingRfc2047 = "rfc2047"
+)
+
+const _DefaultAttributeHeaderSeparator = ","
+
+// AttributeHeader maps a CAS attribute to a header of the requests to the target.
+type AttributeHeader struct {
+	// Attribute is the name of the CAS attribute, e.g. mail
+	Attribute string `yaml:"attribute"`
+	// Header is the name of the header of the requests to the target, e.g. X-CARP-Mail
+	Header string `yaml:"header"`
+	// MultiValue defines whether the values of a multi-valued attribute are joined to one header value (join, the
+	// default) or set as repeated headers (repeat).
+	MultiValue string `yaml:"multi-value"`
+	// Separator joins the values of a multi-valued attribute, default: ","
+	Separator string `yaml:"separator"`
+	// Encoding of the values: base64, rfc2047 or empty for no encoding
+	Encoding string `yaml:"encoding"`
+}
+
+// stripAttributeHeaders removes all mapped headers from the request, so that clients cannot spoof them.
+func stripAttributeHeaders(header http.Header, attributeHeaders []AttributeHeader) {
+	for _, attributeHeader := range attributeHeaders {
+		header.Del(attributeHeader.Header)
+	}
+}
+
+// setAttributeHeaders sets the mapped headers from the CAS attributes of the user.
+func setAttributeHeaders(header http.Header, attributeHeaders []AttributeHeader, attributes UserAttibutes) {
+	for _, attributeHeader := range attributeHeaders {
+		values := attributes[attributeHeader.Attribute]
+		if len(values) == 0 {
+			continue
+		}
+
+		encoded := make([]string, 0, len(values))
+		for _, value := range values {
+			encodedValue := attributeHeader.encode(value)
+			if strings.ContainsAny(encodedValue, "\r\n\x00") {
+				log.Warningf("skipping value of attribute %s with control characters for header %s", attributeHeader.Attribute, attributeHeader.Header)
+				continue
+			}
+			encoded = append(encoded, encodedValue)
+		}
+
+		if attributeHeader.MultiValue == AttributeHeaderMultiValueRepeat {
+			for _, value := range encoded {
+				header.Add(attributeHeader.Header, value)
+			}
+		} else if len(encoded) > 0 {
+			header.Set(attributeHeader.Header, strings.Join(encoded, valueOrDefault(attributeHeader.Separator, _DefaultAttributeHeaderSeparator)))
+		}
+	}
+}
+
+func (a AttributeHeader) encode(value string) string {
+	switch a.Encoding {
+	case AttributeHeaderEncodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	case AttributeHeaderEncodingRfc2047:
+		// only values with non-ASCII characters are encoded
+		return mime.BEncoding.Encode("utf-8", value)
+	default:
+		return value
+	}
+}
+
+func validateAttributeHeaders(configuration Configuration) []error {
+	var errs []error
+
+	for i, attributeHeader := range configuration.AttributeHeaders {
+		if attributeHeader.Attribute == "" {
+			errs = append(errs, fmt.Errorf("attribute-headers[%d]: attribute is required", i))
+		}
+
+		if attributeHeader.Header == "" || strings.ContainsAny(attributeHeader.Header, " \t:") {
+			errs = append(errs, fmt.Errorf("attribute-headers[%d]: header must be a valid header name: %s", i, attributeHeader.Header))
+		} else if http.CanonicalHeaderKey(attributeHeader.Header) == http.CanonicalHeaderKey(configuration.PrincipalHeader) {
+			errs = append(errs, fmt.Errorf("attribute-headers[%d]: header must not be the principal-header: %s", i, attributeHeader.Header))
+		}
+
+		switch attributeHeader.MultiValue {
+		case "", AttributeHeaderMultiValueJoin, AttributeHeaderMultiValueRepeat:
+		default:
+			errs = append(errs, fmt.Errorf("attribute-headers[%d]: multi-value must be join or repeat: %s", i, attributeHeader.MultiValue))
+		}
+
+		switch attributeHeader.Encoding {
+		case "", AttributeHeaderEncodingBase64, AttributeHeaderEncodingRfc2047:
+		default:
+			errs = append(errs, fmt.Errorf("attribute-headers[%d]: encoding must be base64 or rfc2047: %s", i, attributeHeader.Encoding))
+		}
+	}
+
+	return errs
+}
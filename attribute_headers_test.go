@@ -0,0 +1,94 @@
+package carp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetAttributeHeaders(t *testing.T) {
+	attributes := UserAttibutes{
+		"mail":        {"tricia@example.com"},
+		"displayName": {"Tricia McMillan"},
+		"groups":      {"admin", "users"},
+		"cn":          {"Jürgen"},
+	}
+
+	t.Run("should join multi-valued attributes", func(t *testing.T) {
+		header := http.Header{}
+
+		setAttributeHeaders(header, []AttributeHeader{
+			{Attribute: "mail", Header: "X-CARP-Mail"},
+			{Attribute: "groups", Header: "X-CARP-Groups"},
+			{Attribute: "groups", Header: "X-CARP-Groups-Semicolon", Separator: ";"},
+			{Attribute: "missing", Header: "X-CARP-Missing"},
+		}, attributes)
+
+		assert.Equal(t, []string{"tricia@example.com"}, header.Values("X-CARP-Mail"))
+		assert.Equal(t, []string{"admin,users"}, header.Values("X-CARP-Groups"))
+		assert.Equal(t, []string{"admin;users"}, header.Values("X-CARP-Groups-Semicolon"))
+		assert.Empty(t, header.Values("X-CARP-Missing"))
+	})
+
+	t.Run("should repeat multi-valued attributes", func(t *testing.T) {
+		header := http.Header{}
+
+		setAttributeHeaders(header, []AttributeHeader{
+			{Attribute: "groups", Header: "X-CARP-Groups", MultiValue: AttributeHeaderMultiValueRepeat},
+		}, attributes)
+
+		assert.Equal(t, []string{"admin", "users"}, header.Values("X-CARP-Groups"))
+	})
+
+	t.Run("should encode values", func(t *testing.T) {
+		header := http.Header{}
+
+		setAttributeHeaders(header, []AttributeHeader{
+			{Attribute: "cn", Header: "X-CARP-Base64", Encoding: AttributeHeaderEncodingBase64},
+			{Attribute: "cn", Header: "X-CARP-Rfc2047", Encoding: AttributeHeaderEncodingRfc2047},
+			{Attribute: "displayName", Header: "X-CARP-Ascii", Encoding: AttributeHeaderEncodingRfc2047},
+		}, attributes)
+
+		assert.Equal(t, "SsO8cmdlbg==", header.Get("X-CARP-Base64"))
+		assert.Equal(t, "=?utf-8?b?SsO8cmdlbg==?=", header.Get("X-CARP-Rfc2047"))
+		assert.Equal(t, "Tricia McMillan", header.Get("X-CARP-Ascii"))
+	})
+
+	t.Run("should skip values with control characters", func(t *testing.T) {
+		header := http.Header{}
+
+		setAttributeHeaders(header, []AttributeHeader{
+			{Attribute: "mail", Header: "X-CARP-Mail"},
+		}, UserAttibutes{"mail": {"tricia@example.com\r\nX-Admin: true"}})
+
+		assert.Empty(t, header.Values("X-CARP-Mail"))
+	})
+}
+
+func TestProxyHandler_stripsAttributeHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Values("X-CARP-Groups"))
+		assert.Equal(t, "bar", r.Header.Get("X-Foo"))
+	}))
+	defer srv.Close()
+
+	ph, err := NewProxyHandler(Configuration{
+		ForwardUnauthenticatedRESTRequests: true,
+		Target:                             srv.URL,
+		PrincipalHeader:                    "X-CARP-User",
+		AttributeHeaders:                   []AttributeHeader{{Attribute: "groups", Header: "X-CARP-Groups"}},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.Header.Add("x-carp-groups", "admin")
+	r.Header.Set("X-Foo", "bar")
+	w := httptest.NewRecorder()
+
+	ph.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
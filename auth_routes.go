@@ -0,0 +1,156 @@
+package carp
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	AuthPolicyPublic   = "public"
+	AuthPolicyOptional = "optional"
+	AuthPolicyRequired = "required"
+	// authPolicyResource requires authentication, but browsers get resources which the target delivers anonymously
+	authPolicyResource = "resource"
+)
+
+// AuthRoute defines the authentication policy of a path of the target. The first route which matches the path of a
+// request decides; requests which match no route require authentication.
+type AuthRoute struct {
+	// PathPrefix matches requests whose path starts with the prefix
+	PathPrefix string `yaml:"path-prefix"`
+	// PathRegex matches requests whose path matches the regular expression
+	PathRegex string `yaml:"path-regex"`
+	// Policy is public (forward without CAS), optional (forward with the identity of an existing CAS session or
+	// anonymously otherwise) or required
+	Policy string `yaml:"policy"`
+}
+
+type authRoute struct {
+	pattern pathPattern
+	policy  string
+}
+
+type authRoutes struct {
+	routes []authRoute
+	// restricted are the access-rules, whose paths require authentication regardless of the routes
+	restricted *accessRules
+}
+
+func newAuthRoutes(configuration Configuration) (*authRoutes, error) {
+	rules, err := compileAccessRules(configuration)
+	if err != nil {
+		return nil, err
+	}
+	routes := &authRoutes{restricted: &accessRules{rules: rules}}
+
+	for i, route := range configuration.AuthRoutes {
+		pattern, err := newPathPattern(route.PathPrefix, route.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth-routes[%d]: %w", i, err)
+		}
+		routes.routes = append(routes.routes, authRoute{pattern: pattern, policy: route.Policy})
+	}
+
+	// the resource-path applies to requests which match no configured route and contain it in their path
+	if configuration.ResourcePath != "" && configuration.BaseUrl != "" {
+		pattern := pathPattern{regex: regexp.MustCompile(regexp.QuoteMeta(configuration.ResourcePath))}
+		routes.routes = append(routes.routes, authRoute{pattern: pattern, policy: authPolicyResource})
+	}
+
+	return routes, nil
+}
+
+// policyFor returns the policy of the first route which matches the request. Requests which match no route, whose
+// path is not canonical or which are subject to an access rule require authentication.
+func (r *authRoutes) policyFor(req *http.Request) string {
+	if r == nil || !isCanonicalPath(req) || r.restricted.restricts(req) {
+		return AuthPolicyRequired
+	}
+
+	for _, route := range r.routes {
+		if route.pattern.matches(req.URL.Path) {
+			return route.policy
+		}
+	}
+
+	return AuthPolicyRequired
+}
+
+// pathPattern matches the path of a request by prefix or regular expression.
+type pathPattern struct {
+	prefix string
+	regex  *regexp.Regexp
+}
+
+func newPathPattern(prefix string, rawRegex string) (pathPattern, error) {
+	if rawRegex == "" {
+		return pathPattern{prefix: prefix}, nil
+	}
+
+	regex, err := regexp.Compile(rawRegex)
+	if err != nil {
+		return pathPattern{}, fmt.Errorf("invalid path-regex: %w", err)
+	}
+
+	return pathPattern{regex: regex}, nil
+}
+
+// matches reports whether the path matches the regular expression or starts with the prefix. A prefix matches whole
+// path segments only, so that /security does not match /securityX.
+func (p pathPattern) matches(requestPath string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(requestPath)
+	}
+	if !strings.HasPrefix(requestPath, p.prefix) {
+		return false
+	}
+	return len(requestPath) == len(p.prefix) || strings.HasSuffix(p.prefix, "/") || requestPath[len(p.prefix)] == '/'
+}
+
+// isCanonicalPath reports whether the path of the request is canonical. Paths with dot segments, empty segments or
+// encoded dots, slashes and backslashes are not, because the target may resolve them to another path than the one
+// matched by carp.
+func isCanonicalPath(req *http.Request) bool {
+	requestPath := req.URL.Path
+	if !strings.HasPrefix(requestPath, "/") {
+		return false
+	}
+
+	escapedPath := strings.ToLower(req.URL.EscapedPath())
+	for _, encoded := range []string{"%2e", "%2f", "%5c"} {
+		if strings.Contains(escapedPath, encoded) {
+			return false
+		}
+	}
+
+	cleanedPath := path.Clean(requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleanedPath != "/" {
+		cleanedPath += "/"
+	}
+	return cleanedPath == requestPath
+}
+
+func validateAuthRoutes(configuration Configuration) []error {
+	var errs []error
+
+	for i, route := range configuration.AuthRoutes {
+		if (route.PathPrefix == "") == (route.PathRegex == "") {
+			errs = append(errs, fmt.Errorf("auth-routes[%d]: exactly one of path-prefix and path-regex is required", i))
+		}
+
+		if _, err := newPathPattern(route.PathPrefix, route.PathRegex); err != nil {
+			errs = append(errs, fmt.Errorf("auth-routes[%d]: %w", i, err))
+		}
+
+		switch route.Policy {
+		case AuthPolicyPublic, AuthPolicyOptional, AuthPolicyRequired:
+		default:
+			errs = append(errs, fmt.Errorf("auth-routes[%d]: policy must be one of public, optional or required: %s", i, route.Policy))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,202 @@
+package carp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthRoutes_policyFor(t *testing.T) {
+	routes, err := newAuthRoutes(Configuration{AuthRoutes: []AuthRoute{
+		{PathPrefix: "/nexus/static/", Policy: AuthPolicyPublic},
+		{PathRegex: `^/nexus/repository/[^/]+/public/`, Policy: AuthPolicyOptional},
+		{PathPrefix: "/nexus/", Policy: AuthPolicyRequired},
+	}})
+	require.NoError(t, err)
+
+	policyFor := func(path string) string {
+		return routes.policyFor(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, AuthPolicyPublic, policyFor("/nexus/static/logo.png"))
+	assert.Equal(t, AuthPolicyOptional, policyFor("/nexus/repository/releases/public/a.jar"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/repository/releases/private/a.jar"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/other"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/static/%2e%2e/service/rest/v1/security"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/static/../service/rest/v1/security"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/static//logo.png"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/static/./logo.png"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/static%2flogo.png"))
+
+	restrictedRoutes, err := newAuthRoutes(Configuration{
+		AuthRoutes:  []AuthRoute{{PathPrefix: "/nexus/", Policy: AuthPolicyPublic}},
+		AccessRules: []AccessRule{{PathPrefix: "/nexus/service/rest/v1/security", Methods: []string{http.MethodDelete}, Groups: []string{"admins"}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AuthPolicyRequired, restrictedRoutes.policyFor(httptest.NewRequest(http.MethodDelete, "/nexus/service/rest/v1/security/users", nil)))
+	assert.Equal(t, AuthPolicyPublic, restrictedRoutes.policyFor(httptest.NewRequest(http.MethodGet, "/nexus/service/rest/v1/security/users", nil)))
+
+	var noRoutes *authRoutes
+	assert.Equal(t, AuthPolicyRequired, noRoutes.policyFor(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestAuthRoutes_resourcePath(t *testing.T) {
+	routes, err := newAuthRoutes(Configuration{
+		BaseUrl:      "https://nexus.example.com",
+		ResourcePath: "/repository",
+		AuthRoutes:   []AuthRoute{{PathPrefix: "/nexus/repository/public/", Policy: AuthPolicyPublic}},
+	})
+	require.NoError(t, err)
+
+	policyFor := func(path string) string {
+		return routes.policyFor(httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, AuthPolicyPublic, policyFor("/nexus/repository/public/a.jar"))
+	assert.Equal(t, authPolicyResource, policyFor("/nexus/repository/releases/a.jar"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/service/rest"))
+	assert.Equal(t, AuthPolicyRequired, policyFor("/nexus/x/../repository/releases/a.jar"))
+}
+
+func TestAuthRoutes_handlerChain(t *testing.T) {
+	var forwardedPrincipal []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedPrincipal = append(forwardedPrincipal, r.Header.Get("X-CARP-Authentication"))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+
+	configuration := validTestConfiguration(t)
+	configuration.Target = backend.URL
+	configuration.CasUrl = "https://cas.example.com/cas"
+	configuration.PrincipalHeader = "X-CARP-Authentication"
+	configuration.AuthRoutes = []AuthRoute{
+		{PathPrefix: "/public/", Policy: AuthPolicyPublic},
+		{PathPrefix: "/optional/", Policy: AuthPolicyOptional},
+	}
+	configuration.AccessRules = []AccessRule{
+		{PathPrefix: "/public/admin/", Groups: []string{"admins"}},
+		{PathPrefix: "/optional/admin/", Groups: []string{"admins"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := createHandlersForConfig(ctx, configuration, newHandlerState())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	get := func(path string, browser bool, cookies ...*http.Cookie) *http.Response {
+		req, lErr := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, lErr)
+		if browser {
+			req.Header.Set("User-Agent", "Mozilla/5.0")
+		}
+		req.Header.Set("X-CARP-Authentication", "spoofed")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, lErr := client.Do(req)
+		require.NoError(t, lErr)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	t.Run("should forward public route without cas", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		assert.Equal(t, http.StatusTeapot, get("/public/logo.png", true).StatusCode)
+		assert.Equal(t, http.StatusTeapot, get("/public/logo.png", false).StatusCode)
+		assert.Equal(t, []string{"", ""}, forwardedPrincipal)
+	})
+
+	t.Run("should require authentication for public route with dot segments", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		assert.Equal(t, http.StatusUnauthorized, get("/public/%2e%2e/private", false).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, get("/public/../private", false).StatusCode)
+		assert.Equal(t, http.StatusFound, get("/public/%2e%2e/private", true).StatusCode)
+		assert.Empty(t, forwardedPrincipal)
+	})
+
+	t.Run("should require authentication for public and optional routes of access-rules", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		resp := get("/public/admin/users", true)
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.NotContains(t, resp.Header.Get("Location"), "gateway")
+		assert.Equal(t, http.StatusUnauthorized, get("/public/admin/users", false).StatusCode)
+		resp = get("/optional/admin/users", true)
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.NotContains(t, resp.Header.Get("Location"), "gateway")
+		assert.Equal(t, http.StatusUnauthorized, get("/optional/admin/users", false).StatusCode)
+		assert.Empty(t, forwardedPrincipal)
+	})
+
+	t.Run("should use cas gateway once on optional route", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		resp := get("/optional/page", true)
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		location, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "/cas/login", location.Path)
+		assert.Equal(t, "true", location.Query().Get("gateway"))
+		assert.Contains(t, location.Query().Get("service"), "/optional/page")
+
+		var gatewayCookie *http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == _GatewayCookieName {
+				gatewayCookie = cookie
+			}
+		}
+		require.NotNil(t, gatewayCookie)
+		assert.Zero(t, gatewayCookie.MaxAge, "the gateway cookie lives for the browser session")
+
+		assert.Equal(t, http.StatusTeapot, get("/optional/page", true, gatewayCookie).StatusCode)
+		assert.Equal(t, []string{""}, forwardedPrincipal)
+	})
+
+	t.Run("should forward post request of browser on optional route without cas gateway", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/optional/form", strings.NewReader("a=b"))
+		require.NoError(t, err)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+		assert.Equal(t, []string{""}, forwardedPrincipal)
+	})
+
+	t.Run("should forward rest request without credentials on optional route", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		assert.Equal(t, http.StatusTeapot, get("/optional/api", false).StatusCode)
+		assert.Equal(t, []string{""}, forwardedPrincipal)
+	})
+
+	t.Run("should require authentication on other routes", func(t *testing.T) {
+		forwardedPrincipal = nil
+
+		resp := get("/private", true)
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.NotContains(t, resp.Header.Get("Location"), "gateway")
+		assert.Equal(t, http.StatusUnauthorized, get("/private", false).StatusCode)
+		assert.Empty(t, forwardedPrincipal)
+	})
+}
@@ -0,0 +1,189 @@
+package carp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	_CasSessionCookieName        = "_cas_session"
+	_DefaultBackendLogoutMethod  = http.MethodPost
+	_DefaultBackendLogoutTimeout = 10 * time.Second
+)
+
+// LogoutCookie is a cookie which is expired on logout.
+type LogoutCookie struct {
+	Name string `yaml:"name"`
+	// Path of the cookie, defaults to /.
+	Path string `yaml:"path"`
+}
+
+// casLogoutRequest is the single logout request which CAS posts to carp when a user logs out of CAS.
+type casLogoutRequest struct {
+	SessionIndex string `xml:"SessionIndex"`
+}
+
+// backendLogout propagates single logouts of CAS to the target. It calls the logout endpoint of the target for the
+// user and clears the cookies of the target on the next request of the browser.
+type backendLogout struct {
+	tickets         *ticketStore
+	client          *http.Client
+	endpoint        *url.URL
+	method          string
+	principalHeader string
+	cookies         []LogoutCookie
+}
+
+func backendLogoutConfigured(configuration Configuration) bool {
+	return configuration.BackendLogoutPath != "" || len(configuration.BackendLogoutCookies) > 0
+}
+
+func newBackendLogout(configuration Configuration, tickets *ticketStore) (*backendLogout, error) {
+	logout := &backendLogout{
+		tickets:         tickets,
+		client:          &http.Client{Timeout: _DefaultBackendLogoutTimeout},
+		method:          valueOrDefault(configuration.BackendLogoutMethod, _DefaultBackendLogoutMethod),
+		principalHeader: configuration.PrincipalHeader,
+		cookies:         configuration.BackendLogoutCookies,
+	}
+
+	if configuration.BackendLogoutPath != "" {
+		target, err := url.Parse(configuration.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target-url: %s: %w", configuration.Target, err)
+		}
+		logout.endpoint = target.JoinPath(configuration.BackendLogoutPath)
+	}
+
+	return logout, nil
+}
+
+// wrapWithBackendLogoutIfNeeded wraps the handler of the CAS client, which ends the session of a single logout
+// itself, with the propagation of the logout to the target.
+func wrapWithBackendLogoutIfNeeded(configuration Configuration, tickets *ticketStore, handler http.Handler) (http.Handler, error) {
+	if !backendLogoutConfigured(configuration) {
+		return handler, nil
+	}
+
+	logout, err := newBackendLogout(configuration, tickets)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSingleLogoutRequest(r) {
+			logout.propagate(r)
+		} else {
+			logout.clearCookiesIfLoggedOut(w, r)
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+// propagate resolves the user of the ticket in the single logout request and calls the logout endpoint of the
+// target for the user.
+func (l *backendLogout) propagate(r *http.Request) {
+	logger := newRequestLogger(r)
+
+	var logoutRequest casLogoutRequest
+	if err := xml.Unmarshal([]byte(r.FormValue("logoutRequest")), &logoutRequest); err != nil {
+		logger.error(fmt.Sprintf("failed to parse single logout request: %s", err.Error()))
+		return
+	}
+
+	username, ok := l.tickets.logOut(strings.TrimSpace(logoutRequest.SessionIndex))
+	if !ok {
+		logger.debug("Found single logout request for unknown ticket")
+		return
+	}
+
+	logger = logger.withUsername(username)
+	if l.endpoint == nil {
+		logger.info("Received single logout; backend cookies are cleared on next request")
+		return
+	}
+
+	if err := l.callEndpoint(r.Context(), username); err != nil {
+		logger.error(fmt.Sprintf("failed to propagate single logout to target: %s", err.Error()))
+		return
+	}
+	logger.info("Propagated single logout to target")
+}
+
+func (l *backendLogout) callEndpoint(ctx context.Context, username string) error {
+	req, err := http.NewRequestWithContext(ctx, l.method, l.endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(l.principalHeader, username)
+	injectTraceContext(ctx, req)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// clearCookiesIfLoggedOut expires the configured cookies of the target if the session of the request was ended by a
+// single logout.
+func (l *backendLogout) clearCookiesIfLoggedOut(w http.ResponseWriter, r *http.Request) {
+	if len(l.cookies) == 0 {
+		return
+	}
+
+	cookie, err := r.Cookie(_CasSessionCookieName)
+	if err != nil || !l.tickets.takeLoggedOut(cookie.Value) {
+		return
+	}
+
+	newRequestLogger(r).info("Clear cookies of target after single logout")
+	expireCookies(w, l.cookies)
+}
+
+func validateBackendLogout(configuration Configuration) []error {
+	var errs []error
+
+	if configuration.BackendLogoutMethod != "" && configuration.BackendLogoutPath == "" {
+		errs = append(errs, errors.New("backend-logout-path is required for backend-logout-method"))
+	}
+
+	errs = append(errs, validatePath("backend-logout-path", configuration.BackendLogoutPath))
+	errs = append(errs, validateLogoutCookies("backend-logout-cookies", configuration.BackendLogoutCookies)...)
+
+	return errs
+}
+
+func expireCookies(w http.ResponseWriter, cookies []LogoutCookie) {
+	for _, cookie := range cookies {
+		http.SetCookie(w, &http.Cookie{
+			Name:   cookie.Name,
+			Path:   valueOrDefault(cookie.Path, "/"),
+			MaxAge: -1,
+		})
+	}
+}
+
+func validateLogoutCookies(key string, cookies []LogoutCookie) []error {
+	var errs []error
+
+	for i, cookie := range cookies {
+		if cookie.Name == "" || strings.ContainsAny(cookie.Name, " \t;,=") {
+			errs = append(errs, fmt.Errorf("%s[%d]: invalid cookie name: %q", key, i, cookie.Name))
+		}
+		errs = append(errs, validatePath(fmt.Sprintf("%s[%d].path", key, i), cookie.Path))
+	}
+
+	return errs
+}
@@ -0,0 +1,103 @@
+package carp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const _TestLogoutRequest = `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="LR-1" Version="2.0" IssueInstant="2024-01-01T12:00:00Z">
+  <saml:NameID xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">tricia</saml:NameID>
+  <samlp:SessionIndex>%s</samlp:SessionIndex>
+</samlp:LogoutRequest>`
+
+func TestBackendLogout(t *testing.T) {
+	var grantingTicketRequests atomic.Int32
+	casServer := newFakeCasRestServer(t, &grantingTicketRequests)
+
+	var logouts []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logouts = append(logouts, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-CARP-Authentication"))
+	}))
+	t.Cleanup(backend.Close)
+
+	configuration := Configuration{
+		CasUrl:               casServer.URL + "/cas",
+		ServiceUrl:           "http://carp.example.com",
+		Target:               backend.URL,
+		PrincipalHeader:      "X-CARP-Authentication",
+		BackendLogoutPath:    "/api/logout",
+		BackendLogoutCookies: []LogoutCookie{{Name: "JSESSIONID"}, {Name: "remember", Path: "/app"}},
+	}
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler, err := newCasRequestHandler(configuration, target, newHandlerState())
+	require.NoError(t, err)
+
+	browserRequest := func(method string, target string, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	singleLogout := func(ticket string) *httptest.ResponseRecorder {
+		form := url.Values{"logoutRequest": {strings.Replace(_TestLogoutRequest, "%s", ticket, 1)}}
+		return browserRequest(http.MethodPost, "/", form.Encode())
+	}
+
+	login := browserRequest(http.MethodGet, "/app?ticket=ST-tricia", "")
+	require.Equal(t, http.StatusOK, login.Code)
+	var session *http.Cookie
+	for _, cookie := range login.Result().Cookies() {
+		if cookie.Name == _CasSessionCookieName {
+			session = cookie
+		}
+	}
+	require.NotNil(t, session)
+
+	t.Run("should ignore unknown tickets", func(t *testing.T) {
+		w := singleLogout("ST-unknown")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, logouts)
+	})
+
+	t.Run("should call logout endpoint of target for user of ticket", func(t *testing.T) {
+		w := singleLogout("ST-tricia")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []string{"POST /api/logout tricia"}, logouts)
+	})
+
+	t.Run("should clear cookies of target on next request", func(t *testing.T) {
+		w := browserRequest(http.MethodGet, "/app", "", session)
+
+		cleared := map[string]string{}
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.MaxAge < 0 {
+				cleared[cookie.Name] = cookie.Path
+			}
+		}
+		assert.Equal(t, map[string]string{"JSESSIONID": "/", "remember": "/app", _CasSessionCookieName: ""}, cleared)
+	})
+
+	t.Run("should clear cookies only once", func(t *testing.T) {
+		w := browserRequest(http.MethodGet, "/app", "", session)
+
+		for _, cookie := range w.Result().Cookies() {
+			assert.NotEqual(t, "JSESSIONID", cookie.Name)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+package carp
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	_DefaultLimiterBanWindow      = 600
+	_DefaultLimiterBanDuration    = 60
+	_DefaultLimiterBanMaxDuration = 86400
+)
+
+// Ban blocks the requests of a throttling key, e.g. service-account:10.0.0.1:username, until a point in time.
+type Ban struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+	// Level is the number of bans of the key before this one. The duration doubles with every level.
+	Level int `json:"level"`
+}
+
+// banPolicy bans a key for duration*2^level after threshold throttled requests within window.
+type banPolicy struct {
+	threshold   int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+}
+
+func newBanPolicy(configuration Configuration) banPolicy {
+	return banPolicy{
+		threshold:   configuration.LimiterBanThreshold,
+		window:      secondsOrDefault(configuration.LimiterBanWindow, _DefaultLimiterBanWindow),
+		duration:    secondsOrDefault(configuration.LimiterBanDuration, _DefaultLimiterBanDuration),
+		maxDuration: secondsOrDefault(configuration.LimiterBanMaxDuration, _DefaultLimiterBanMaxDuration),
+	}
+}
+
+func (p banPolicy) durationFor(level int) time.Duration {
+	duration := float64(p.duration) * math.Pow(2, float64(level))
+	if duration > float64(p.maxDuration) {
+		return p.maxDuration
+	}
+	return time.Duration(duration)
+}
+
+type offender struct {
+	throttles []time.Time
+	ban       Ban
+
+	// queue is the list of the banList which holds the offender at element
+	queue   *list.List
+	element *list.Element
+}
+
+// banList keeps the throttled requests and bans of at most maxOffenders keys. If a snapshot file is set, the bans are
+// written to it in the background after every change and read from it on creation, so that they survive a restart.
+type banList struct {
+	mu        sync.Mutex
+	offenders map[string]*offender
+	// throttled orders the offenders without active ban by their last throttled request and banned orders the banned
+	// offenders by the start of their ban, the most recent first, so that offenders are evicted in constant time
+	throttled    *list.List
+	banned       *list.List
+	maxOffenders int
+	snapshotFile string
+	now          func() time.Time
+
+	// changed is set if the bans changed since the last snapshot; writing is set while a snapshot is written
+	changed bool
+	writing bool
+	written *sync.Cond
+}
+
+func newBanList(snapshotFile string, maxOffenders int) *banList {
+	if maxOffenders <= 0 {
+		maxOffenders = _DefaultLimiterMaxEntries
+	}
+
+	bans := &banList{
+		offenders:    map[string]*offender{},
+		throttled:    list.New(),
+		banned:       list.New(),
+		maxOffenders: maxOffenders,
+		snapshotFile: snapshotFile,
+		now:          time.Now,
+	}
+	bans.written = sync.NewCond(&bans.mu)
+	bans.load()
+	return bans
+}
+
+// bannedFor returns the remaining duration of the ban of the key.
+func (l *banList) bannedFor(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	o, ok := l.offenders[key]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := o.ban.Until.Sub(l.now())
+	return remaining, remaining > 0
+}
+
+// recordThrottle records a throttled request of the key and bans the key if it reached the threshold of the policy.
+// The duration of the new ban is returned.
+func (l *banList) recordThrottle(key string, policy banPolicy) (time.Duration, bool) {
+	if policy.threshold <= 0 {
+		return 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	o, ok := l.offenders[key]
+	if !ok {
+		if len(l.offenders) >= l.maxOffenders && !l.evictOffender(now) {
+			// all tracked keys are banned; the key is still throttled by its limiter
+			return 0, false
+		}
+		o = &offender{ban: Ban{Key: key}}
+		l.offenders[key] = o
+	}
+	if !o.ban.Until.After(now) {
+		l.track(o, l.throttled)
+	}
+
+	o.throttles = append(throttlesSince(o.throttles, now.Add(-policy.window)), now)
+	if len(o.throttles) < policy.threshold {
+		return 0, false
+	}
+
+	if !o.ban.Until.IsZero() && now.After(o.ban.Until.Add(policy.maxDuration)) {
+		// the key behaved for a long time, start again with the shortest ban
+		o.ban.Level = 0
+	} else if !o.ban.Until.IsZero() {
+		o.ban.Level++
+	}
+
+	duration := policy.durationFor(o.ban.Level)
+	o.ban.Until = now.Add(duration)
+	o.throttles = nil
+	l.track(o, l.banned)
+	l.save()
+
+	return duration, true
+}
+
+// evictOffender removes the key without active ban whose last throttled request is the oldest. If all keys were
+// banned, the key with the oldest ban is removed if its ban expired. The caller must hold the lock.
+func (l *banList) evictOffender(now time.Time) bool {
+	element := l.throttled.Back()
+	if element == nil {
+		element = l.banned.Back()
+		if element == nil || element.Value.(*offender).ban.Until.After(now) {
+			return false
+		}
+	}
+
+	evicted := element.Value.(*offender)
+	l.remove(evicted)
+	if !evicted.ban.Until.IsZero() {
+		l.save()
+	}
+	return true
+}
+
+// track moves the offender to the front of the queue. The caller must hold the lock.
+func (l *banList) track(o *offender, queue *list.List) {
+	if o.element != nil {
+		o.queue.Remove(o.element)
+	}
+	o.queue = queue
+	o.element = queue.PushFront(o)
+}
+
+// remove removes the offender from the list. The caller must hold the lock.
+func (l *banList) remove(o *offender) {
+	if o.element != nil {
+		o.queue.Remove(o.element)
+	}
+	delete(l.offenders, o.ban.Key)
+}
+
+func throttlesSince(throttles []time.Time, since time.Time) []time.Time {
+	for i, throttle := range throttles {
+		if throttle.After(since) {
+			return throttles[i:]
+		}
+	}
+	return nil
+}
+
+// unban removes the ban and the history of the key.
+func (l *banList) unban(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	o, ok := l.offenders[key]
+	if !ok {
+		return false
+	}
+
+	l.remove(o)
+	l.save()
+	return o.ban.Until.After(l.now())
+}
+
+// bans returns the active bans ordered by key.
+func (l *banList) bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bans := []Ban{}
+	for _, o := range l.offenders {
+		if o.ban.Until.After(now) {
+			bans = append(bans, o.ban)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+// cleanup removes keys without recent throttled requests whose last ban is older than the maximum ban duration.
+func (l *banList) cleanup(policy banPolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	changed := false
+	for _, o := range l.offenders {
+		o.throttles = throttlesSince(o.throttles, now.Add(-policy.window))
+		if len(o.throttles) == 0 && now.After(o.ban.Until.Add(policy.maxDuration)) {
+			l.remove(o)
+			changed = changed || !o.ban.Until.IsZero()
+		}
+	}
+
+	if changed {
+		l.save()
+	}
+}
+
+func (l *banList) load() {
+	if l.snapshotFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(l.snapshotFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to read ban snapshot %s: %s", l.snapshotFile, err.Error())
+		return
+	}
+
+	var bans []Ban
+	if err = json.Unmarshal(data, &bans); err != nil {
+		log.Errorf("failed to parse ban snapshot %s: %s", l.snapshotFile, err.Error())
+		return
+	}
+
+	// the oldest ban is evicted first
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	for _, ban := range bans {
+		o := &offender{ban: ban}
+		l.offenders[ban.Key] = o
+		l.track(o, l.banned)
+	}
+	log.Infof("Loaded %d bans from snapshot %s", len(bans), l.snapshotFile)
+}
+
+// save schedules a snapshot of all bans. The snapshot is written in the background, so that requests do not wait for
+// the file; changes during a write are combined into the next snapshot. The caller must hold the lock.
+func (l *banList) save() {
+	if l.snapshotFile == "" {
+		return
+	}
+
+	l.changed = true
+	if !l.writing {
+		l.writing = true
+		go l.writeSnapshots()
+	}
+}
+
+// writeSnapshots writes snapshots until the bans do not change anymore. Expired bans are kept, so that their level is
+// not lost on restart.
+func (l *banList) writeSnapshots() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.changed {
+		l.changed = false
+		bans := []Ban{}
+		for _, o := range l.offenders {
+			if !o.ban.Until.IsZero() {
+				bans = append(bans, o.ban)
+			}
+		}
+
+		l.mu.Unlock()
+		if err := writeFileAtomically(l.snapshotFile, bans); err != nil {
+			log.Errorf("failed to write ban snapshot %s: %s", l.snapshotFile, err.Error())
+		}
+		l.mu.Lock()
+	}
+
+	l.writing = false
+	l.written.Broadcast()
+}
+
+// flush waits until the pending snapshot is written.
+func (l *banList) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.writing {
+		l.written.Wait()
+	}
+}
+
+// writeFileAtomically writes the value as JSON to a temporary file and renames it, so that readers never see a
+// partially written file.
+func writeFileAtomically(path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmp.Name(), err)
+	}
+	return nil
+}
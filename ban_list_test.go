@@ -0,0 +1,263 @@
+package carp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBanList(snapshotFile string, now *time.Time) *banList {
+	bans := newBanList(snapshotFile, 0)
+	bans.now = func() time.Time { return *now }
+	return bans
+}
+
+func TestBanList(t *testing.T) {
+	policy := banPolicy{threshold: 3, window: time.Minute, duration: time.Minute, maxDuration: 10 * time.Minute}
+
+	t.Run("should ban key after threshold within window", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		_, banned := bans.recordThrottle("key", policy)
+		assert.False(t, banned)
+		_, banned = bans.recordThrottle("key", policy)
+		assert.False(t, banned)
+
+		duration, banned := bans.recordThrottle("key", policy)
+		require.True(t, banned)
+		assert.Equal(t, time.Minute, duration)
+
+		remaining, banned := bans.bannedFor("key")
+		assert.True(t, banned)
+		assert.Equal(t, time.Minute, remaining)
+
+		_, banned = bans.bannedFor("other")
+		assert.False(t, banned)
+	})
+
+	t.Run("should forget throttles outside of window", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		bans.recordThrottle("key", policy)
+		bans.recordThrottle("key", policy)
+		now = now.Add(2 * time.Minute)
+
+		_, banned := bans.recordThrottle("key", policy)
+		assert.False(t, banned)
+	})
+
+	t.Run("should double duration up to max duration", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		var durations []time.Duration
+		for i := 0; i < 5; i++ {
+			for j := 0; j < policy.threshold; j++ {
+				if duration, banned := bans.recordThrottle("key", policy); banned {
+					durations = append(durations, duration)
+				}
+			}
+			_, banned := bans.bannedFor("key")
+			assert.True(t, banned)
+			now = now.Add(durations[len(durations)-1])
+		}
+
+		assert.Equal(t, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute}, durations)
+	})
+
+	t.Run("should reset level after long good behaviour", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("key", policy)
+		}
+		now = now.Add(time.Hour)
+
+		var duration time.Duration
+		for j := 0; j < policy.threshold; j++ {
+			duration, _ = bans.recordThrottle("key", policy)
+		}
+		assert.Equal(t, time.Minute, duration)
+	})
+
+	t.Run("should not ban without threshold", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		for j := 0; j < 10; j++ {
+			_, banned := bans.recordThrottle("key", banPolicy{})
+			assert.False(t, banned)
+		}
+	})
+
+	t.Run("should unban key", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("key", policy)
+		}
+		require.Len(t, bans.bans(), 1)
+
+		assert.True(t, bans.unban("key"))
+		assert.False(t, bans.unban("key"))
+		assert.Empty(t, bans.bans())
+		_, banned := bans.bannedFor("key")
+		assert.False(t, banned)
+	})
+
+	t.Run("should remove old offenders on cleanup", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("banned", policy)
+		}
+		bans.recordThrottle("throttled", policy)
+
+		now = now.Add(2 * time.Minute)
+		bans.cleanup(policy)
+		assert.Len(t, bans.offenders, 1)
+
+		now = now.Add(time.Hour)
+		bans.cleanup(policy)
+		assert.Empty(t, bans.offenders)
+	})
+
+	t.Run("should evict offender without ban at max offenders", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+		bans.maxOffenders = 3
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("banned", policy)
+		}
+		bans.recordThrottle("old", policy)
+		now = now.Add(time.Second)
+		bans.recordThrottle("recent", policy)
+		now = now.Add(time.Second)
+		bans.recordThrottle("new", policy)
+
+		assert.Len(t, bans.offenders, 3)
+		assert.NotContains(t, bans.offenders, "old")
+		assert.Contains(t, bans.offenders, "recent")
+		assert.Contains(t, bans.offenders, "new")
+		_, banned := bans.bannedFor("banned")
+		assert.True(t, banned)
+	})
+
+	t.Run("should not evict banned offenders", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+		bans.maxOffenders = 1
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("banned", policy)
+		}
+		for j := 0; j < policy.threshold; j++ {
+			_, banned := bans.recordThrottle("other", policy)
+			assert.False(t, banned)
+		}
+
+		assert.Len(t, bans.offenders, 1)
+		assert.Contains(t, bans.offenders, "banned")
+	})
+
+	t.Run("should evict expired ban if all offenders were banned", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		bans := newTestBanList("", &now)
+		bans.maxOffenders = 1
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("banned", policy)
+		}
+		now = now.Add(2 * time.Minute)
+		bans.recordThrottle("other", policy)
+
+		assert.Len(t, bans.offenders, 1)
+		assert.Contains(t, bans.offenders, "other")
+	})
+
+	t.Run("should keep bans in snapshot file", func(t *testing.T) {
+		snapshotFile := filepath.Join(t.TempDir(), "bans.json")
+		now := time.Unix(1000, 0)
+		bans := newTestBanList(snapshotFile, &now)
+
+		for j := 0; j < policy.threshold; j++ {
+			bans.recordThrottle("key", policy)
+		}
+		bans.flush()
+
+		restored := newTestBanList(snapshotFile, &now)
+		require.Len(t, restored.bans(), 1)
+		assert.Equal(t, "key", restored.bans()[0].Key)
+		assert.Equal(t, now.Add(time.Minute), restored.bans()[0].Until.Local())
+
+		// the level survives the restart
+		now = now.Add(time.Minute)
+		var duration time.Duration
+		for j := 0; j < policy.threshold; j++ {
+			duration, _ = restored.recordThrottle("key", policy)
+		}
+		assert.Equal(t, 2*time.Minute, duration)
+	})
+}
+
+func TestThrottlingHandler_ban(t *testing.T) {
+	configuration := Configuration{
+		ServiceAccountNameRegex: "^service_account_",
+		LimiterTokenRate:        1,
+		LimiterBurstSize:        1,
+		LimiterBanThreshold:     2,
+		LimiterBanDuration:      60,
+	}
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	state := &throttling{store: NewMemoryLimiterStore(_DefaultLimiterMaxEntries), bans: newBanList("", 0)}
+	handler := newThrottlingHandler(context.TODO(), configuration, target, state)
+
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+		req = req.WithContext(context.WithValue(req.Context(), _ServiceAccountAuthContextKey, true))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.SetBasicAuth("service_account_test", "secret")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request().Code)
+	assert.Equal(t, http.StatusTooManyRequests, request().Code)
+
+	banned := request()
+	assert.Equal(t, http.StatusTooManyRequests, banned.Code)
+	assert.Equal(t, "60", banned.Header().Get(_HttpHeaderRetryAfter))
+
+	key := _ServiceAccountLimiterKeyPrefix + "10.0.0.1:service_account_test"
+	require.Len(t, state.bans.bans(), 1)
+	assert.Equal(t, key, state.bans.bans()[0].Key)
+
+	assert.Equal(t, "60", banned.Header().Get(_HttpHeaderRateLimitReset))
+
+	// the ban outlasts the token bucket
+	state.store.Reset(key)
+	rejected := request()
+	assert.Equal(t, http.StatusTooManyRequests, rejected.Code)
+	assert.Equal(t, "1", rejected.Header().Get(_HttpHeaderRateLimitLimit))
+	assert.Equal(t, "0", rejected.Header().Get(_HttpHeaderRateLimitRemaining))
+	assert.Equal(t, "60", rejected.Header().Get(_HttpHeaderRateLimitReset))
+	assert.Equal(t, "60", rejected.Header().Get(_HttpHeaderRetryAfter))
+
+	assert.True(t, state.bans.unban(key))
+	assert.Equal(t, http.StatusUnauthorized, request().Code)
+}
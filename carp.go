@@ -2,41 +2,496 @@ package carp
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
-// NewServer creates a new carp server. Start the server with ListenAndServe()
-func NewServer(configuration Configuration) (*http.Server, error) {
-	mainHandler, err := createHandlersForConfig(configuration)
+const (
+	// ShutdownPhaseHttpServer is the shutdown phase in which the listener is closed and in-flight requests are drained.
+	ShutdownPhaseHttpServer = "http-server"
+	// ShutdownPhaseBackgroundJobs is the shutdown phase in which background jobs (e.g. the throttling cleanup) are stopped.
+	ShutdownPhaseBackgroundJobs = "background-jobs"
+)
+
+const _BackgroundJobsContextKey = "BackgroundJobs"
+
+// ShutdownError reports the shutdown phase of a Server that failed.
+type ShutdownError struct {
+	Phase string
+	Err   error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("failed to shutdown carp server in phase %s: %s", e.Phase, e.Err.Error())
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Server is a carp server with a graceful lifecycle. Start it with Start(), stop it with Shutdown() and
+// block until it has stopped with Wait().
+type Server struct {
+	httpServer  *http.Server
+	adminServer *http.Server
+	jobs        *backgroundJobs
+	jobsCtx     context.Context
+	cancelJobs  context.CancelFunc
+	state       *handlerState
+
+	// reloadMu guards the creation of handler chains and background jobs; no job is started once shuttingDown is set,
+	// so that no job is added while Shutdown waits for the jobs.
+	reloadMu     sync.Mutex
+	shuttingDown bool
+	chain        atomic.Pointer[handlerChain]
+
+	mu            sync.Mutex
+	listener      net.Listener
+	adminListener net.Listener
+	started       bool
+	done          chan struct{}
+	err           error
+	stopOnce      sync.Once
+}
+
+// handlerChain is the handler chain built for one configuration. It is replaced as a whole on reload.
+type handlerChain struct {
+	configuration Configuration
+	handler       http.Handler
+	adminHandler  http.Handler
+	cancel        context.CancelFunc
+}
+
+// handlerState is the state of the handlers which survives a reload of the configuration.
+type handlerState struct {
+	mu               sync.Mutex
+	casClients       map[casClientKey]*casClients
+	throttling       *throttling
+	accessLogOutputs map[accessLogOutputKey]io.WriteCloser
+	metrics          *Metrics
+}
+
+func newHandlerState() *handlerState {
+	state := &handlerState{
+		casClients:       map[casClientKey]*casClients{},
+		accessLogOutputs: map[accessLogOutputKey]io.WriteCloser{},
+		metrics:          NewMetrics(),
+	}
+	state.metrics.throttlingClients = state.countLimiters
+	return state
+}
+
+// getOrCreateThrottling returns the LimiterStore and ban list of the state. They are created for the first
+// configuration and kept on reload.
+func (state *handlerState) getOrCreateThrottling(configuration Configuration) *throttling {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.throttling == nil {
+		state.throttling = &throttling{
+			store: newLimiterStore(configuration),
+			bans:  newBanList(configuration.LimiterBanSnapshotFile, configuration.LimiterMaxEntries),
+		}
+	}
+	return state.throttling
+}
+
+// flushBanSnapshot waits until the last change of the bans is written to the snapshot file or the context expires.
+func (state *handlerState) flushBanSnapshot(ctx context.Context) error {
+	state.mu.Lock()
+	throttling := state.throttling
+	state.mu.Unlock()
+
+	if throttling == nil {
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		throttling.bans.flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to flush ban snapshot: %w", ctx.Err())
+	}
+}
+
+func (state *handlerState) countLimiters() int {
+	state.mu.Lock()
+	throttling := state.throttling
+	state.mu.Unlock()
+
+	if throttling == nil {
+		return 0
+	}
+	return throttling.store.Len()
+}
+
+// NewServer creates a new carp server. Start the server with Start()
+func NewServer(configuration Configuration) (*Server, error) {
+	if err := configuration.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	jobs := &backgroundJobs{}
+	jobsCtx, cancelJobs := context.WithCancel(context.WithValue(context.Background(), _BackgroundJobsContextKey, jobs))
+
+	server := &Server{
+		jobs:       jobs,
+		jobsCtx:    jobsCtx,
+		cancelJobs: cancelJobs,
+		state:      newHandlerState(),
+		done:       make(chan struct{}),
+	}
+
+	chain, err := server.buildHandlerChain(configuration)
 	if err != nil {
+		cancelJobs()
+		jobs.wait()
+		server.state.closeAccessLogOutputs()
 		return nil, err
 	}
+	server.chain.Store(chain)
 
-	return &http.Server{
+	server.httpServer = &http.Server{
 		Addr:    ":" + strconv.Itoa(configuration.Port),
-		Handler: mainHandler,
+		Handler: http.HandlerFunc(server.serveHTTP),
+	}
+
+	if configuration.AdminPort > 0 {
+		server.adminServer = &http.Server{
+			Addr:    ":" + strconv.Itoa(configuration.AdminPort),
+			Handler: http.HandlerFunc(server.serveAdminHTTP),
+		}
+	}
+
+	return server, nil
+}
+
+func (s *Server) buildHandlerChain(configuration Configuration) (*handlerChain, error) {
+	ctx, cancel := context.WithCancel(s.jobsCtx)
+
+	handler, err := createHandlersForConfig(ctx, configuration, s.state)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var adminHandler http.Handler
+	if configuration.AdminPort > 0 {
+		adminHandler, err = newAdminHandler(s, configuration)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	return &handlerChain{
+		configuration: configuration,
+		handler:       handler,
+		adminHandler:  adminHandler,
+		cancel:        cancel,
 	}, nil
 }
 
-func createHandlersForConfig(configuration Configuration) (http.HandlerFunc, error) {
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.chain.Load().handler.ServeHTTP(w, r)
+}
+
+func (s *Server) serveAdminHTTP(w http.ResponseWriter, r *http.Request) {
+	adminHandler := s.chain.Load().adminHandler
+	if adminHandler == nil {
+		// the admin-port was removed from the configuration without a restart
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	adminHandler.ServeHTTP(w, r)
+}
+
+// Handler returns the handler chain of the server.
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+// Addr returns the address the server listens on or nil if the server has not been started yet.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// AdminAddr returns the address the admin API listens on or nil if the server has not been started yet or has no
+// admin-port.
+func (s *Server) AdminAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.adminListener == nil {
+		return nil
+	}
+	return s.adminListener.Addr()
+}
+
+// ThrottlingBuckets returns the token buckets of all throttled clients ordered by key.
+func (s *Server) ThrottlingBuckets() []ThrottlingBucket {
+	configuration := s.chain.Load().configuration
+	return s.state.getOrCreateThrottling(configuration).buckets(configuration)
+}
+
+// ResetThrottlingBucket refills the token bucket of the throttling key.
+func (s *Server) ResetThrottlingBucket(key string) {
+	s.state.getOrCreateThrottling(s.chain.Load().configuration).store.Reset(key)
+}
+
+// Bans returns the active bans of clients which were throttled too often.
+func (s *Server) Bans() []Ban {
+	return s.state.getOrCreateThrottling(s.chain.Load().configuration).bans.bans()
+}
+
+// Unban lifts the ban of the throttling key and forgets its history. It returns false if the key was not banned.
+func (s *Server) Unban(key string) bool {
+	return s.state.getOrCreateThrottling(s.chain.Load().configuration).bans.unban(key)
+}
+
+// Sessions returns the authenticated CAS browser sessions.
+func (s *Server) Sessions() ([]Session, error) {
+	clients, err := s.state.getOrCreateCasClients(s.chain.Load().configuration)
+	if err != nil {
+		return nil, err
+	}
+	return clients.tickets.sessions(), nil
+}
+
+// InvalidateSession ends the CAS browser session with the given id. The next request of the session is redirected
+// to the CAS login. It returns false if there is no such session.
+func (s *Server) InvalidateSession(id string) (bool, error) {
+	clients, err := s.state.getOrCreateCasClients(s.chain.Load().configuration)
+	if err != nil {
+		return false, err
+	}
+	return clients.tickets.invalidate(id), nil
+}
+
+// Start opens the listener and serves requests in the background. The server is shut down gracefully as soon as
+// the given context is done. Use Wait() to block until the server has stopped.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return errors.New("carp server has already been started")
+	}
+
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.httpServer.Addr, err)
+	}
+
+	if s.adminServer != nil {
+		adminListener, err := net.Listen("tcp", s.adminServer.Addr)
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to listen on %s: %w", s.adminServer.Addr, err)
+		}
+		s.adminListener = adminListener
+		go s.serveAdmin(adminListener)
+		log.Infof("carp admin API listens on %s", adminListener.Addr().String())
+	}
+
+	s.listener = listener
+	s.started = true
+
+	go s.serve(listener)
+
+	configuration := s.chain.Load().configuration
+	if configuration.ConfigReloadInterval > 0 || configuration.ConfigReloadOnSighup {
+		path := configurationPath()
+		lastModified := fileModificationTime(path)
+		s.reloadMu.Lock()
+		if !s.shuttingDown {
+			startBackgroundJob(s.jobsCtx, func(ctx context.Context) {
+				s.watchConfiguration(ctx, configuration, path, lastModified)
+			})
+		}
+		s.reloadMu.Unlock()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Info("Context done - shutdown carp server")
+			if err := s.Shutdown(context.Background()); err != nil {
+				log.Errorf("failed to shutdown carp server: %s", err.Error())
+			}
+		case <-s.done:
+		}
+	}()
+
+	log.Infof("carp server listens on %s", listener.Addr().String())
+
+	return nil
+}
+
+func (s *Server) serve(listener net.Listener) {
+	err := s.httpServer.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		// the server stopped on its own; stop background jobs as well
+		s.stop(fmt.Errorf("carp server stopped unexpectedly: %w", err), s.stopJobs(context.Background()))
+	}
+}
+
+func (s *Server) serveAdmin(listener net.Listener) {
+	err := s.adminServer.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("carp admin API stopped unexpectedly: %s", err.Error())
+	}
+}
+
+// Shutdown stops the server gracefully: the listener is closed, in-flight requests are drained and background jobs
+// are stopped. If the context expires before the shutdown is complete a ShutdownError for the failed phase is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var shutdownErr error
+	err := s.httpServer.Shutdown(ctx)
+	if s.adminServer != nil {
+		err = errors.Join(err, s.adminServer.Shutdown(ctx))
+	}
+	if err != nil {
+		shutdownErr = &ShutdownError{Phase: ShutdownPhaseHttpServer, Err: err}
+	}
+
+	jobsErr := s.stopJobs(ctx)
+	s.state.closeAccessLogOutputs()
+	s.stop(nil, shutdownErr, jobsErr)
+
+	return s.Wait()
+}
+
+func (s *Server) stopJobs(ctx context.Context) error {
+	s.reloadMu.Lock()
+	s.shuttingDown = true
+	s.cancelJobs()
+	s.reloadMu.Unlock()
+
+	// the ban snapshot is written by its own goroutine, so that it is flushed even if other jobs did not stop in time
+	err := errors.Join(s.jobs.waitContext(ctx), s.state.flushBanSnapshot(ctx))
+	if err != nil {
+		return &ShutdownError{Phase: ShutdownPhaseBackgroundJobs, Err: err}
+	}
+	return nil
+}
+
+func (s *Server) stop(errs ...error) {
+	s.stopOnce.Do(func() {
+		s.err = errors.Join(errs...)
+		close(s.done)
+	})
+}
+
+// Wait blocks until the server has stopped and returns the error which caused the stop, if any.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func createHandlersForConfig(ctx context.Context, configuration Configuration, state *handlerState) (http.Handler, error) {
 	proxyHandler, err := NewProxyHandler(configuration)
 	if err != nil {
 		return nil, fmt.Errorf("error creating proxy-handler: %w", err)
 	}
 
-	casRequestHandler, err := NewCasRequestHandler(configuration, proxyHandler)
+	casRequestHandler, err := newCasRequestHandler(configuration, proxyHandler, state)
 	if err != nil {
 		return nil, fmt.Errorf("error creating cas-request-handler: %w", err)
 	}
 
-	throttlingHandler := NewThrottlingHandler(context.TODO(), configuration, casRequestHandler)
+	throttlingHandler := newThrottlingHandler(ctx, configuration, casRequestHandler, state.getOrCreateThrottling(configuration))
 
 	doguRestHandler, err := NewDoguRestHandler(configuration, throttlingHandler)
 	if err != nil {
 		return nil, fmt.Errorf("error creating dogu-rest-handler: %w", err)
 	}
 
-	return doguRestHandler, nil
+	healthHandler := NewHealthHandler(configuration, doguRestHandler)
+
+	jwksHandler, err := NewJwksHandler(configuration, healthHandler)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jwks-handler: %w", err)
+	}
+
+	metricsHandler := NewMetricsHandler(configuration, state.metrics, jwksHandler)
+
+	tracingHandler, err := NewTracingHandler(ctx, configuration, metricsHandler)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracing-handler: %w", err)
+	}
+
+	requestIdHandler := NewRequestIdHandler(configuration, tracingHandler)
+
+	clientIpHandler, err := NewClientIpHandler(configuration, requestIdHandler)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client-ip-handler: %w", err)
+	}
+
+	// the access log is outermost, so that requests are logged even if an inner handler panics or answers early
+	accessLogHandler, err := newAccessLogHandler(configuration, clientIpHandler, func() (io.Writer, error) {
+		return state.getOrCreateAccessLogOutput(configuration)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating access-log-handler: %w", err)
+	}
+
+	return accessLogHandler, nil
+}
+
+// backgroundJobs keeps track of the goroutines started by the handlers of a server.
+type backgroundJobs struct {
+	wg sync.WaitGroup
+}
+
+func (j *backgroundJobs) wait() {
+	j.wg.Wait()
+}
+
+func (j *backgroundJobs) waitContext(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startBackgroundJob runs the job in a new goroutine. The job is tracked by the server owning the context, so that
+// the server can wait for it on shutdown.
+func startBackgroundJob(ctx context.Context, job func(ctx context.Context)) {
+	jobs, ok := ctx.Value(_BackgroundJobsContextKey).(*backgroundJobs)
+	if !ok {
+		go job(ctx)
+		return
+	}
+
+	jobs.wg.Add(1)
+	go func() {
+		defer jobs.wg.Done()
+		job(ctx)
+	}()
 }
@@ -1,42 +1,228 @@
 package carp
 
 import (
+	"context"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+func validTestConfiguration(t *testing.T) Configuration {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	return Configuration{
+		CasUrl:          "https://cas.example.com/cas",
+		ServiceUrl:      "https://dogu.example.com/dogu",
+		Target:          "http://localhost:8080",
+		PrincipalHeader: "X-CARP-Authentication",
+		Port:            port,
+	}
+}
+
 func TestNewServer(t *testing.T) {
 	t.Run("should create new server", func(t *testing.T) {
-		srv, err := NewServer(Configuration{})
+		srv, err := NewServer(validTestConfiguration(t))
 
 		require.NoError(t, err)
 		require.NotNil(t, srv)
 	})
 
-	t.Run("should fail to create new server for error in proxy-handler", func(t *testing.T) {
-		_, err := NewServer(Configuration{
+	t.Run("should fail to create new server for invalid configuration", func(t *testing.T) {
+		_, err := NewServer(Configuration{})
+
+		require.Error(t, err)
+		require.ErrorContains(t, err, "invalid configuration: cas-url is required")
+	})
+}
+
+func TestCreateHandlersForConfig(t *testing.T) {
+	t.Run("should fail to create handlers for error in proxy-handler", func(t *testing.T) {
+		_, err := createHandlersForConfig(context.Background(), Configuration{
 			Target: "http://example.com/%ZZ",
-		})
+		}, newHandlerState())
 
 		require.Error(t, err)
 		require.ErrorContains(t, err, "error creating proxy-handler: failed to parse target-url")
 	})
 
-	t.Run("should fail to create new server for error in cas-handler", func(t *testing.T) {
-		_, err := NewServer(Configuration{
+	t.Run("should fail to create handlers for error in cas-handler", func(t *testing.T) {
+		_, err := createHandlersForConfig(context.Background(), Configuration{
 			CasUrl: "http://example.com/%ZZ",
-		})
+		}, newHandlerState())
 
 		require.Error(t, err)
 		require.ErrorContains(t, err, "error creating cas-request-handler: failed to parse cas url")
 	})
 
-	t.Run("should fail to create new server for error in dogu-rest-handler", func(t *testing.T) {
-		_, err := NewServer(Configuration{
+	t.Run("should fail to create handlers for error in dogu-rest-handler", func(t *testing.T) {
+		_, err := createHandlersForConfig(context.Background(), Configuration{
 			ServiceAccountNameRegex: "[",
-		})
+		}, newHandlerState())
 
 		require.Error(t, err)
 		require.ErrorContains(t, err, "error creating dogu-rest-handler: error compiling serviceAccountNameRegex")
 	})
 }
+
+func TestServer_Lifecycle(t *testing.T) {
+	t.Run("should serve requests until shutdown", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		defer backend.Close()
+
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+
+		err = srv.Start(context.Background())
+		require.NoError(t, err)
+
+		resp, err := http.Get("http://" + srv.Addr().String() + "/foo")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+		err = srv.Shutdown(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, srv.Wait())
+
+		_, err = http.Get("http://" + srv.Addr().String() + "/foo")
+		require.Error(t, err)
+	})
+
+	t.Run("should shutdown when start context is done", func(t *testing.T) {
+		srv, err := NewServer(validTestConfiguration(t))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err = srv.Start(ctx)
+		require.NoError(t, err)
+
+		cancel()
+
+		require.NoError(t, srv.Wait())
+	})
+
+	t.Run("should drain in-flight requests on shutdown", func(t *testing.T) {
+		requestStarted := make(chan struct{})
+		releaseRequest := make(chan struct{})
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(requestStarted)
+			<-releaseRequest
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer backend.Close()
+
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		require.NoError(t, srv.Start(context.Background()))
+
+		statusCodes := make(chan int)
+		go func() {
+			resp, lErr := http.Get("http://" + srv.Addr().String() + "/slow")
+			if lErr != nil {
+				statusCodes <- 0
+				return
+			}
+			statusCodes <- resp.StatusCode
+		}()
+
+		<-requestStarted
+		shutdownErrs := make(chan error)
+		go func() {
+			shutdownErrs <- srv.Shutdown(context.Background())
+		}()
+
+		close(releaseRequest)
+
+		assert.Equal(t, http.StatusAccepted, <-statusCodes)
+		assert.NoError(t, <-shutdownErrs)
+	})
+
+	t.Run("should report failed shutdown phase", func(t *testing.T) {
+		requestStarted := make(chan struct{})
+		releaseRequest := make(chan struct{})
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(requestStarted)
+			<-releaseRequest
+		}))
+		defer backend.Close()
+		defer close(releaseRequest)
+
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		require.NoError(t, srv.Start(context.Background()))
+
+		go func() {
+			_, _ = http.Get("http://" + srv.Addr().String() + "/hanging")
+		}()
+		<-requestStarted
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = srv.Shutdown(ctx)
+
+		var shutdownErr *ShutdownError
+		require.ErrorAs(t, err, &shutdownErr)
+		assert.Equal(t, ShutdownPhaseHttpServer, shutdownErr.Phase)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("should fail to start server twice", func(t *testing.T) {
+		srv, err := NewServer(validTestConfiguration(t))
+		require.NoError(t, err)
+		require.NoError(t, srv.Start(context.Background()))
+		defer srv.Shutdown(context.Background())
+
+		err = srv.Start(context.Background())
+
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "carp server has already been started")
+	})
+
+	t.Run("should stop background jobs on shutdown", func(t *testing.T) {
+		srv, err := NewServer(validTestConfiguration(t))
+		require.NoError(t, err)
+
+		require.NoError(t, srv.Shutdown(context.Background()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.NoError(t, srv.jobs.waitContext(ctx))
+	})
+
+	t.Run("should flush ban snapshot on shutdown", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+		configuration.LimiterBanThreshold = 1
+		configuration.LimiterBanSnapshotFile = filepath.Join(t.TempDir(), "bans.json")
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		throttling := srv.state.getOrCreateThrottling(configuration)
+		_, banned := throttling.bans.recordThrottle("key", newBanPolicy(configuration))
+		require.True(t, banned)
+
+		require.NoError(t, srv.Shutdown(context.Background()))
+
+		data, err := os.ReadFile(configuration.LimiterBanSnapshotFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"key":"key"`)
+	})
+}
@@ -1,13 +1,18 @@
 package carp
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
 
 	"github.com/cloudogu/go-cas"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func NewCasClientFactory(configuration Configuration) (*CasClientFactory, error) {
@@ -24,18 +29,21 @@ func NewCasClientFactory(configuration Configuration) (*CasClientFactory, error)
 	urlScheme := cas.NewDefaultURLScheme(casUrl)
 	urlScheme.ServiceValidatePath = path.Join("p3", "serviceValidate")
 
-	httpClient := &http.Client{}
+	var transport http.RoundTripper = http.DefaultTransport
 	if configuration.SkipSSLVerification {
-		transport := &http.Transport{
+		transport = &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
-		httpClient.Transport = transport
 	}
+	ticketTransport := &casTicketTransport{base: transport}
+	httpClient := &http.Client{Transport: ticketTransport}
 
 	return &CasClientFactory{
 		serviceUrl:                         serviceUrl,
 		urlScheme:                          urlScheme,
 		httpClient:                         httpClient,
+		ticketTransport:                    ticketTransport,
+		tickets:                            newTicketStore(secondsOrDefault(configuration.CasSessionLifetime, _DefaultCasSessionLifetime)),
 		forwardUnauthenticatedRESTRequests: configuration.ForwardUnauthenticatedRESTRequests,
 	}, nil
 }
@@ -43,6 +51,8 @@ func NewCasClientFactory(configuration Configuration) (*CasClientFactory, error)
 type CasClientFactory struct {
 	urlScheme                          cas.URLScheme
 	httpClient                         *http.Client
+	ticketTransport                    *casTicketTransport
+	tickets                            *ticketStore
 	serviceUrl                         *url.URL
 	forwardUnauthenticatedRESTRequests bool
 }
@@ -51,14 +61,147 @@ func (factory *CasClientFactory) CreateClient() *cas.Client {
 	return cas.NewClient(&cas.Options{
 		URLScheme: factory.urlScheme,
 		Client:    factory.httpClient,
+		Store:     factory.tickets,
 	})
 }
 
 func (factory *CasClientFactory) CreateRestClient() *cas.RestClient {
 	return cas.NewRestClient(&cas.RestOptions{
-		ServiceURL: factory.serviceUrl,
-		URLScheme:  factory.urlScheme,
-		Client:     factory.httpClient,
+		ServiceURL:                         factory.serviceUrl,
+		URLScheme:                          factory.urlScheme,
+		Client:                             factory.httpClient,
 		ForwardUnauthenticatedRESTRequests: factory.forwardUnauthenticatedRESTRequests,
 	})
 }
+
+// createRestAuthenticator creates the CAS REST authentication of carp, which shares the http transport with the CAS
+// clients.
+func (factory *CasClientFactory) createRestAuthenticator() *casRestAuthenticator {
+	return &casRestAuthenticator{
+		urlScheme:                          factory.urlScheme,
+		serviceUrl:                         factory.serviceUrl,
+		transport:                          factory.ticketTransport.base,
+		forwardUnauthenticatedRESTRequests: factory.forwardUnauthenticatedRESTRequests,
+	}
+}
+
+// casTicketTransport adds the request id and a span to the ticket validation requests of the CAS browser client. The
+// CAS client does not pass the context of the incoming request to its requests, so the context of a ticket validation
+// is looked up by the ticket in the query of the validation request.
+type casTicketTransport struct {
+	base    http.RoundTripper
+	tickets sync.Map
+}
+
+type trackedTicket struct {
+	ctx             context.Context
+	requestIdHeader string
+}
+
+func (t *casTicketTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	value, ok := t.tickets.Load(req.URL.Query().Get("ticket"))
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	tracked := value.(trackedTicket)
+
+	ctx, span := startSpan(tracked.ctx, spanNameCasTicketValidation, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	if requestId := requestIdFromRequest(req); requestId != "" {
+		req.Header.Set(tracked.requestIdHeader, requestId)
+	}
+	injectTraceContext(ctx, req)
+
+	resp, err := t.base.RoundTrip(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	endSpanWithStatus(span, statusCode, err)
+
+	return resp, err
+}
+
+// trackTicket adds the request id and the trace context of the request context to the validation requests of the
+// ticket until the returned function is called.
+func (t *casTicketTransport) trackTicket(ctx context.Context, ticket string, requestIdHeader string) func() {
+	t.tickets.Store(ticket, trackedTicket{ctx: ctx, requestIdHeader: requestIdHeader})
+	return func() {
+		t.tickets.Delete(ticket)
+	}
+}
+
+// credentialsKey hashes the credentials, so that passwords are not kept in the cache of the CAS REST authentication.
+func credentialsKey(username string, password string) string {
+	sum := sha256.Sum256([]byte(username + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// casClientKey contains all configuration values which are used to create the CAS clients.
+type casClientKey struct {
+	casUrl                             string
+	serviceUrl                         string
+	skipSSLVerification                bool
+	forwardUnauthenticatedRESTRequests bool
+}
+
+func newCasClientKey(configuration Configuration) casClientKey {
+	return casClientKey{
+		casUrl:                             configuration.CasUrl,
+		serviceUrl:                         configuration.ServiceUrl,
+		skipSSLVerification:                configuration.SkipSSLVerification,
+		forwardUnauthenticatedRESTRequests: configuration.ForwardUnauthenticatedRESTRequests,
+	}
+}
+
+// casClients holds the CAS clients together with their sessions.
+type casClients struct {
+	browserClient     *cas.Client
+	restAuthenticator *casRestAuthenticator
+	ticketTransport   *casTicketTransport
+	tickets           *ticketStore
+}
+
+// getOrCreateCasClients returns the CAS clients for the configuration. The clients are reused as long as the
+// CAS related configuration values do not change.
+func (state *handlerState) getOrCreateCasClients(configuration Configuration) (*casClients, error) {
+	key := newCasClientKey(configuration)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if clients, ok := state.casClients[key]; ok {
+		return clients, nil
+	}
+
+	casClientFactory, err := NewCasClientFactory(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := &casClients{
+		browserClient:     casClientFactory.CreateClient(),
+		restAuthenticator: casClientFactory.createRestAuthenticator(),
+		ticketTransport:   casClientFactory.ticketTransport,
+		tickets:           casClientFactory.tickets,
+	}
+	state.casClients[key] = clients
+
+	return clients, nil
+}
+
+// removeUnusedCasClients drops all CAS clients which do not belong to the configuration.
+func (state *handlerState) removeUnusedCasClients(configuration Configuration) {
+	key := newCasClientKey(configuration)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for clientKey := range state.casClients {
+		if clientKey != key {
+			delete(state.casClients, clientKey)
+		}
+	}
+}
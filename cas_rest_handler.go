@@ -0,0 +1,218 @@
+package carp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cloudogu/go-cas"
+	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const _CasAuthenticationContextKey = "CasAuthentication"
+
+const (
+	_CasRestCacheDuration        = 10 * time.Second
+	_CasRestCacheCleanupInterval = time.Minute
+)
+
+// casAuthentication is the CAS authentication of a REST request.
+type casAuthentication struct {
+	response *cas.AuthenticationResponse
+	first    bool
+}
+
+// casRestAuthenticator authenticates REST requests by basic auth against the CAS REST API. Unlike the handler of the
+// go-cas RestClient, it sends the requests to CAS with the context of the incoming request and passes the result of
+// CAS to the throttling of the request.
+type casRestAuthenticator struct {
+	urlScheme                          cas.URLScheme
+	serviceUrl                         *url.URL
+	transport                          http.RoundTripper
+	forwardUnauthenticatedRESTRequests bool
+}
+
+// Handle wraps the handler with the CAS REST authentication. The answers of CAS are cached by credentials for 10
+// seconds, so that CAS is not asked on every request. The request id is sent to CAS in the requestIdHeader.
+func (a *casRestAuthenticator) Handle(handler http.Handler, requestIdHeader string) http.Handler {
+	return &casRestHandler{
+		authenticator:   a,
+		handler:         handler,
+		requestIdHeader: requestIdHeader,
+		cache:           cache.New(_CasRestCacheDuration, _CasRestCacheCleanupInterval),
+	}
+}
+
+// authenticate requests a ticket granting ticket and a service ticket for the credentials and validates the service
+// ticket. rejected is true if CAS rejected the credentials.
+func (a *casRestAuthenticator) authenticate(r *http.Request, requestIdHeader string, username string, password string) (response *cas.AuthenticationResponse, rejected bool, err error) {
+	grantingTicketUrl, err := a.urlScheme.RestGrantingTicket()
+	if err != nil {
+		return nil, false, err
+	}
+
+	transport := &casRestTransport{
+		base:              a.transport,
+		ctx:               r.Context(),
+		requestIdHeader:   requestIdHeader,
+		grantingTicketUrl: grantingTicketUrl.String(),
+	}
+	client := cas.NewRestClient(&cas.RestOptions{
+		ServiceURL: a.serviceUrl,
+		URLScheme:  a.urlScheme,
+		Client:     &http.Client{Transport: transport},
+	})
+
+	grantingTicket, err := client.RequestGrantingTicket(username, password)
+	if err != nil {
+		return nil, transport.grantingTicketRejected(), err
+	}
+
+	serviceTicket, err := client.RequestServiceTicket(grantingTicket)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err = client.ValidateServiceTicket(serviceTicket)
+	return response, false, err
+}
+
+// casRestTransport sends the requests of the CAS REST client of a single request with the context, the request id and
+// the trace context of the request and keeps the status code of the ticket granting ticket request.
+type casRestTransport struct {
+	base                     http.RoundTripper
+	ctx                      context.Context
+	requestIdHeader          string
+	grantingTicketUrl        string
+	grantingTicketStatusCode int
+}
+
+func (t *casRestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(t.ctx, spanNameCasRestAuthentication, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	if requestId := requestIdFromRequest(req); requestId != "" {
+		req.Header.Set(t.requestIdHeader, requestId)
+	}
+	injectTraceContext(ctx, req)
+
+	resp, err := t.base.RoundTrip(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	if req.URL.String() == t.grantingTicketUrl {
+		t.grantingTicketStatusCode = statusCode
+	}
+	endSpanWithStatus(span, statusCode, err)
+
+	return resp, err
+}
+
+// grantingTicketRejected reports whether CAS rejected the credentials. Server errors and timeouts of CAS are no
+// rejection.
+func (t *casRestTransport) grantingTicketRejected() bool {
+	return t.grantingTicketStatusCode >= 400 && t.grantingTicketStatusCode < 500
+}
+
+// casRestHandler authenticates requests with basic auth against CAS and passes authenticated requests to the handler.
+type casRestHandler struct {
+	authenticator   *casRestAuthenticator
+	handler         http.Handler
+	requestIdHeader string
+	cache           *cache.Cache
+}
+
+func (h *casRestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		h.handleUnauthenticatedRequest(w, r)
+		return
+	}
+
+	authentication, ok := h.cachedAuthentication(r, username, password)
+	if !ok {
+		h.handleUnauthenticatedRequest(w, r)
+		return
+	}
+
+	if restAuthentication := casRestAuthenticationFromRequest(r); restAuthentication != nil {
+		restAuthentication.authenticated.Store(true)
+	}
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), _CasAuthenticationContextKey, authentication)))
+}
+
+// cachedAuthentication returns the cached answer of CAS to the credentials or asks CAS. Rejected credentials are
+// cached as well, failures of CAS are not.
+func (h *casRestHandler) cachedAuthentication(r *http.Request, username string, password string) (casAuthentication, bool) {
+	key := credentialsKey(username, password)
+	if cached, found := h.cache.Get(key); found {
+		response := cached.(*cas.AuthenticationResponse)
+		return casAuthentication{response: response}, response != nil
+	}
+
+	response, rejected, err := h.authenticator.authenticate(r, h.requestIdHeader, username, password)
+	if err != nil {
+		newRequestLogger(r).withUsername(username).info(fmt.Sprintf("CAS REST authentication failed: %s", err.Error()))
+		if rejected {
+			h.cache.SetDefault(key, (*cas.AuthenticationResponse)(nil))
+		}
+		return casAuthentication{}, false
+	}
+
+	h.cache.SetDefault(key, response)
+	return casAuthentication{response: response, first: true}, true
+}
+
+func (h *casRestHandler) handleUnauthenticatedRequest(w http.ResponseWriter, r *http.Request) {
+	if h.authenticator.forwardUnauthenticatedRESTRequests {
+		// forward REST request for potential local user authentication or anonymous user
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="CAS Protected Area"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func casAuthenticationFromRequest(r *http.Request) (casAuthentication, bool) {
+	authentication, ok := r.Context().Value(_CasAuthenticationContextKey).(casAuthentication)
+	return authentication, ok
+}
+
+// casIsAuthenticated reports whether the request was authenticated by CAS, as REST request by carp or as browser
+// request by go-cas.
+func casIsAuthenticated(r *http.Request) bool {
+	if _, ok := casAuthenticationFromRequest(r); ok {
+		return true
+	}
+	return cas.IsAuthenticated(r)
+}
+
+// casUsername returns the name of the user who was authenticated by CAS.
+func casUsername(r *http.Request) string {
+	if authentication, ok := casAuthenticationFromRequest(r); ok {
+		return authentication.response.User
+	}
+	return cas.Username(r)
+}
+
+// casAttributes returns the attributes of the user who was authenticated by CAS.
+func casAttributes(r *http.Request) cas.UserAttributes {
+	if authentication, ok := casAuthenticationFromRequest(r); ok {
+		return authentication.response.Attributes
+	}
+	return cas.Attributes(r)
+}
+
+// casIsFirstAuthenticatedRequest reports whether the request is the first one of its CAS authentication.
+func casIsFirstAuthenticatedRequest(r *http.Request) bool {
+	if authentication, ok := casAuthenticationFromRequest(r); ok {
+		return authentication.first
+	}
+	return cas.IsFirstAuthenticatedRequest(r)
+}
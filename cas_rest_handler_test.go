@@ -0,0 +1,91 @@
+package carp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCasRestHandler(t *testing.T) {
+	var grantingTicketRequests atomic.Int32
+	casServer := newFakeCasRestServer(t, &grantingTicketRequests)
+
+	newHandler := func(t *testing.T, forwardUnauthenticated bool, target http.Handler) http.Handler {
+		clients, err := newHandlerState().getOrCreateCasClients(Configuration{
+			CasUrl:                             casServer.URL + "/cas",
+			ServiceUrl:                         "http://carp.example.com",
+			ForwardUnauthenticatedRESTRequests: forwardUnauthenticated,
+		})
+		require.NoError(t, err)
+		return clients.restAuthenticator.Handle(target, _DefaultRequestIdHeader)
+	}
+
+	request := func(handler http.Handler, username string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+		req.SetBasicAuth(username, password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("should authenticate concurrent requests with their own credentials", func(t *testing.T) {
+		handler := newHandler(t, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, _, _ := r.BasicAuth()
+			if !casIsAuthenticated(r) || casUsername(r) != username {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				username := fmt.Sprintf("user-%d", i%4)
+				if i%2 == 0 {
+					assert.Equal(t, http.StatusOK, request(handler, username, "secret").Code, username)
+				} else {
+					assert.Equal(t, http.StatusUnauthorized, request(handler, username, "wrong").Code, username)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("should cache answers of CAS", func(t *testing.T) {
+		var first []bool
+		handler := newHandler(t, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			first = append(first, casIsFirstAuthenticatedRequest(r))
+			assert.Equal(t, []string{"admins"}, casAttributes(r)["groups"])
+		}))
+		grantingTicketRequests.Store(0)
+
+		assert.Equal(t, http.StatusOK, request(handler, "admin", "secret").Code)
+		assert.Equal(t, http.StatusOK, request(handler, "admin", "secret").Code)
+		rejected := request(handler, "admin", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, rejected.Code)
+		assert.Equal(t, `Basic realm="CAS Protected Area"`, rejected.Header().Get("WWW-Authenticate"))
+		assert.Equal(t, http.StatusUnauthorized, request(handler, "admin", "wrong").Code)
+
+		assert.Equal(t, []bool{true, false}, first)
+		assert.Equal(t, int32(2), grantingTicketRequests.Load())
+	})
+
+	t.Run("should forward unauthenticated requests if configured", func(t *testing.T) {
+		var authenticated []bool
+		handler := newHandler(t, true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authenticated = append(authenticated, casIsAuthenticated(r))
+		}))
+
+		assert.Equal(t, http.StatusOK, request(handler, "alice", "wrong").Code)
+		assert.Equal(t, http.StatusOK, request(handler, "alice", "secret").Code)
+
+		assert.Equal(t, []bool{false, true}, authenticated)
+	})
+}
@@ -0,0 +1,58 @@
+package carp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+const _CasRestAuthenticationContextKey = "CasRestAuthentication"
+
+// casRestAuthentication records whether CAS authenticated the credentials of a request.
+type casRestAuthentication struct {
+	authenticated atomic.Bool
+}
+
+func casRestAuthenticationFromRequest(r *http.Request) *casRestAuthentication {
+	authentication, _ := r.Context().Value(_CasRestAuthenticationContextKey).(*casRestAuthentication)
+	return authentication
+}
+
+// throttleCasRestAuthentication throttles requests whose credentials are not authenticated by CAS, so that clients
+// with wrong credentials do not lock the account of the user in CAS. Every request with credentials reserves a token
+// of the limiter of the client ip and username before it reaches CAS, so that concurrent requests can not exceed the
+// limit; a successful authentication resets the limiter.
+func throttleCasRestAuthentication(configuration Configuration, state *throttling, policy banPolicy, handler http.Handler, writer http.ResponseWriter, request *http.Request) {
+	username, _, ok := request.BasicAuth()
+	if !ok {
+		handler.ServeHTTP(writer, request)
+		return
+	}
+
+	logger := newRequestLogger(request).withUsername(username)
+	ipUsernameId := fmt.Sprintf("%s%s:%s", _CasRestLimiterKeyPrefix, ClientIP(request), username)
+	limit := Limit{TokenRate: configuration.CasRestLimiterTokenRate, BurstSize: configuration.CasRestLimiterBurstSize}
+	store := state.store
+
+	if state.rejectBanned(writer, request, logger, ipUsernameId, limit, configuration.LimiterJsonResponse) {
+		return
+	}
+
+	result := store.Allow(ipUsernameId, limit)
+	setRateLimitHeaders(writer.Header(), result, limit)
+
+	if !result.Allowed {
+		state.rejectThrottled(writer, request, logger, ipUsernameId, result, policy, configuration.LimiterJsonResponse)
+		return
+	}
+
+	authentication := &casRestAuthentication{}
+	handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), _CasRestAuthenticationContextKey, authentication)))
+
+	if authentication.authenticated.Load() {
+		store.Reset(ipUsernameId)
+	} else {
+		logger.debug(fmt.Sprintf("CAS did not authenticate credentials, throttling tokens left: %.1f", result.Remaining))
+	}
+}
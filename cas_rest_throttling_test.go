@@ -0,0 +1,122 @@
+package carp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeCasRestServer accepts the password "secret" for every user. The user admin is member of the group admins.
+func newFakeCasRestServer(t *testing.T, grantingTicketRequests *atomic.Int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/cas/v1/tickets":
+			grantingTicketRequests.Add(1)
+			require.NoError(t, r.ParseForm())
+			if r.PostForm.Get("password") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Location", "/cas/v1/tickets/TGT-"+r.PostForm.Get("username"))
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(r.URL.Path, "/cas/v1/tickets/TGT-"):
+			_, _ = fmt.Fprint(w, "ST-"+strings.TrimPrefix(r.URL.Path, "/cas/v1/tickets/TGT-"))
+		case r.URL.Path == "/cas/p3/serviceValidate":
+			username := strings.TrimPrefix(r.URL.Query().Get("ticket"), "ST-")
+			groups := ""
+			if username == "admin" {
+				groups = "<cas:attributes><cas:groups>admins</cas:groups></cas:attributes>"
+			}
+			_, _ = fmt.Fprintf(w, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+  <cas:authenticationSuccess><cas:user>%s</cas:user>%s</cas:authenticationSuccess>
+</cas:serviceResponse>`, username, groups)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestThrottlingHandler_casRestAuthentication(t *testing.T) {
+
+	var grantingTicketRequests atomic.Int32
+	casServer := newFakeCasRestServer(t, &grantingTicketRequests)
+
+	configuration := Configuration{
+		CasUrl:                  casServer.URL + "/cas",
+		ServiceUrl:              "http://carp.example.com",
+		CasRestLimiterTokenRate: 1,
+		CasRestLimiterBurstSize: 2,
+	}
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	casRequestHandler, err := NewCasRequestHandler(configuration, target)
+	require.NoError(t, err)
+	store := NewMemoryLimiterStore(_DefaultLimiterMaxEntries)
+	handler := newThrottlingHandler(context.TODO(), configuration, casRequestHandler, &throttling{store: store, bans: newBanList("", 0)})
+	limit := Limit{TokenRate: 1, BurstSize: 2}
+
+	request := func(username string, password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set(_HttpHeaderXForwardedFor, "10.0.0.1")
+		req.SetBasicAuth(username, password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	t.Run("should throttle after rejections of CAS", func(t *testing.T) {
+		grantingTicketRequests.Store(0)
+
+		assert.Equal(t, http.StatusUnauthorized, request("alice", "wrong-1"))
+		assert.Equal(t, http.StatusUnauthorized, request("alice", "wrong-2"))
+		assert.Equal(t, http.StatusTooManyRequests, request("alice", "wrong-3"))
+		// throttled requests do not reach CAS
+		assert.Equal(t, int32(2), grantingTicketRequests.Load())
+
+		// other users of the same ip are not affected
+		assert.Equal(t, http.StatusOK, request("bob", "secret"))
+	})
+
+	t.Run("should throttle concurrent requests before they reach CAS", func(t *testing.T) {
+		grantingTicketRequests.Store(0)
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes <- request("dave", fmt.Sprintf("wrong-%d", i))
+			}(i)
+		}
+		wg.Wait()
+		close(codes)
+
+		counts := map[int]int{}
+		for code := range codes {
+			counts[code]++
+		}
+		assert.Equal(t, map[int]int{http.StatusUnauthorized: 2, http.StatusTooManyRequests: 8}, counts)
+		assert.Equal(t, int32(2), grantingTicketRequests.Load())
+	})
+
+	t.Run("should reset throttling after successful authentication", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request("carol", "wrong-1"))
+		require.Less(t, store.Tokens("cas-rest:10.0.0.1:carol", limit), 2.0)
+		length := store.Len()
+
+		assert.Equal(t, http.StatusOK, request("carol", "secret"))
+		assert.Equal(t, length-1, store.Len())
+		assert.Equal(t, 2.0, store.Tokens("cas-rest:10.0.0.1:carol", limit))
+	})
+}
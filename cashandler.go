@@ -6,51 +6,106 @@ import (
 
 // NewCasRequestHandler creates a CasRequestHandler that wraps the given http.Handler and adds CAS-Authentication to the request
 func NewCasRequestHandler(configuration Configuration, handler http.Handler) (http.Handler, error) {
-	casClientFactory, err := NewCasClientFactory(configuration)
+	return newCasRequestHandler(configuration, handler, newHandlerState())
+}
+
+// newCasRequestHandler creates a CasRequestHandler which reuses the CAS clients of the given state, so that
+// authenticated sessions survive a rebuild of the handler chain.
+func newCasRequestHandler(configuration Configuration, handler http.Handler, state *handlerState) (http.Handler, error) {
+	clients, err := state.getOrCreateCasClients(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := newAuthRoutes(configuration)
 	if err != nil {
 		return nil, err
 	}
 
-	browserHandler := casClientFactory.CreateClient().Handle(handler)
+	classifier, err := newRequestClassifier(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	browserHandler, err := wrapWithBackendLogoutIfNeeded(configuration, clients.tickets, clients.browserClient.Handle(clients.tickets.bindSessions(handler)))
+	if err != nil {
+		return nil, err
+	}
+
+	casBrowserHandler, err := wrapWithLogoutRedirectionIfNeeded(configuration, clients.tickets, browserHandler)
+	if err != nil {
+		return nil, err
+	}
 
+	requestIdHeader := valueOrDefault(configuration.RequestIdHeader, _DefaultRequestIdHeader)
 	return &CasRequestHandler{
 		wrappedHandler:    handler,
-		CasBrowserHandler: wrapWithLogoutRedirectionIfNeeded(configuration, browserHandler),
-		CasRestHandler:    casClientFactory.CreateRestClient().Handle(handler),
+		CasBrowserHandler: casBrowserHandler,
+		CasRestHandler:    clients.restAuthenticator.Handle(handler, requestIdHeader),
+		requestIdHeader:   requestIdHeader,
+		authRoutes:        routes,
+		classifier:        classifier,
+		casTransport:      clients.ticketTransport,
 	}, nil
 }
 
-func wrapWithLogoutRedirectionIfNeeded(configuration Configuration, handler http.Handler) http.Handler {
+func wrapWithLogoutRedirectionIfNeeded(configuration Configuration, tickets *ticketStore, handler http.Handler) (http.Handler, error) {
 	if logoutRedirectionConfigured(configuration) {
 		log.Info("Found configuration for logout redirection")
-		logoutRedirectionHandler := NewLogoutRedirectionHandler(configuration, handler)
-		return logoutRedirectionHandler
+		return newLogoutRedirectionHandler(configuration, handler, tickets)
 	} else {
 		log.Info("No configuration for logout redirection found")
-		return handler
+		return handler, nil
 	}
 }
 
 func logoutRedirectionConfigured(configuration Configuration) bool {
-	return configuration.LogoutMethod != "" || configuration.LogoutPath != ""
+	return configuration.LogoutMethod != "" || configuration.LogoutPath != "" || len(configuration.LogoutRules) > 0
 }
 
 type CasRequestHandler struct {
 	wrappedHandler    http.Handler
 	CasBrowserHandler http.Handler
 	CasRestHandler    http.Handler
+	requestIdHeader   string
+	casTransport      *casTicketTransport
+	authRoutes        *authRoutes
+	classifier        RequestClassifier
 }
 
 func (h *CasRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metricsFromRequest(r).countStage(stageCas)
+
 	if IsServiceAccountAuthentication(r) {
 		// no cas-authentication needed -> skip cas-handler
+		metricsFromRequest(r).countServiceAccountBypass()
+		username, _, _ := r.BasicAuth()
+		requestInfoFromRequest(r).setServiceAccount(username)
+		h.wrappedHandler.ServeHTTP(w, r)
+		return
+	}
+
+	policy := h.authRoutes.policyFor(r)
+	if policy == AuthPolicyPublic {
+		// public routes are forwarded without cas-authentication
 		h.wrappedHandler.ServeHTTP(w, r)
 		return
 	}
 
-	handler := h.CasRestHandler
-	if IsBrowserRequest(r) {
-		handler = h.CasBrowserHandler
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" && h.casTransport != nil {
+		defer h.casTransport.trackTicket(r.Context(), ticket, h.requestIdHeader)()
 	}
-	handler.ServeHTTP(w, r)
+
+	if isBrowserRequest(h.classifier, r) {
+		h.CasBrowserHandler.ServeHTTP(w, r)
+		return
+	}
+
+	if _, _, ok := r.BasicAuth(); !ok && policy == AuthPolicyOptional {
+		// rest requests without credentials are forwarded anonymously on optional routes
+		h.wrappedHandler.ServeHTTP(w, r)
+		return
+	}
+
+	h.CasRestHandler.ServeHTTP(w, r)
 }
@@ -0,0 +1,178 @@
+package carp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const _ClientIpContextKey = "ClientIp"
+
+const _HttpHeaderForwarded = "Forwarded"
+
+// _DefaultTrustedProxies is the loopback network. Proxies in other networks must be listed in trusted-proxies, because
+// every client of a trusted network can forge its address.
+var _DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// trustedProxies are the networks of the proxies whose forwarded header is trusted.
+type trustedProxies struct {
+	prefixes []netip.Prefix
+	// header is the one header in which the trusted proxies forward the client address, X-Forwarded-For or Forwarded
+	header string
+}
+
+func newTrustedProxies(configuration Configuration) (trustedProxies, error) {
+	header := http.CanonicalHeaderKey(valueOrDefault(configuration.TrustedProxyHeader, _HttpHeaderXForwardedFor))
+	if header != _HttpHeaderXForwardedFor && header != _HttpHeaderForwarded {
+		return trustedProxies{}, fmt.Errorf("trusted-proxy-header must be %s or %s: %s", _HttpHeaderXForwardedFor, _HttpHeaderForwarded, configuration.TrustedProxyHeader)
+	}
+
+	cidrs := configuration.TrustedProxies
+	if len(cidrs) == 0 {
+		cidrs = _DefaultTrustedProxies
+	}
+
+	proxies := trustedProxies{header: header}
+	for _, cidr := range cidrs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return trustedProxies{}, fmt.Errorf("invalid trusted-proxies entry %s: %w", cidr, err)
+		}
+		proxies.prefixes = append(proxies.prefixes, prefix)
+	}
+
+	return proxies, nil
+}
+
+// parsePrefix parses a CIDR or a single address.
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+func (p trustedProxies) contains(addr netip.Addr) bool {
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIp walks the hops of the trusted header from the right, starting with the remote address, and returns the
+// first address which is no trusted proxy. Hops added by untrusted clients and all other headers are ignored, so that
+// clients can not forge their address.
+func (p trustedProxies) clientIp(r *http.Request) string {
+	remoteHost := remoteAddrHost(r)
+	current, err := netip.ParseAddr(remoteHost)
+	if err != nil {
+		return remoteHost
+	}
+	current = current.Unmap()
+
+	hops := forwardedHops(r, p.header)
+	for i := len(hops) - 1; i >= 0 && p.contains(current); i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// obfuscated or unknown hops can not be resolved further
+			break
+		}
+		current = hop.Unmap()
+	}
+
+	return current.String()
+}
+
+// forwardedHops returns the addresses of the header, Forwarded or X-Forwarded-For, from the client to the last proxy.
+func forwardedHops(r *http.Request, header string) []string {
+	var hops []string
+
+	for _, value := range r.Header.Values(header) {
+		for _, element := range strings.Split(value, ",") {
+			if header == _HttpHeaderForwarded {
+				hops = append(hops, forwardedFor(element))
+			} else {
+				hops = append(hops, strings.TrimSpace(element))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the address of the for parameter of a Forwarded element (RFC 7239), e.g.
+// for="[2001:db8::1]:4711";proto=https
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(name, "for") {
+			continue
+		}
+
+		value = strings.Trim(value, `"`)
+		if strings.HasPrefix(value, "[") {
+			value = strings.TrimPrefix(value, "[")
+			value, _, _ = strings.Cut(value, "]")
+		} else if host, _, err := net.SplitHostPort(value); err == nil {
+			value = host
+		}
+		return value
+	}
+	return ""
+}
+
+func remoteAddrHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewClientIpHandler resolves the client ip of every request with the trusted-proxies of the configuration, so that
+// ClientIP returns the same address in all handlers.
+func NewClientIpHandler(configuration Configuration, handler http.Handler) (http.Handler, error) {
+	proxies, err := newTrustedProxies(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		clientIp := proxies.clientIp(request)
+		requestInfoFromRequest(request).setClientIp(clientIp)
+		ctx := context.WithValue(request.Context(), _ClientIpContextKey, clientIp)
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	}), nil
+}
+
+var defaultTrustedProxies, _ = newTrustedProxies(Configuration{})
+
+// ClientIP returns the address of the client of the request. Hops of trusted proxies in the trusted-proxy-header are
+// skipped. Requests which did not pass the handler of NewClientIpHandler are resolved with
+// the default trusted proxies.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(_ClientIpContextKey).(string); ok {
+		return ip
+	}
+	return defaultTrustedProxies.clientIp(r)
+}
+
+func validateTrustedProxies(configuration Configuration) []error {
+	if _, err := newTrustedProxies(configuration); err != nil {
+		return []error{err}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package carp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies_clientIp(t *testing.T) {
+	proxies, err := newTrustedProxies(Configuration{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"remote address without forwarded header", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"ignore forwarded header of untrusted client", "203.0.113.7:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"skip trusted proxies from the right", "192.0.2.1:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.99, 198.51.100.1, 10.0.0.5"}, "198.51.100.1"},
+		{"first hop if all hops are trusted", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"stop at invalid hop", "192.0.2.1:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.1, unknown"}, "192.0.2.1"},
+		{"ignore forged forwarded header", "10.0.0.5:1234",
+			map[string]string{
+				"Forwarded":       "for=6.6.6.6",
+				"X-Forwarded-For": "203.0.113.7",
+			}, "203.0.113.7"},
+		{"ignore forwarded header without x-forwarded-for", "10.0.0.5:1234",
+			map[string]string{"Forwarded": "for=6.6.6.6"}, "10.0.0.5"},
+		{"ipv4-mapped remote address", "[::ffff:192.0.2.1]:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			assert.Equal(t, tt.want, proxies.clientIp(r))
+		})
+	}
+}
+
+func TestTrustedProxies_clientIpWithForwardedHeader(t *testing.T) {
+	proxies, err := newTrustedProxies(Configuration{TrustedProxies: []string{"192.0.2.1", "2001:db8::/32"}, TrustedProxyHeader: "forwarded"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"skip trusted proxies from the right", map[string]string{
+			"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`,
+		}, "198.51.100.1"},
+		{"ipv6 client", map[string]string{"Forwarded": `for="[2001:db9::1]:4711"`}, "2001:db9::1"},
+		{"ignore forged x-forwarded-for header", map[string]string{
+			"Forwarded":       "for=198.51.100.1",
+			"X-Forwarded-For": "6.6.6.6",
+		}, "198.51.100.1"},
+		{"stop at obfuscated hop", map[string]string{"Forwarded": "for=198.51.100.1, for=_hidden"}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			assert.Equal(t, tt.want, proxies.clientIp(r))
+		})
+	}
+}
+
+func TestNewClientIpHandler(t *testing.T) {
+	var clientIp string
+	handler, err := NewClientIpHandler(Configuration{TrustedProxies: []string{"192.0.2.0/24"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIp = ClientIP(r)
+	}))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, "198.51.100.1", clientIp)
+
+	_, err = NewClientIpHandler(Configuration{TrustedProxies: []string{"10.0.0.0/33"}}, handler)
+	assert.ErrorContains(t, err, "invalid trusted-proxies entry 10.0.0.0/33")
+}
+
+func TestClientIP(t *testing.T) {
+	t.Run("should use default trusted proxies without handler", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
+
+		assert.Equal(t, "198.51.100.1", ClientIP(r))
+	})
+
+	t.Run("should use remote address of untrusted client", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "198.51.100.2:1234"
+		r.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
+
+		assert.Equal(t, "198.51.100.2", ClientIP(r))
+	})
+}
@@ -1,15 +1,29 @@
 package carp
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"reflect"
 	"strings"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
+// EnvironmentPrefix is the prefix of environment variables overriding configuration values, e.g. CARP_CAS_URL
+// overrides cas-url.
+const EnvironmentPrefix = "CARP_"
+
+const (
+	ConfigurationSourceDefault     = "default"
+	ConfigurationSourceFile        = "file"
+	ConfigurationSourceEnvironment = "env"
+)
+
+const _MaskedConfigurationValue = "*****"
+
 type Configuration struct {
 	BaseUrl                            string `yaml:"base-url"`
 	CasUrl                             string `yaml:"cas-url"`
@@ -22,18 +36,74 @@ type Configuration struct {
 	LogoutMethod                       string `yaml:"logout-method"`
 	LogoutPath                         string `yaml:"logout-path"`
 	ForwardUnauthenticatedRESTRequests bool   `yaml:"forward-unauthenticated-rest-requests"`
+	CasSessionLifetime                 int    `yaml:"cas-session-lifetime"`
 	ServiceAccountNameRegex            string `yaml:"service-account-name-regex"`
+	ServiceAccountCredentialsFile      string `yaml:"service-account-credentials-file"`
 	LoggingFormat                      string `yaml:"log-format"`
 	LogLevel                           string `yaml:"log-level"`
 	UserReplicator                     UserReplicator
+	RequestClassifier                  RequestClassifier
+	LimiterBackend                     LimiterBackend
 	ResponseModifier                   func(*http.Response) error
-	LimiterTokenRate                   int `yaml:"limiter-token-rate"`
-	LimiterBurstSize                   int `yaml:"limiter-burst-size"`
-	LimiterCleanInterval               int `yaml:"limiter-clean-interval"`
+	LimiterTokenRate                   int                         `yaml:"limiter-token-rate"`
+	LimiterBurstSize                   int                         `yaml:"limiter-burst-size"`
+	LimiterCleanInterval               int                         `yaml:"limiter-clean-interval"`
+	LimiterMaxEntries                  int                         `yaml:"limiter-max-entries"`
+	LimiterJsonResponse                bool                        `yaml:"limiter-json-response"`
+	LimiterBanThreshold                int                         `yaml:"limiter-ban-threshold"`
+	LimiterBanWindow                   int                         `yaml:"limiter-ban-window"`
+	LimiterBanDuration                 int                         `yaml:"limiter-ban-duration"`
+	LimiterBanMaxDuration              int                         `yaml:"limiter-ban-max-duration"`
+	LimiterBanSnapshotFile             string                      `yaml:"limiter-ban-snapshot-file"`
+	CasRestLimiterTokenRate            int                         `yaml:"cas-rest-limiter-token-rate"`
+	CasRestLimiterBurstSize            int                         `yaml:"cas-rest-limiter-burst-size"`
+	ConfigReloadInterval               int                         `yaml:"config-reload-interval"`
+	ConfigReloadOnSighup               bool                        `yaml:"config-reload-on-sighup"`
+	HealthLivenessPath                 string                      `yaml:"health-liveness-path"`
+	HealthReadinessPath                string                      `yaml:"health-readiness-path"`
+	HealthCheckTimeout                 int                         `yaml:"health-check-timeout"`
+	HealthCheckCacheDuration           int                         `yaml:"health-check-cache-duration"`
+	MetricsPath                        string                      `yaml:"metrics-path"`
+	AccessLogFormat                    string                      `yaml:"access-log-format"`
+	AccessLogOutput                    string                      `yaml:"access-log-output"`
+	AccessLogFile                      string                      `yaml:"access-log-file"`
+	AccessLogMaxSize                   int                         `yaml:"access-log-max-size"`
+	AccessLogMaxBackups                int                         `yaml:"access-log-max-backups"`
+	AccessLogSyslogNetwork             string                      `yaml:"access-log-syslog-network"`
+	AccessLogSyslogAddress             string                      `yaml:"access-log-syslog-address"`
+	AccessLogSyslogTag                 string                      `yaml:"access-log-syslog-tag"`
+	RequestIdHeader                    string                      `yaml:"request-id-header"`
+	TrustedProxies                     []string                    `yaml:"trusted-proxies"`
+	TrustedProxyHeader                 string                      `yaml:"trusted-proxy-header"`
+	TracingEndpoint                    string                      `yaml:"tracing-endpoint"`
+	TracingServiceName                 string                      `yaml:"tracing-service-name"`
+	AttributeHeaders                   []AttributeHeader           `yaml:"attribute-headers"`
+	IdentityAssertionHeader            string                      `yaml:"identity-assertion-header"`
+	IdentityAssertionSecret            string                      `yaml:"identity-assertion-secret" carp:"secret"`
+	IdentityAssertionKeyFile           string                      `yaml:"identity-assertion-key-file"`
+	IdentityAssertionAudience          string                      `yaml:"identity-assertion-audience"`
+	IdentityAssertionLifetime          int                         `yaml:"identity-assertion-lifetime"`
+	IdentityAssertionAttributes        []string                    `yaml:"identity-assertion-attributes"`
+	IdentityAssertionJwksPath          string                      `yaml:"identity-assertion-jwks-path"`
+	AccessRules                        []AccessRule                `yaml:"access-rules"`
+	AccessRulesGroupAttribute          string                      `yaml:"access-rules-group-attribute"`
+	AccessDeniedPage                   string                      `yaml:"access-denied-page"`
+	AuthRoutes                         []AuthRoute                 `yaml:"auth-routes"`
+	RequestClassificationRules         []RequestClassificationRule `yaml:"request-classification-rules"`
+	LogoutRules                        []LogoutRule                `yaml:"logout-rules"`
+	BackendLogoutMethod                string                      `yaml:"backend-logout-method"`
+	BackendLogoutPath                  string                      `yaml:"backend-logout-path"`
+	BackendLogoutCookies               []LogoutCookie              `yaml:"backend-logout-cookies"`
+	AdminPort                          int                         `yaml:"admin-port"`
+	AdminToken                         string                      `yaml:"admin-token" carp:"secret"`
+	AdminGroup                         string                      `yaml:"admin-group"`
 }
 
+// configurationSources maps the yaml key of every configuration value to the source it was read from.
+type configurationSources map[string]string
+
 func InitializeAndReadConfiguration() (Configuration, error) {
-	configuration, err := readConfiguration()
+	configuration, sources, err := readConfiguration()
 	if err != nil {
 		return configuration, errors.Wrap(err, "could not initialize")
 	}
@@ -43,40 +113,219 @@ func InitializeAndReadConfiguration() (Configuration, error) {
 		return configuration, errors.Wrap(err, "could not initialize")
 	}
 
+	logEffectiveConfiguration(configuration, sources)
+
 	return configuration, nil
 }
 
-func readConfiguration() (Configuration, error) {
+func readConfiguration() (Configuration, configurationSources, error) {
 	configuration := Configuration{}
+	sources := configurationSources{}
+
+	confPath := configurationPath()
+
+	data, err := readConfigurationFile(confPath, os.LookupEnv)
+	if err != nil {
+		return configuration, sources, err
+	}
+
+	err = yaml.Unmarshal(data, &configuration)
+	if err != nil {
+		return configuration, sources, errors.Wrapf(err, "failed to unmarshal configuration %s", confPath)
+	}
+
+	fileValues := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &fileValues)
+	if err != nil {
+		return configuration, sources, errors.Wrapf(err, "failed to unmarshal configuration %s", confPath)
+	}
+
+	for key := range fileValues {
+		sources[key] = ConfigurationSourceFile
+	}
+
+	err = applyEnvironment(&configuration, sources, os.LookupEnv)
+	if err != nil {
+		return configuration, sources, errors.Wrap(err, "failed to apply configuration from environment")
+	}
 
-	confPath := "carp.yml"
+	return configuration, sources, nil
+}
+
+// readConfigurationFile reads the configuration file. A missing file is read as empty if the environment provides
+// configuration values, so that carp can be configured by environment variables alone.
+func readConfigurationFile(confPath string, lookupEnv func(string) (string, bool)) ([]byte, error) {
+	if _, err := os.Stat(confPath); os.IsNotExist(err) {
+		if environmentProvidesConfiguration(lookupEnv) {
+			// logged by logEffectiveConfiguration, after the logger is prepared
+			return nil, nil
+		}
+		return nil, errors.Errorf("could not find configuration at %s", confPath)
+	}
+
+	data, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read configuration %s", confPath)
+	}
+	return data, nil
+}
+
+// environmentProvidesConfiguration reports whether an environment variable exists for any configuration value.
+func environmentProvidesConfiguration(lookupEnv func(string) (string, bool)) bool {
+	for _, field := range yamlFields(reflect.TypeOf(Configuration{})) {
+		if _, ok := lookupEnv(environmentVariableName(field.key)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// configurationPath returns the first non-flag argument of the process or carp.yml if there is none.
+func configurationPath() string {
 	if len(os.Args) > 1 {
 		for _, arg := range os.Args[1:] {
 			if !strings.HasPrefix(arg, "-") {
-				confPath = arg
-				break
+				return arg
 			}
 		}
 	}
 
-	if _, err := os.Stat(confPath); os.IsNotExist(err) {
-		return configuration, errors.Errorf("could not find configuration at %s", confPath)
+	return "carp.yml"
+}
+
+// applyEnvironment overrides every yaml-tagged field of the configuration for which an environment variable
+// exists. The name of the variable is the yaml key in upper case, prefixed with EnvironmentPrefix and with dashes
+// replaced by underscores. Values of string lists are split at commas unless they are a yaml flow sequence; values of
+// other non-string fields are parsed as yaml.
+func applyEnvironment(configuration *Configuration, sources configurationSources, lookupEnv func(string) (string, bool)) error {
+	value := reflect.ValueOf(configuration).Elem()
+
+	for _, field := range yamlFields(value.Type()) {
+		envName := environmentVariableName(field.key)
+		envValue, ok := lookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		fieldValue := value.FieldByIndex(field.index)
+		if fieldValue.Kind() == reflect.String {
+			fieldValue.SetString(envValue)
+		} else if isStringList(fieldValue.Type()) && !strings.HasPrefix(strings.TrimSpace(envValue), "[") {
+			fieldValue.Set(reflect.ValueOf(splitEnvironmentList(envValue)).Convert(fieldValue.Type()))
+		} else {
+			parsed := reflect.New(fieldValue.Type())
+			if err := yaml.Unmarshal([]byte(envValue), parsed.Interface()); err != nil {
+				return errors.Wrapf(err, "failed to parse value of %s", envName)
+			}
+			fieldValue.Set(parsed.Elem())
+		}
+
+		sources[field.key] = ConfigurationSourceEnvironment
 	}
 
-	data, err := ioutil.ReadFile(confPath)
-	if err != nil {
-		return configuration, errors.Wrapf(err, "failed to read configuration %s", confPath)
+	return nil
+}
+
+func isMissingFile(path string) bool {
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
+
+func isStringList(fieldType reflect.Type) bool {
+	return fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.String
+}
+
+// splitEnvironmentList splits a comma-separated list, e.g. 10.0.0.0/8, 192.0.2.1. Empty elements are dropped.
+func splitEnvironmentList(envValue string) []string {
+	values := []string{}
+	for _, element := range strings.Split(envValue, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			values = append(values, element)
+		}
 	}
+	return values
+}
 
-	err = yaml.Unmarshal(data, &configuration)
-	if err != nil {
-		return configuration, errors.Wrapf(err, "failed to unmarshal configuration %s", confPath)
+func environmentVariableName(key string) string {
+	return EnvironmentPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// logEffectiveConfiguration logs every configuration value with its source. Values of fields tagged with
+// `carp:"secret"` are masked.
+func logEffectiveConfiguration(configuration Configuration, sources configurationSources) {
+	if confPath := configurationPath(); isMissingFile(confPath) {
+		log.Infof("could not find configuration at %s; using configuration from environment", confPath)
 	}
 
-	return configuration, nil
+	value := reflect.ValueOf(configuration)
+
+	for _, field := range yamlFields(value.Type()) {
+		source, ok := sources[field.key]
+		if !ok {
+			source = ConfigurationSourceDefault
+		}
+
+		log.Infof("configuration %s=%s (%s)", field.key, formatConfigurationValue(field, value.FieldByIndex(field.index)), source)
+	}
+}
+
+func formatConfigurationValue(field yamlField, value reflect.Value) string {
+	if field.secret {
+		if value.IsZero() {
+			return ""
+		}
+		return _MaskedConfigurationValue
+	}
+
+	return fmt.Sprintf("%v", value.Interface())
+}
+
+// maskedConfiguration returns every configuration value by its yaml key. Values of fields tagged with
+// `carp:"secret"` are masked.
+func maskedConfiguration(configuration Configuration) map[string]interface{} {
+	value := reflect.ValueOf(configuration)
+	values := map[string]interface{}{}
+
+	for _, field := range yamlFields(value.Type()) {
+		fieldValue := value.FieldByIndex(field.index)
+		if field.secret && !fieldValue.IsZero() {
+			values[field.key] = _MaskedConfigurationValue
+			continue
+		}
+		values[field.key] = fieldValue.Interface()
+	}
+
+	return values
+}
+
+type yamlField struct {
+	key    string
+	index  []int
+	secret bool
+}
+
+func yamlFields(t reflect.Type) []yamlField {
+	var fields []yamlField
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		fields = append(fields, yamlField{
+			key:    key,
+			index:  field.Index,
+			secret: field.Tag.Get("carp") == "secret",
+		})
+	}
+
+	return fields
 }
 
 // Deprecated: ReadConfiguration exists for historical compatibility
 func ReadConfiguration() (Configuration, error) {
-	return readConfiguration()
+	configuration, _, err := readConfiguration()
+	return configuration, err
 }
@@ -0,0 +1,162 @@
+package carp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConfiguration(t *testing.T) {
+	writeConfig := func(t *testing.T, content string) {
+		confPath := filepath.Join(t.TempDir(), "carp.yml")
+		require.NoError(t, os.WriteFile(confPath, []byte(content), 0600))
+
+		oldArgs := os.Args
+		os.Args = []string{"carp", "-flag", confPath}
+		t.Cleanup(func() { os.Args = oldArgs })
+	}
+
+	t.Run("should read configuration from file", func(t *testing.T) {
+		writeConfig(t, "cas-url: https://cas.example.com/cas\nport: 9090\n")
+
+		configuration, sources, err := readConfiguration()
+
+		require.NoError(t, err)
+		assert.Equal(t, "https://cas.example.com/cas", configuration.CasUrl)
+		assert.Equal(t, 9090, configuration.Port)
+		assert.Equal(t, configurationSources{"cas-url": ConfigurationSourceFile, "port": ConfigurationSourceFile}, sources)
+	})
+
+	t.Run("should override configuration from file with environment", func(t *testing.T) {
+		writeConfig(t, "cas-url: https://cas.example.com/cas\nport: 9090\n")
+		t.Setenv("CARP_CAS_URL", "https://other.example.com/cas")
+		t.Setenv("CARP_LIMITER_TOKEN_RATE", "10")
+		t.Setenv("CARP_SKIP_SSL_VERIFICATION", "true")
+
+		configuration, sources, err := readConfiguration()
+
+		require.NoError(t, err)
+		assert.Equal(t, "https://other.example.com/cas", configuration.CasUrl)
+		assert.Equal(t, 9090, configuration.Port)
+		assert.Equal(t, 10, configuration.LimiterTokenRate)
+		assert.True(t, configuration.SkipSSLVerification)
+		assert.Equal(t, ConfigurationSourceEnvironment, sources["cas-url"])
+		assert.Equal(t, ConfigurationSourceFile, sources["port"])
+		assert.Equal(t, ConfigurationSourceEnvironment, sources["limiter-token-rate"])
+	})
+
+	t.Run("should fail for invalid value in environment", func(t *testing.T) {
+		writeConfig(t, "port: 9090\n")
+		t.Setenv("CARP_PORT", "not-a-number")
+
+		_, _, err := readConfiguration()
+
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "failed to parse value of CARP_PORT")
+	})
+
+	t.Run("should fail for missing configuration file", func(t *testing.T) {
+		oldArgs := os.Args
+		os.Args = []string{"carp", filepath.Join(t.TempDir(), "missing.yml")}
+		defer func() { os.Args = oldArgs }()
+
+		_, _, err := readConfiguration()
+
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "could not find configuration at")
+	})
+
+	t.Run("should read configuration from environment without configuration file", func(t *testing.T) {
+		oldArgs := os.Args
+		os.Args = []string{"carp", filepath.Join(t.TempDir(), "missing.yml")}
+		defer func() { os.Args = oldArgs }()
+		t.Setenv("CARP_CAS_URL", "https://cas.example.com/cas")
+		t.Setenv("CARP_PORT", "9090")
+
+		configuration, sources, err := readConfiguration()
+
+		require.NoError(t, err)
+		assert.Equal(t, "https://cas.example.com/cas", configuration.CasUrl)
+		assert.Equal(t, 9090, configuration.Port)
+		assert.Equal(t, configurationSources{"cas-url": ConfigurationSourceEnvironment, "port": ConfigurationSourceEnvironment}, sources)
+	})
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	t.Run("should not override values without environment variable", func(t *testing.T) {
+		configuration := Configuration{CasUrl: "https://cas.example.com/cas"}
+		sources := configurationSources{}
+
+		err := applyEnvironment(&configuration, sources, func(string) (string, bool) { return "", false })
+
+		require.NoError(t, err)
+		assert.Equal(t, "https://cas.example.com/cas", configuration.CasUrl)
+		assert.Empty(t, sources)
+	})
+
+	t.Run("should keep string values verbatim", func(t *testing.T) {
+		configuration := Configuration{}
+		env := map[string]string{"CARP_SERVICE_ACCOUNT_NAME_REGEX": "^service_account_: [a-z]+$"}
+
+		err := applyEnvironment(&configuration, configurationSources{}, func(key string) (string, bool) {
+			value, ok := env[key]
+			return value, ok
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, "^service_account_: [a-z]+$", configuration.ServiceAccountNameRegex)
+	})
+
+	t.Run("should split comma-separated lists", func(t *testing.T) {
+		configuration := Configuration{}
+		env := map[string]string{"CARP_TRUSTED_PROXIES": "10.0.0.0/8, 192.0.2.1,"}
+
+		err := applyEnvironment(&configuration, configurationSources{}, func(key string) (string, bool) {
+			value, ok := env[key]
+			return value, ok
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.1"}, configuration.TrustedProxies)
+	})
+
+	t.Run("should parse lists in yaml flow syntax", func(t *testing.T) {
+		configuration := Configuration{}
+
+		err := applyEnvironment(&configuration, configurationSources{}, func(key string) (string, bool) {
+			return "[10.0.0.0/8, 192.0.2.1]", key == "CARP_TRUSTED_PROXIES"
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.1"}, configuration.TrustedProxies)
+	})
+}
+
+func TestLogEffectiveConfiguration(t *testing.T) {
+	t.Run("should log values with their source", func(t *testing.T) {
+		logBuf := new(bytes.Buffer)
+		logging.SetBackend(logging.NewLogBackend(logBuf, "", 0))
+
+		logEffectiveConfiguration(
+			Configuration{CasUrl: "https://cas.example.com/cas", Port: 8080},
+			configurationSources{"cas-url": ConfigurationSourceEnvironment, "port": ConfigurationSourceFile},
+		)
+
+		assert.Contains(t, logBuf.String(), "configuration cas-url=https://cas.example.com/cas (env)")
+		assert.Contains(t, logBuf.String(), "configuration port=8080 (file)")
+		assert.Contains(t, logBuf.String(), "configuration target-url= (default)")
+	})
+
+	t.Run("should mask secret values", func(t *testing.T) {
+		field := yamlField{key: "secret", secret: true}
+
+		assert.Equal(t, "*****", formatConfigurationValue(field, reflect.ValueOf("my-secret")))
+		assert.Equal(t, "", formatConfigurationValue(field, reflect.ValueOf("")))
+	})
+}
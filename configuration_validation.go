@@ -0,0 +1,241 @@
+package carp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/op/go-logging"
+)
+
+// Validate checks the configuration and returns all problems at once as a joined error. Besides the configuration
+// itself, it reads the service-account-credentials-file to check that it is readable and well-formed; no other state
+// is created or changed, so that it can run on every reload.
+func (configuration Configuration) Validate() error {
+	var errs []error
+
+	errs = append(errs, validateUrl("cas-url", configuration.CasUrl, true))
+	errs = append(errs, validateUrl("service-url", configuration.ServiceUrl, true))
+	errs = append(errs, validateUrl("target-url", configuration.Target, true))
+	errs = append(errs, validateUrl("base-url", configuration.BaseUrl, configuration.ResourcePath != ""))
+
+	if configuration.PrincipalHeader == "" {
+		errs = append(errs, errors.New("principal-header is required"))
+	}
+
+	if configuration.Port < 1 || configuration.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535: %d", configuration.Port))
+	}
+
+	if configuration.LoggingFormat != "" && configuration.LoggingFormat != LogFormatJson {
+		if _, err := logging.NewStringFormatter(configuration.LoggingFormat); err != nil {
+			errs = append(errs, fmt.Errorf("invalid log-format %s: %w", configuration.LoggingFormat, err))
+		}
+	}
+
+	if configuration.LogLevel != "" {
+		if _, err := convertLogLevel(configuration.LogLevel); err != nil {
+			errs = append(errs, fmt.Errorf("invalid log-level %s: %w", configuration.LogLevel, err))
+		}
+	}
+
+	if configuration.ConfigReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("config-reload-interval must not be negative: %d", configuration.ConfigReloadInterval))
+	}
+
+	errs = append(errs, validatePath("health-liveness-path", configuration.HealthLivenessPath))
+	errs = append(errs, validatePath("health-readiness-path", configuration.HealthReadinessPath))
+	errs = append(errs, validatePath("metrics-path", configuration.MetricsPath))
+
+	if configuration.CasSessionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("cas-session-lifetime must not be negative: %d", configuration.CasSessionLifetime))
+	}
+
+	if configuration.HealthCheckTimeout < 0 {
+		errs = append(errs, fmt.Errorf("health-check-timeout must not be negative: %d", configuration.HealthCheckTimeout))
+	}
+
+	if configuration.HealthCheckCacheDuration < 0 {
+		errs = append(errs, fmt.Errorf("health-check-cache-duration must not be negative: %d", configuration.HealthCheckCacheDuration))
+	}
+
+	if strings.ContainsAny(configuration.RequestIdHeader, " \t:") {
+		errs = append(errs, fmt.Errorf("request-id-header must be a valid header name: %s", configuration.RequestIdHeader))
+	}
+
+	errs = append(errs, validateTrustedProxies(configuration)...)
+	errs = append(errs, validateUrl("tracing-endpoint", configuration.TracingEndpoint, false))
+	errs = append(errs, validateAttributeHeaders(configuration)...)
+	errs = append(errs, validateIdentityAssertion(configuration)...)
+	errs = append(errs, validateAccessRules(configuration)...)
+	errs = append(errs, validateAuthRoutes(configuration)...)
+	errs = append(errs, validateRequestClassificationRules(configuration)...)
+	errs = append(errs, validateAccessLog(configuration)...)
+	errs = append(errs, validateLimiter(configuration)...)
+	errs = append(errs, validateLogoutRules(configuration)...)
+	errs = append(errs, validateBackendLogout(configuration)...)
+	errs = append(errs, validateAdmin(configuration)...)
+
+	return errors.Join(errs...)
+}
+
+func validateUrl(key string, rawUrl string, required bool) error {
+	if rawUrl == "" {
+		if required {
+			return fmt.Errorf("%s is required", key)
+		}
+		return nil
+	}
+
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return fmt.Errorf("%s must use scheme http or https: %s", key, rawUrl)
+	}
+
+	if parsedUrl.Host == "" {
+		return fmt.Errorf("%s must contain a host: %s", key, rawUrl)
+	}
+
+	return nil
+}
+
+func validatePath(key string, path string) error {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s must start with /: %s", key, path)
+	}
+	return nil
+}
+
+func validateAccessLog(configuration Configuration) []error {
+	if configuration.AccessLogFormat == "" {
+		return nil
+	}
+
+	var errs []error
+
+	if _, err := newAccessLogFormatter(configuration.AccessLogFormat); err != nil {
+		errs = append(errs, fmt.Errorf("invalid access-log-format: %w", err))
+	}
+
+	switch configuration.AccessLogOutput {
+	case "", AccessLogOutputStdout, AccessLogOutputSyslog:
+	case AccessLogOutputFile:
+		if configuration.AccessLogFile == "" {
+			errs = append(errs, errors.New("access-log-file is required for access-log-output file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("access-log-output must be one of stdout, file or syslog: %s", configuration.AccessLogOutput))
+	}
+
+	if configuration.AccessLogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("access-log-max-size must not be negative: %d", configuration.AccessLogMaxSize))
+	}
+
+	if configuration.AccessLogMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("access-log-max-backups must not be negative: %d", configuration.AccessLogMaxBackups))
+	}
+
+	return errs
+}
+
+func validateLimiter(configuration Configuration) []error {
+	var errs []error
+
+	if configuration.ServiceAccountNameRegex != "" {
+		if _, err := regexp.Compile(configuration.ServiceAccountNameRegex); err != nil {
+			errs = append(errs, fmt.Errorf("invalid service-account-name-regex: %w", err))
+		}
+
+		// service-account-requests need a limit
+		if configuration.LimiterTokenRate <= 0 {
+			errs = append(errs, fmt.Errorf("limiter-token-rate must be greater than 0: %d", configuration.LimiterTokenRate))
+		}
+
+		if configuration.LimiterBurstSize <= 0 {
+			errs = append(errs, fmt.Errorf("limiter-burst-size must be greater than 0: %d", configuration.LimiterBurstSize))
+		}
+	} else {
+		// the limiter configuration is used by the cas rest limiter and the ban list as well
+		if configuration.LimiterTokenRate < 0 {
+			errs = append(errs, fmt.Errorf("limiter-token-rate must not be negative: %d", configuration.LimiterTokenRate))
+		}
+
+		if configuration.LimiterBurstSize < 0 {
+			errs = append(errs, fmt.Errorf("limiter-burst-size must not be negative: %d", configuration.LimiterBurstSize))
+		}
+	}
+
+	if configuration.ServiceAccountCredentialsFile != "" {
+		if _, err := readCredentialsFile(configuration.ServiceAccountCredentialsFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if configuration.CasRestLimiterTokenRate < 0 {
+		errs = append(errs, fmt.Errorf("cas-rest-limiter-token-rate must not be negative: %d", configuration.CasRestLimiterTokenRate))
+	}
+
+	if configuration.CasRestLimiterBurstSize < 0 {
+		errs = append(errs, fmt.Errorf("cas-rest-limiter-burst-size must not be negative: %d", configuration.CasRestLimiterBurstSize))
+	} else if configuration.CasRestLimiterTokenRate > 0 && configuration.CasRestLimiterBurstSize == 0 {
+		errs = append(errs, fmt.Errorf("cas-rest-limiter-burst-size must be greater than 0: %d", configuration.CasRestLimiterBurstSize))
+	}
+
+	if configuration.LimiterBanThreshold < 0 {
+		errs = append(errs, fmt.Errorf("limiter-ban-threshold must not be negative: %d", configuration.LimiterBanThreshold))
+	}
+
+	if configuration.LimiterBanWindow < 0 {
+		errs = append(errs, fmt.Errorf("limiter-ban-window must not be negative: %d", configuration.LimiterBanWindow))
+	}
+
+	if configuration.LimiterBanDuration < 0 {
+		errs = append(errs, fmt.Errorf("limiter-ban-duration must not be negative: %d", configuration.LimiterBanDuration))
+	}
+
+	if configuration.LimiterBanMaxDuration < 0 {
+		errs = append(errs, fmt.Errorf("limiter-ban-max-duration must not be negative: %d", configuration.LimiterBanMaxDuration))
+	}
+
+	if configuration.LimiterMaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("limiter-max-entries must not be negative: %d", configuration.LimiterMaxEntries))
+	}
+
+	if configuration.LimiterCleanInterval < 0 {
+		errs = append(errs, fmt.Errorf("limiter-clean-interval must not be negative: %d", configuration.LimiterCleanInterval))
+	}
+
+	return errs
+}
+
+func validateAdmin(configuration Configuration) []error {
+	if configuration.AdminPort == 0 {
+		return nil
+	}
+
+	var errs []error
+
+	if configuration.AdminPort < 0 || configuration.AdminPort > 65535 {
+		errs = append(errs, fmt.Errorf("admin-port must be between 1 and 65535: %d", configuration.AdminPort))
+	}
+
+	if configuration.AdminPort == configuration.Port {
+		errs = append(errs, fmt.Errorf("admin-port must differ from port: %d", configuration.AdminPort))
+	}
+
+	if configuration.AdminToken == "" && configuration.AdminGroup == "" {
+		errs = append(errs, errors.New("admin-token or admin-group is required for admin-port"))
+	}
+
+	if configuration.AdminGroup != "" && configuration.CasRestLimiterTokenRate == 0 {
+		errs = append(errs, errors.New("cas-rest-limiter-token-rate is required for admin-group"))
+	}
+
+	return errs
+}
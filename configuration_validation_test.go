@@ -0,0 +1,295 @@
+package carp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfiguration_Validate(t *testing.T) {
+	validConfiguration := func() Configuration {
+		return Configuration{
+			CasUrl:          "https://cas.example.com/cas",
+			ServiceUrl:      "https://dogu.example.com/dogu",
+			Target:          "http://localhost:8080",
+			PrincipalHeader: "X-CARP-Authentication",
+			Port:            9090,
+		}
+	}
+
+	t.Run("should accept valid configuration", func(t *testing.T) {
+		assert.NoError(t, validConfiguration().Validate())
+	})
+
+	t.Run("should accept valid service-account configuration", func(t *testing.T) {
+		configuration := validConfiguration()
+		configuration.ServiceAccountNameRegex = "^service_account_([A-Za-z0-9]+)_([A-Za-z0-9]+)$"
+		configuration.LimiterTokenRate = 10
+		configuration.LimiterBurstSize = 150
+
+		assert.NoError(t, configuration.Validate())
+	})
+
+	t.Run("should return all problems at once", func(t *testing.T) {
+		err := Configuration{}.Validate()
+
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "cas-url is required")
+		assert.ErrorContains(t, err, "service-url is required")
+		assert.ErrorContains(t, err, "target-url is required")
+		assert.ErrorContains(t, err, "principal-header is required")
+		assert.ErrorContains(t, err, "port must be between 1 and 65535: 0")
+		assert.NotContains(t, err.Error(), "base-url")
+	})
+
+	tests := []struct {
+		name    string
+		modify  func(configuration *Configuration)
+		wantErr string
+	}{
+		{
+			"should fail for url without scheme",
+			func(configuration *Configuration) { configuration.Target = "localhost:8080" },
+			"target-url must use scheme http or https: localhost:8080",
+		},
+		{
+			"should fail for url without host",
+			func(configuration *Configuration) { configuration.CasUrl = "https:///cas" },
+			"cas-url must contain a host: https:///cas",
+		},
+		{
+			"should fail for unparsable url",
+			func(configuration *Configuration) { configuration.ServiceUrl = "http://example.com/%ZZ" },
+			"invalid service-url",
+		},
+		{
+			"should fail for resource-path without base-url",
+			func(configuration *Configuration) { configuration.ResourcePath = "/nexus/repository" },
+			"base-url is required",
+		},
+		{
+			"should fail for port out of range",
+			func(configuration *Configuration) { configuration.Port = 70000 },
+			"port must be between 1 and 65535: 70000",
+		},
+		{
+			"should fail for invalid log-format",
+			func(configuration *Configuration) { configuration.LoggingFormat = "%{unknown}" },
+			"invalid log-format %{unknown}",
+		},
+		{
+			"should fail for invalid log-level",
+			func(configuration *Configuration) { configuration.LogLevel = "LOUD" },
+			"invalid log-level LOUD",
+		},
+		{
+			"should fail for invalid regex",
+			func(configuration *Configuration) {
+				configuration.ServiceAccountNameRegex = "["
+				configuration.LimiterTokenRate = 1
+				configuration.LimiterBurstSize = 1
+			},
+			"invalid service-account-name-regex: error parsing regexp: missing closing ]",
+		},
+		{
+			"should fail for limiter without token rate",
+			func(configuration *Configuration) {
+				configuration.ServiceAccountNameRegex = ".*"
+				configuration.LimiterBurstSize = 1
+			},
+			"limiter-token-rate must be greater than 0: 0",
+		},
+		{
+			"should fail for limiter without burst size",
+			func(configuration *Configuration) {
+				configuration.ServiceAccountNameRegex = ".*"
+				configuration.LimiterTokenRate = 1
+			},
+			"limiter-burst-size must be greater than 0: 0",
+		},
+		{
+			"should fail for negative clean interval",
+			func(configuration *Configuration) { configuration.LimiterCleanInterval = -1 },
+			"limiter-clean-interval must not be negative: -1",
+		},
+		{
+			"should fail for negative cas session lifetime",
+			func(configuration *Configuration) { configuration.CasSessionLifetime = -1 },
+			"cas-session-lifetime must not be negative: -1",
+		},
+		{
+			"should fail for file access log without file",
+			func(configuration *Configuration) {
+				configuration.AccessLogFormat = AccessLogFormatCombined
+				configuration.AccessLogOutput = AccessLogOutputFile
+			},
+			"access-log-file is required for access-log-output file",
+		},
+		{
+			"should fail for invalid request-id-header",
+			func(configuration *Configuration) { configuration.RequestIdHeader = "X-Request ID" },
+			"request-id-header must be a valid header name: X-Request ID",
+		},
+		{
+			"should fail for attribute-header without header",
+			func(configuration *Configuration) {
+				configuration.AttributeHeaders = []AttributeHeader{{Attribute: "mail"}}
+			},
+			"attribute-headers[0]: header must be a valid header name: ",
+		},
+		{
+			"should fail for attribute-header with unknown encoding",
+			func(configuration *Configuration) {
+				configuration.AttributeHeaders = []AttributeHeader{{Attribute: "mail", Header: "X-Mail", Encoding: "rot13"}}
+			},
+			"attribute-headers[0]: encoding must be base64 or rfc2047: rot13",
+		},
+		{
+			"should fail for short identity-assertion-secret",
+			func(configuration *Configuration) { configuration.IdentityAssertionSecret = "secret" },
+			"identity-assertion-secret must have at least 32 bytes",
+		},
+		{
+			"should fail for access-rule without path",
+			func(configuration *Configuration) {
+				configuration.AccessRules = []AccessRule{{Groups: []string{"admin"}}}
+			},
+			"access-rules[0]: exactly one of path-prefix and path-regex is required",
+		},
+		{
+			"should fail for auth-route with unknown policy",
+			func(configuration *Configuration) {
+				configuration.AuthRoutes = []AuthRoute{{PathPrefix: "/", Policy: "sometimes"}}
+			},
+			"auth-routes[0]: policy must be one of public, optional or required: sometimes",
+		},
+		{
+			"missing service-account-credentials-file",
+			func(configuration *Configuration) {
+				configuration.ServiceAccountCredentialsFile = "/does/not/exist"
+			},
+			"failed to read service-account-credentials-file /does/not/exist",
+		},
+		{
+			"missing cas-rest-limiter-burst-size",
+			func(configuration *Configuration) {
+				configuration.CasRestLimiterTokenRate = 1
+			},
+			"cas-rest-limiter-burst-size must be greater than 0: 0",
+		},
+		{
+			"negative limiter-token-rate without service-account-name-regex",
+			func(configuration *Configuration) {
+				configuration.ServiceAccountNameRegex = ""
+				configuration.LimiterTokenRate = -1
+			},
+			"limiter-token-rate must not be negative: -1",
+		},
+		{
+			"negative limiter-burst-size without service-account-name-regex",
+			func(configuration *Configuration) {
+				configuration.ServiceAccountNameRegex = ""
+				configuration.LimiterBurstSize = -1
+			},
+			"limiter-burst-size must not be negative: -1",
+		},
+		{
+			"negative cas-rest-limiter-burst-size",
+			func(configuration *Configuration) {
+				configuration.CasRestLimiterBurstSize = -1
+			},
+			"cas-rest-limiter-burst-size must not be negative: -1",
+		},
+		{
+			"logout-rules without condition",
+			func(configuration *Configuration) {
+				configuration.LogoutRules = []LogoutRule{{Service: "/welcome"}}
+			},
+			"logout-rules[0]: at least one of method, path-regex and query is required",
+		},
+		{
+			"invalid logout-rules service",
+			func(configuration *Configuration) {
+				configuration.LogoutRules = []LogoutRule{{PathRegex: "^/logout$", Service: "javascript:alert(1)"}}
+			},
+			"logout-rules[0]: service must use scheme http or https: javascript:alert(1)",
+		},
+		{
+			"backend-logout-method without path",
+			func(configuration *Configuration) {
+				configuration.BackendLogoutMethod = "DELETE"
+			},
+			"backend-logout-path is required for backend-logout-method",
+		},
+		{
+			"invalid backend-logout-cookies",
+			func(configuration *Configuration) {
+				configuration.BackendLogoutCookies = []LogoutCookie{{Name: "a;b"}}
+			},
+			`backend-logout-cookies[0]: invalid cookie name: "a;b"`,
+		},
+		{
+			"admin-port without authorization",
+			func(configuration *Configuration) {
+				configuration.AdminPort = 9090
+			},
+			"admin-token or admin-group is required for admin-port",
+		},
+		{
+			"admin-port equals port",
+			func(configuration *Configuration) {
+				configuration.AdminPort = configuration.Port
+				configuration.AdminToken = "secret"
+			},
+			"admin-port must differ from port",
+		},
+		{
+			"admin-group without cas-rest limiter",
+			func(configuration *Configuration) {
+				configuration.AdminPort = 9090
+				configuration.AdminGroup = "admins"
+			},
+			"cas-rest-limiter-token-rate is required for admin-group",
+		},
+		{
+			"negative limiter-ban-duration",
+			func(configuration *Configuration) {
+				configuration.LimiterBanDuration = -1
+			},
+			"limiter-ban-duration must not be negative: -1",
+		},
+		{
+			"invalid trusted-proxies",
+			func(configuration *Configuration) {
+				configuration.TrustedProxies = []string{"10.0.0.0/8", "proxy.example.com"}
+			},
+			"invalid trusted-proxies entry proxy.example.com",
+		},
+		{
+			"invalid trusted-proxy-header",
+			func(configuration *Configuration) {
+				configuration.TrustedProxyHeader = "X-Real-IP"
+			},
+			"trusted-proxy-header must be X-Forwarded-For or Forwarded: X-Real-IP",
+		},
+		{
+			"invalid request-classification-rules",
+			func(configuration *Configuration) {
+				configuration.RequestClassificationRules = []RequestClassificationRule{{UserAgentRegex: "curl", Class: "bot"}}
+			},
+			"request-classification-rules[0]: class must be browser or rest: bot",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configuration := validConfiguration()
+			tt.modify(&configuration)
+
+			err := configuration.Validate()
+
+			require.Error(t, err)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
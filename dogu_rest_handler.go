@@ -28,17 +28,35 @@ func NewDoguRestHandler(configuration Configuration, handler http.Handler) (http
 		return nil, fmt.Errorf("error compiling serviceAccountNameRegex: %w", err)
 	}
 
+	classifier, err := newRequestClassifier(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := newServiceAccountCredentials(configuration)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(writer http.ResponseWriter, request *http.Request) {
-		log.Debugf("doguRestHandler: receiving request: %s", request.URL.String())
+		logger := newRequestLogger(request)
+		logger.debug("doguRestHandler: receiving request")
+		metricsFromRequest(request).countStage(stageDoguRest)
 
 		ctx := request.Context()
 
-		username, _, ok := request.BasicAuth()
+		username, password, ok := request.BasicAuth()
 
-		if ok && configuration.ForwardUnauthenticatedRESTRequests && !IsBrowserRequest(request) && usernameRegex.MatchString(username) {
-			// This is a Rest-Request with a service-account-user -> set in context
-			log.Debugf("doguRestHandler: request with username '%s' is a service-account-rest-request", username)
-			ctx = context.WithValue(ctx, _ServiceAccountAuthContextKey, true)
+		if ok && configuration.ForwardUnauthenticatedRESTRequests && !isBrowserRequest(classifier, request) && usernameRegex.MatchString(username) {
+			if credentials.verify(username, password) {
+				// This is a Rest-Request with a service-account-user -> set in context
+				logger.withUsername(username).debug("doguRestHandler: request is a service-account-rest-request")
+				ctx = context.WithValue(ctx, _ServiceAccountAuthContextKey, true)
+			} else {
+				// CAS is not bypassed; the throttling handler rejects the request and charges a token
+				logger.withUsername(username).debug("doguRestHandler: service account credentials rejected")
+				ctx = context.WithValue(ctx, _ServiceAccountRejectedContextKey, true)
+			}
 		}
 
 		// forward request to next handler with new context
@@ -0,0 +1,220 @@
+package carp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	_DefaultHealthLivenessPath       = "/carp/health/live"
+	_DefaultHealthReadinessPath      = "/carp/health/ready"
+	_DefaultHealthCheckTimeout       = 5
+	_DefaultHealthCheckCacheDuration = 10
+)
+
+const (
+	HealthStatusUp   = "UP"
+	HealthStatusDown = "DOWN"
+)
+
+// HealthResponse is the JSON body of the liveness and readiness endpoints.
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of a single check of a HealthResponse.
+type HealthCheck struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthHandler struct {
+	delegate      http.Handler
+	livenessPath  string
+	readinessPath string
+	targets       map[string]string
+	client        *http.Client
+	timeout       time.Duration
+	cacheDuration time.Duration
+
+	mu        sync.Mutex
+	cached    *HealthResponse
+	checkedAt time.Time
+	// running is closed when the running readiness check is finished
+	running chan struct{}
+}
+
+// NewHealthHandler creates a handler which answers the liveness and readiness endpoints itself and delegates all
+// other requests to the given handler. The readiness endpoint probes the CAS and the target.
+func NewHealthHandler(configuration Configuration, handler http.Handler) http.Handler {
+	httpClient := &http.Client{
+		// a redirect (e.g. to the login page) proves the reachability already
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if configuration.SkipSSLVerification {
+		httpClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	return &healthHandler{
+		delegate:      handler,
+		livenessPath:  valueOrDefault(configuration.HealthLivenessPath, _DefaultHealthLivenessPath),
+		readinessPath: valueOrDefault(configuration.HealthReadinessPath, _DefaultHealthReadinessPath),
+		targets: map[string]string{
+			"cas":    configuration.CasUrl,
+			"target": configuration.Target,
+		},
+		client:        httpClient,
+		timeout:       secondsOrDefault(configuration.HealthCheckTimeout, _DefaultHealthCheckTimeout),
+		cacheDuration: secondsOrDefault(configuration.HealthCheckCacheDuration, _DefaultHealthCheckCacheDuration),
+	}
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case h.livenessPath:
+		writeHealthResponse(w, &HealthResponse{
+			Status: HealthStatusUp,
+			Checks: map[string]HealthCheck{"process": {Status: HealthStatusUp}},
+		})
+	case h.readinessPath:
+		response, err := h.readiness(r.Context())
+		if err != nil {
+			// the caller is gone
+			return
+		}
+		writeHealthResponse(w, response)
+	default:
+		h.delegate.ServeHTTP(w, r)
+	}
+}
+
+// readiness returns the cached readiness result or waits for a new check. The check runs detached from the
+// requests, so that a caller which disconnects neither fails the probes nor blocks the other callers.
+func (h *healthHandler) readiness(ctx context.Context) (*HealthResponse, error) {
+	h.mu.Lock()
+	if h.cached != nil && time.Since(h.checkedAt) < h.cacheDuration {
+		defer h.mu.Unlock()
+		return h.cached, nil
+	}
+	if h.running == nil {
+		h.running = make(chan struct{})
+		go h.check(h.running)
+	}
+	running := h.running
+	h.mu.Unlock()
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cached, nil
+}
+
+func (h *healthHandler) check(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	response := &HealthResponse{Status: HealthStatusUp, Checks: map[string]HealthCheck{}}
+
+	var checksMu sync.Mutex
+	var wg sync.WaitGroup
+	for name, target := range h.targets {
+		wg.Add(1)
+		go func(name string, target string) {
+			defer wg.Done()
+			check := h.probe(ctx, target)
+
+			checksMu.Lock()
+			defer checksMu.Unlock()
+			response.Checks[name] = check
+			if check.Status != HealthStatusUp {
+				response.Status = HealthStatusDown
+			}
+		}(name, target)
+	}
+	wg.Wait()
+
+	if response.Status != HealthStatusUp {
+		log.Warningf("Readiness check failed: %v", response.Checks)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cached = response
+	h.checkedAt = time.Now()
+	h.running = nil
+	close(done)
+}
+
+func (h *healthHandler) probe(ctx context.Context, target string) HealthCheck {
+	start := time.Now()
+	check := func(err error) HealthCheck {
+		result := HealthCheck{Status: HealthStatusUp, LatencyMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Status = HealthStatusDown
+			result.Error = err.Error()
+		}
+		return result
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return check(fmt.Errorf("failed to create request: %w", err))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return check(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return check(fmt.Errorf("unexpected status code %d", resp.StatusCode))
+	}
+
+	return check(nil)
+}
+
+func writeHealthResponse(w http.ResponseWriter, response *HealthResponse) {
+	statusCode := http.StatusOK
+	if response.Status != HealthStatusUp {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("failed to write health response: %s", err.Error())
+	}
+}
+
+func valueOrDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func secondsOrDefault(seconds int, defaultSeconds int) time.Duration {
+	if seconds == 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,167 @@
+package carp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler(t *testing.T) {
+	unreachableHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to delegate: %s", r.URL.String())
+	})
+
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) HealthResponse {
+		var response HealthResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	newBackend := func(t *testing.T, statusCode int, counter *int32) *httptest.Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if counter != nil {
+				atomic.AddInt32(counter, 1)
+			}
+			w.WriteHeader(statusCode)
+		}))
+		t.Cleanup(backend.Close)
+		return backend
+	}
+
+	t.Run("should answer liveness without delegate", func(t *testing.T) {
+		handler := NewHealthHandler(Configuration{}, unreachableHandler)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/health/live", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		response := decode(t, w)
+		assert.Equal(t, HealthStatusUp, response.Status)
+		assert.Equal(t, HealthStatusUp, response.Checks["process"].Status)
+	})
+
+	t.Run("should answer readiness with per-check status", func(t *testing.T) {
+		cas := newBackend(t, http.StatusFound, nil)
+		target := newBackend(t, http.StatusUnauthorized, nil)
+		handler := NewHealthHandler(Configuration{CasUrl: cas.URL, Target: target.URL}, unreachableHandler)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/health/ready", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		response := decode(t, w)
+		assert.Equal(t, HealthStatusUp, response.Status)
+		assert.Equal(t, HealthStatusUp, response.Checks["cas"].Status)
+		assert.Equal(t, HealthStatusUp, response.Checks["target"].Status)
+	})
+
+	t.Run("should report unavailable target", func(t *testing.T) {
+		cas := newBackend(t, http.StatusOK, nil)
+		target := newBackend(t, http.StatusBadGateway, nil)
+		handler := NewHealthHandler(Configuration{CasUrl: cas.URL, Target: target.URL}, unreachableHandler)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/health/ready", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		response := decode(t, w)
+		assert.Equal(t, HealthStatusDown, response.Status)
+		assert.Equal(t, HealthStatusUp, response.Checks["cas"].Status)
+		assert.Equal(t, HealthStatusDown, response.Checks["target"].Status)
+		assert.Equal(t, "unexpected status code 502", response.Checks["target"].Error)
+	})
+
+	t.Run("should report unreachable cas", func(t *testing.T) {
+		cas := newBackend(t, http.StatusOK, nil)
+		cas.Close()
+		target := newBackend(t, http.StatusOK, nil)
+		handler := NewHealthHandler(Configuration{CasUrl: cas.URL, Target: target.URL}, unreachableHandler)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/health/ready", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		response := decode(t, w)
+		assert.Equal(t, HealthStatusDown, response.Checks["cas"].Status)
+		assert.NotEmpty(t, response.Checks["cas"].Error)
+	})
+
+	t.Run("should cache readiness result", func(t *testing.T) {
+		var probes int32
+		cas := newBackend(t, http.StatusOK, &probes)
+		target := newBackend(t, http.StatusOK, &probes)
+		handler := NewHealthHandler(Configuration{CasUrl: cas.URL, Target: target.URL, HealthCheckCacheDuration: 60}, unreachableHandler)
+
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/health/ready", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+
+		assert.Equal(t, int32(2), atomic.LoadInt32(&probes))
+	})
+
+	t.Run("should not fail readiness for cancelled caller", func(t *testing.T) {
+		var probes int32
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&probes, 1)
+			<-release
+		}))
+		t.Cleanup(slow.Close)
+		t.Cleanup(func() {
+			select {
+			case <-release:
+			default:
+				close(release)
+			}
+		})
+		handler := NewHealthHandler(Configuration{CasUrl: slow.URL, Target: slow.URL, HealthCheckCacheDuration: 60}, unreachableHandler)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelled := make(chan struct{})
+		go func() {
+			defer close(cancelled)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/carp/health/ready", nil).WithContext(ctx))
+		}()
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&probes) == 2 }, time.Second, 10*time.Millisecond)
+		cancel()
+		<-cancelled
+
+		close(release)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/health/ready", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, HealthStatusUp, decode(t, w).Status)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&probes))
+	})
+
+	t.Run("should use configured paths", func(t *testing.T) {
+		handler := NewHealthHandler(Configuration{HealthLivenessPath: "/livez"}, unreachableHandler)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("should delegate other requests", func(t *testing.T) {
+		delegated := false
+		handler := NewHealthHandler(Configuration{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delegated = true
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nexus/carp/health/live", nil))
+
+		assert.True(t, delegated)
+	})
+}
@@ -1,12 +1,20 @@
 package carp
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
+// IsBrowserRequest classifies the request by its User-Agent. The handlers use the RequestClassifier of the
+// configuration instead.
 func IsBrowserRequest(req *http.Request) bool {
-	return isBrowserUserAgent(req.Header.Get("User-Agent")) || isSingleLogoutRequest(req)
+	return isBrowserRequest(userAgentRequestClassifier{}, req)
 }
 
 func isBrowserUserAgent(userAgent string) bool {
@@ -33,10 +41,110 @@ func isSingleLogoutRequest(r *http.Request) bool {
 
 type statusResponseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int64
 }
 
 func (s *statusResponseWriter) WriteHeader(statusCode int) {
 	s.ResponseWriter.WriteHeader(statusCode)
 	s.statusCode = statusCode
 }
+
+func (s *statusResponseWriter) Write(data []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(data)
+	s.bytesWritten += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher for streamed responses of the target
+func (s *statusResponseWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker for websocket connections to the target
+func (s *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	s.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+const _RequestInfoContextKey = "RequestInfo"
+
+// requestInfo collects information about a request from the handlers of the chain, so that it is available to the
+// outer handlers after the request has been served.
+type requestInfo struct {
+	mu   sync.Mutex
+	data requestInfoData
+}
+
+type requestInfoData struct {
+	clientIp         string
+	requestId        string
+	username         string
+	serviceAccount   bool
+	throttled        bool
+	upstreamDuration time.Duration
+}
+
+// withRequestInfo adds a new requestInfo to the context of the request.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), _RequestInfoContextKey, info)), info
+}
+
+// requestInfoFromRequest returns the requestInfo of the request. The result is nil if the request has no
+// requestInfo; all methods of requestInfo can be called on nil.
+func requestInfoFromRequest(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(_RequestInfoContextKey).(*requestInfo)
+	return info
+}
+
+func (i *requestInfo) update(update func(data *requestInfoData)) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	update(&i.data)
+}
+
+func (i *requestInfo) setClientIp(clientIp string) {
+	i.update(func(data *requestInfoData) { data.clientIp = clientIp })
+}
+
+func (i *requestInfo) setRequestId(requestId string) {
+	i.update(func(data *requestInfoData) { data.requestId = requestId })
+}
+
+func (i *requestInfo) setUsername(username string) {
+	i.update(func(data *requestInfoData) { data.username = username })
+}
+
+func (i *requestInfo) setServiceAccount(username string) {
+	i.update(func(data *requestInfoData) {
+		data.username = username
+		data.serviceAccount = true
+	})
+}
+
+func (i *requestInfo) setThrottled() {
+	i.update(func(data *requestInfoData) { data.throttled = true })
+}
+
+func (i *requestInfo) setUpstreamDuration(duration time.Duration) {
+	i.update(func(data *requestInfoData) { data.upstreamDuration = duration })
+}
+
+func (i *requestInfo) snapshot() requestInfoData {
+	if i == nil {
+		return requestInfoData{}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.data
+}
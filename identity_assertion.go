@@ -0,0 +1,292 @@
+package carp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	_DefaultIdentityAssertionHeader   = "X-CARP-Assertion"
+	_DefaultIdentityAssertionLifetime = 60
+	_DefaultIdentityAssertionJwksPath = "/carp/jwks.json"
+	_MinIdentityAssertionSecretLength = 32
+)
+
+// IdentityAssertionClaims are the claims of the identity assertion which is passed to the target.
+type IdentityAssertionClaims struct {
+	jwt.RegisteredClaims
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// identityAssertionSigner mints short-lived JWTs which assert the identity of an authenticated user to the target.
+type identityAssertionSigner struct {
+	header     string
+	method     jwt.SigningMethod
+	key        interface{}
+	publicKey  crypto.PublicKey
+	keyId      string
+	issuer     string
+	audience   string
+	lifetime   time.Duration
+	attributes []string
+}
+
+func identityAssertionConfigured(configuration Configuration) bool {
+	return configuration.IdentityAssertionSecret != "" || configuration.IdentityAssertionKeyFile != ""
+}
+
+// newIdentityAssertionSigner creates the signer of the identity assertions. The result is nil if neither a secret
+// nor a key file is configured.
+func newIdentityAssertionSigner(configuration Configuration) (*identityAssertionSigner, error) {
+	if !identityAssertionConfigured(configuration) {
+		return nil, nil
+	}
+
+	signer := &identityAssertionSigner{
+		header:     valueOrDefault(configuration.IdentityAssertionHeader, _DefaultIdentityAssertionHeader),
+		issuer:     configuration.ServiceUrl,
+		audience:   valueOrDefault(configuration.IdentityAssertionAudience, configuration.Target),
+		lifetime:   secondsOrDefault(configuration.IdentityAssertionLifetime, _DefaultIdentityAssertionLifetime),
+		attributes: configuration.IdentityAssertionAttributes,
+	}
+
+	if configuration.IdentityAssertionSecret != "" {
+		signer.method = jwt.SigningMethodHS256
+		signer.key = []byte(configuration.IdentityAssertionSecret)
+		return signer, nil
+	}
+
+	privateKey, err := readPrivateKey(configuration.IdentityAssertionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		signer.method = jwt.SigningMethodRS256
+		signer.publicKey = &key.PublicKey
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			signer.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			signer.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			signer.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve of identity-assertion-key-file: %s", key.Curve.Params().Name)
+		}
+		signer.publicKey = &key.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported key type of identity-assertion-key-file: %T", privateKey)
+	}
+	signer.key = privateKey
+
+	signer.keyId, err = signer.jwk().thumbprint()
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity-assertion-key-file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("identity-assertion-key-file %s contains no PEM block", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("identity-assertion-key-file %s contains no RSA or EC private key", path)
+}
+
+// sign creates the identity assertion of the user with the configured attributes.
+func (s *identityAssertionSigner) sign(username string, attributes UserAttibutes, now time.Time) (string, error) {
+	claims := IdentityAssertionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   username,
+			Issuer:    s.issuer,
+			Audience:  jwt.ClaimStrings{s.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.lifetime)),
+		},
+	}
+
+	for _, attribute := range s.attributes {
+		if values, ok := attributes[attribute]; ok {
+			if claims.Attributes == nil {
+				claims.Attributes = map[string][]string{}
+			}
+			claims.Attributes[attribute] = values
+		}
+	}
+
+	token := jwt.NewWithClaims(s.method, claims)
+	if s.keyId != "" {
+		token.Header["kid"] = s.keyId
+	}
+
+	assertion, err := token.SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign identity assertion: %w", err)
+	}
+
+	return assertion, nil
+}
+
+// JSONWebKeySet is the body of the JWKS endpoint.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey is the public key of the identity assertions as defined in RFC 7517.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	KeyId     string `json:"kid,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+func (s *identityAssertionSigner) jwk() JSONWebKey {
+	switch key := s.publicKey.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: s.method.Alg(),
+			KeyId:     s.keyId,
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			KeyType:   "EC",
+			Use:       "sig",
+			Algorithm: s.method.Alg(),
+			KeyId:     s.keyId,
+			Curve:     key.Curve.Params().Name,
+			X:         base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:         base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}
+	default:
+		return JSONWebKey{}
+	}
+}
+
+// thumbprint computes the JWK thumbprint of RFC 7638 which is used as key id.
+func (k JSONWebKey) thumbprint() (string, error) {
+	var members interface{}
+	switch k.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.KeyType, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Curve, k.KeyType, k.X, k.Y}
+	default:
+		return "", fmt.Errorf("unsupported key type %s", k.KeyType)
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// NewJwksHandler creates a handler which answers the JWKS endpoint with the public key of the identity assertions
+// and delegates all other requests to the given handler. The endpoint is only served for RSA and EC keys, because
+// the secret of HS256 can not be published.
+func NewJwksHandler(configuration Configuration, handler http.Handler) (http.Handler, error) {
+	signer, err := newIdentityAssertionSigner(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if signer == nil || signer.publicKey == nil {
+		return handler, nil
+	}
+
+	jwksPath := valueOrDefault(configuration.IdentityAssertionJwksPath, _DefaultIdentityAssertionJwksPath)
+	body, err := json.Marshal(JSONWebKeySet{Keys: []JSONWebKey{signer.jwk()}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal jwks: %w", err)
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != jwksPath {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		if _, err := writer.Write(body); err != nil {
+			log.Errorf("failed to write jwks response: %s", err.Error())
+		}
+	}), nil
+}
+
+func validateIdentityAssertion(configuration Configuration) []error {
+	var errs []error
+
+	if configuration.IdentityAssertionSecret != "" && configuration.IdentityAssertionKeyFile != "" {
+		errs = append(errs, fmt.Errorf("only one of identity-assertion-secret and identity-assertion-key-file must be set"))
+	}
+
+	if configuration.IdentityAssertionSecret != "" && len(configuration.IdentityAssertionSecret) < _MinIdentityAssertionSecretLength {
+		errs = append(errs, fmt.Errorf("identity-assertion-secret must have at least %d bytes", _MinIdentityAssertionSecretLength))
+	}
+
+	if configuration.IdentityAssertionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("identity-assertion-lifetime must not be negative: %d", configuration.IdentityAssertionLifetime))
+	}
+
+	errs = append(errs, validatePath("identity-assertion-jwks-path", configuration.IdentityAssertionJwksPath))
+
+	return errs
+}
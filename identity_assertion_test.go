@@ -0,0 +1,200 @@
+package carp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePrivateKey(t *testing.T, key interface{}) string {
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "assertion.key")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600))
+	return path
+}
+
+func fetchJwks(t *testing.T, configuration Configuration) JSONWebKeySet {
+	handler, err := NewJwksHandler(configuration, http.NotFoundHandler())
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var jwks JSONWebKeySet
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	return jwks
+}
+
+func decodeBase64Url(t *testing.T, value string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	require.NoError(t, err)
+	return data
+}
+
+func TestIdentityAssertionSigner(t *testing.T) {
+	now := time.Now()
+	attributes := UserAttibutes{
+		"mail":   {"tricia@example.com"},
+		"groups": {"admin", "users"},
+		"secret": {"not included"},
+	}
+	baseConfiguration := Configuration{
+		ServiceUrl:                  "https://carp.example.com/",
+		Target:                      "http://backend:8080",
+		IdentityAssertionAttributes: []string{"mail", "groups"},
+	}
+
+	assertClaims := func(t *testing.T, token *jwt.Token) {
+		claims := token.Claims.(*IdentityAssertionClaims)
+		assert.Equal(t, "tricia", claims.Subject)
+		assert.Equal(t, "https://carp.example.com/", claims.Issuer)
+		assert.Equal(t, jwt.ClaimStrings{"http://backend:8080"}, claims.Audience)
+		assert.Equal(t, now.Unix(), claims.IssuedAt.Unix())
+		assert.Equal(t, now.Add(time.Minute).Unix(), claims.ExpiresAt.Unix())
+		assert.Equal(t, map[string][]string{"mail": {"tricia@example.com"}, "groups": {"admin", "users"}}, claims.Attributes)
+	}
+
+	t.Run("should sign with HS256 secret", func(t *testing.T) {
+		configuration := baseConfiguration
+		configuration.IdentityAssertionSecret = "0123456789abcdef0123456789abcdef"
+
+		signer, err := newIdentityAssertionSigner(configuration)
+		require.NoError(t, err)
+		assertion, err := signer.sign("tricia", attributes, now)
+		require.NoError(t, err)
+
+		token, err := jwt.ParseWithClaims(assertion, &IdentityAssertionClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return []byte(configuration.IdentityAssertionSecret), nil
+		}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithAudience("http://backend:8080"))
+		require.NoError(t, err)
+		assertClaims(t, token)
+	})
+
+	t.Run("should sign with RSA key verifiable by jwks", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		configuration := baseConfiguration
+		configuration.IdentityAssertionKeyFile = writePrivateKey(t, key)
+
+		signer, err := newIdentityAssertionSigner(configuration)
+		require.NoError(t, err)
+		assertion, err := signer.sign("tricia", attributes, now)
+		require.NoError(t, err)
+
+		jwk := fetchJwks(t, configuration).Keys[0]
+		assert.Equal(t, "RSA", jwk.KeyType)
+		assert.Equal(t, "RS256", jwk.Algorithm)
+		publicKey := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decodeBase64Url(t, jwk.N)),
+			E: int(new(big.Int).SetBytes(decodeBase64Url(t, jwk.E)).Int64()),
+		}
+
+		token, err := jwt.ParseWithClaims(assertion, &IdentityAssertionClaims{}, func(token *jwt.Token) (interface{}, error) {
+			assert.Equal(t, jwk.KeyId, token.Header["kid"])
+			return publicKey, nil
+		}, jwt.WithValidMethods([]string{"RS256"}))
+		require.NoError(t, err)
+		assertClaims(t, token)
+	})
+
+	t.Run("should sign with EC key verifiable by jwks", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		require.NoError(t, err)
+		configuration := baseConfiguration
+		configuration.IdentityAssertionKeyFile = writePrivateKey(t, key)
+
+		signer, err := newIdentityAssertionSigner(configuration)
+		require.NoError(t, err)
+		assertion, err := signer.sign("tricia", attributes, now)
+		require.NoError(t, err)
+
+		jwk := fetchJwks(t, configuration).Keys[0]
+		assert.Equal(t, "EC", jwk.KeyType)
+		assert.Equal(t, "P-384", jwk.Curve)
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P384(),
+			X:     new(big.Int).SetBytes(decodeBase64Url(t, jwk.X)),
+			Y:     new(big.Int).SetBytes(decodeBase64Url(t, jwk.Y)),
+		}
+
+		token, err := jwt.ParseWithClaims(assertion, &IdentityAssertionClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return publicKey, nil
+		}, jwt.WithValidMethods([]string{"ES384"}))
+		require.NoError(t, err)
+		assertClaims(t, token)
+	})
+
+	t.Run("should compute rfc 7638 thumbprint", func(t *testing.T) {
+		// example of RFC 7638 section 3.1
+		jwk := JSONWebKey{
+			KeyType: "RSA",
+			E:       "AQAB",
+			N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		}
+
+		thumbprint, err := jwk.thumbprint()
+
+		require.NoError(t, err)
+		assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+	})
+
+	t.Run("should not be created without secret or key file", func(t *testing.T) {
+		signer, err := newIdentityAssertionSigner(baseConfiguration)
+
+		require.NoError(t, err)
+		assert.Nil(t, signer)
+	})
+
+	t.Run("should fail for key file without private key", func(t *testing.T) {
+		configuration := baseConfiguration
+		configuration.IdentityAssertionKeyFile = filepath.Join(t.TempDir(), "missing.key")
+
+		_, err := newIdentityAssertionSigner(configuration)
+
+		assert.ErrorContains(t, err, "failed to read identity-assertion-key-file")
+	})
+}
+
+func TestProxyHandler_stripsIdentityAssertion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("X-CARP-Assertion"))
+	}))
+	defer srv.Close()
+
+	ph, err := NewProxyHandler(Configuration{
+		ForwardUnauthenticatedRESTRequests: true,
+		Target:                             srv.URL,
+		PrincipalHeader:                    "X-CARP-User",
+		IdentityAssertionSecret:            "0123456789abcdef0123456789abcdef",
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.Header.Set("X-CARP-Assertion", "forged")
+	w := httptest.NewRecorder()
+
+	ph.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,320 @@
+package carp
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const _DefaultLimiterMaxEntries = 10000
+
+// _SharedLimiterStoreRetries is the number of attempts to update a bucket which is updated concurrently by another
+// replica.
+const _SharedLimiterStoreRetries = 10
+
+// Limit is the rate and the size of the token buckets of a LimiterStore.
+type Limit struct {
+	TokenRate int
+	BurstSize int
+}
+
+// LimiterResult is the state of a bucket after a token was requested.
+type LimiterResult struct {
+	Allowed bool
+	// Remaining is the number of tokens left in the bucket.
+	Remaining float64
+	// RetryAfter is the time until the next token is available.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+func newLimiterResult(allowed bool, remaining float64, retryAfter time.Duration, limit Limit) LimiterResult {
+	return LimiterResult{
+		Allowed:    allowed,
+		Remaining:  remaining,
+		RetryAfter: retryAfter,
+		Reset:      refillDuration(remaining, limit),
+	}
+}
+
+// limiterResultFor returns the state of a bucket with the given tokens without taking a token.
+func limiterResultFor(tokens float64, limit Limit) LimiterResult {
+	var retryAfter time.Duration
+	if tokens < 1 {
+		retryAfter = refillDuration(tokens, Limit{TokenRate: limit.TokenRate, BurstSize: 1})
+	}
+	return newLimiterResult(tokens >= 1, tokens, retryAfter, limit)
+}
+
+// LimiterStore holds the token buckets of the throttling by key, e.g. client ip and username.
+type LimiterStore interface {
+	// Allow takes a token from the bucket of the key if one is left.
+	Allow(key string, limit Limit) LimiterResult
+	// Tokens returns the number of tokens left in the bucket of the key. Unknown keys have a full bucket.
+	Tokens(key string, limit Limit) float64
+	// Reset removes the bucket of the key.
+	Reset(key string)
+	// Cleanup removes all buckets which allow a request again.
+	Cleanup()
+	// Len returns the number of buckets.
+	Len() int
+	// Keys returns the keys of all buckets.
+	Keys() []string
+}
+
+// newLimiterStore creates a shared store for the LimiterBackend of the configuration or an in-memory store otherwise.
+func newLimiterStore(configuration Configuration) LimiterStore {
+	if configuration.LimiterBackend != nil {
+		return NewSharedLimiterStore(configuration.LimiterBackend)
+	}
+
+	maxEntries := configuration.LimiterMaxEntries
+	if maxEntries == 0 {
+		maxEntries = _DefaultLimiterMaxEntries
+	}
+	return NewMemoryLimiterStore(maxEntries)
+}
+
+type memoryLimiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+// memoryLimiterStore keeps the buckets in memory. If it holds maxEntries buckets, the least recently used bucket is
+// dropped for a new one.
+type memoryLimiterStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+// NewMemoryLimiterStore creates a LimiterStore which keeps at most maxEntries buckets in memory.
+func NewMemoryLimiterStore(maxEntries int) LimiterStore {
+	return &memoryLimiterStore{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func (s *memoryLimiterStore) Allow(key string, limit Limit) LimiterResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limiter := s.getOrCreate(key, limit)
+	now := time.Now()
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return newLimiterResult(false, limiter.TokensAt(now), 0, limit)
+	}
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return newLimiterResult(false, limiter.TokensAt(now), delay, limit)
+	}
+
+	return newLimiterResult(true, limiter.TokensAt(now), 0, limit)
+}
+
+func (s *memoryLimiterStore) Tokens(key string, limit Limit) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return float64(limit.BurstSize)
+	}
+	return element.Value.(*memoryLimiterEntry).limiter.Tokens()
+}
+
+func (s *memoryLimiterStore) getOrCreate(key string, limit Limit) *rate.Limiter {
+	if element, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(element)
+		limiter := element.Value.(*memoryLimiterEntry).limiter
+		// the limit changes on reload of the configuration
+		limiter.SetLimit(rate.Limit(limit.TokenRate))
+		limiter.SetBurst(limit.BurstSize)
+		return limiter
+	}
+
+	if s.lru.Len() >= s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryLimiterEntry).key)
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(limit.TokenRate), limit.BurstSize)
+	s.entries[key] = s.lru.PushFront(&memoryLimiterEntry{key: key, limiter: limiter})
+	return limiter
+}
+
+func (s *memoryLimiterStore) Reset(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+	}
+}
+
+func (s *memoryLimiterStore) Cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, element := range s.entries {
+		if element.Value.(*memoryLimiterEntry).limiter.Tokens() >= 1 {
+			s.lru.Remove(element)
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (s *memoryLimiterStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lru.Len()
+}
+
+func (s *memoryLimiterStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// LimiterBucket is the state of a token bucket in a LimiterBackend.
+type LimiterBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// LimiterBackend stores the token buckets of carp replicas which share their throttling state, e.g. in Redis.
+type LimiterBackend interface {
+	// Get returns the bucket of the key. found is false if the key has no bucket.
+	Get(key string) (bucket LimiterBucket, found bool, err error)
+	// CompareAndSwap stores the bucket if the stored bucket of the key still equals old, or if old is nil and the key
+	// has no bucket. The backend may drop the bucket after ttl, when it is full again.
+	CompareAndSwap(key string, old *LimiterBucket, bucket LimiterBucket, ttl time.Duration) (bool, error)
+	// Delete removes the bucket of the key.
+	Delete(key string) error
+	// Len returns the number of buckets.
+	Len() (int, error)
+	// Keys returns the keys of all buckets.
+	Keys() ([]string, error)
+}
+
+// sharedLimiterStore computes the token buckets of all replicas in a LimiterBackend. If the backend fails, requests
+// are allowed, so that an outage of the backend does not stop carp.
+type sharedLimiterStore struct {
+	backend LimiterBackend
+	now     func() time.Time
+}
+
+// NewSharedLimiterStore creates a LimiterStore which keeps its buckets in the given backend.
+func NewSharedLimiterStore(backend LimiterBackend) LimiterStore {
+	return &sharedLimiterStore{backend: backend, now: time.Now}
+}
+
+func (s *sharedLimiterStore) Allow(key string, limit Limit) LimiterResult {
+	for i := 0; i < _SharedLimiterStoreRetries; i++ {
+		old, found, err := s.backend.Get(key)
+		if err != nil {
+			log.Errorf("failed to get throttling bucket %s: %s", key, err.Error())
+			return limiterResultFor(float64(limit.BurstSize), limit)
+		}
+
+		now := s.now()
+		tokens := refilledTokens(old, found, limit, now)
+		if tokens < 1 {
+			return limiterResultFor(tokens, limit)
+		}
+
+		bucket := LimiterBucket{Tokens: tokens - 1, Updated: now}
+		var expected *LimiterBucket
+		if found {
+			expected = &old
+		}
+
+		swapped, err := s.backend.CompareAndSwap(key, expected, bucket, refillDuration(bucket.Tokens, limit))
+		if err != nil {
+			log.Errorf("failed to store throttling bucket %s: %s", key, err.Error())
+			return limiterResultFor(float64(limit.BurstSize), limit)
+		}
+		if swapped {
+			return newLimiterResult(true, bucket.Tokens, 0, limit)
+		}
+	}
+
+	log.Warningf("failed to update throttling bucket %s because of concurrent updates", key)
+	return limiterResultFor(float64(limit.BurstSize), limit)
+}
+
+func (s *sharedLimiterStore) Tokens(key string, limit Limit) float64 {
+	bucket, found, err := s.backend.Get(key)
+	if err != nil {
+		log.Errorf("failed to get throttling bucket %s: %s", key, err.Error())
+		return float64(limit.BurstSize)
+	}
+
+	return refilledTokens(bucket, found, limit, s.now())
+}
+
+func (s *sharedLimiterStore) Reset(key string) {
+	if err := s.backend.Delete(key); err != nil {
+		log.Errorf("failed to delete throttling bucket %s: %s", key, err.Error())
+	}
+}
+
+// Cleanup does nothing; the backend drops full buckets after their ttl.
+func (s *sharedLimiterStore) Cleanup() {
+}
+
+func (s *sharedLimiterStore) Len() int {
+	count, err := s.backend.Len()
+	if err != nil {
+		log.Errorf("failed to count throttling buckets: %s", err.Error())
+		return 0
+	}
+	return count
+}
+
+func (s *sharedLimiterStore) Keys() []string {
+	keys, err := s.backend.Keys()
+	if err != nil {
+		log.Errorf("failed to list throttling buckets: %s", err.Error())
+		return nil
+	}
+	return keys
+}
+
+func refilledTokens(bucket LimiterBucket, found bool, limit Limit, now time.Time) float64 {
+	if !found {
+		return float64(limit.BurstSize)
+	}
+
+	elapsed := now.Sub(bucket.Updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.BurstSize), bucket.Tokens+elapsed*float64(limit.TokenRate))
+}
+
+// refillDuration returns the time until the bucket is full again.
+func refillDuration(tokens float64, limit Limit) time.Duration {
+	if limit.TokenRate <= 0 {
+		return 0
+	}
+	missing := float64(limit.BurstSize) - tokens
+	return time.Duration(math.Ceil(missing / float64(limit.TokenRate) * float64(time.Second)))
+}
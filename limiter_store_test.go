@@ -0,0 +1,208 @@
+package carp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLimiterBackend is an in-process LimiterBackend, shared by the stores of several replicas.
+type fakeLimiterBackend struct {
+	mu       sync.Mutex
+	buckets  map[string]LimiterBucket
+	ttls     map[string]time.Duration
+	conflict int
+	err      error
+}
+
+func newFakeLimiterBackend() *fakeLimiterBackend {
+	return &fakeLimiterBackend{buckets: map[string]LimiterBucket{}, ttls: map[string]time.Duration{}}
+}
+
+func (b *fakeLimiterBackend) Get(key string) (LimiterBucket, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket, found := b.buckets[key]
+	return bucket, found, b.err
+}
+
+func (b *fakeLimiterBackend) CompareAndSwap(key string, old *LimiterBucket, bucket LimiterBucket, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return false, b.err
+	}
+
+	if b.conflict > 0 {
+		// another replica updated the bucket in the meantime
+		b.conflict--
+		return false, nil
+	}
+
+	current, found := b.buckets[key]
+	if (old == nil && found) || (old != nil && (!found || current != *old)) {
+		return false, nil
+	}
+
+	b.buckets[key] = bucket
+	b.ttls[key] = ttl
+	return true, nil
+}
+
+func (b *fakeLimiterBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.buckets, key)
+	return b.err
+}
+
+func (b *fakeLimiterBackend) Len() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.buckets), b.err
+}
+
+func (b *fakeLimiterBackend) Keys() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var keys []string
+	for key := range b.buckets {
+		keys = append(keys, key)
+	}
+	return keys, b.err
+}
+
+func TestMemoryLimiterStore(t *testing.T) {
+	limit := Limit{TokenRate: 1, BurstSize: 2}
+
+	t.Run("should throttle after burst", func(t *testing.T) {
+		store := NewMemoryLimiterStore(10)
+
+		assert.True(t, store.Allow("a", limit).Allowed)
+		assert.True(t, store.Allow("a", limit).Allowed)
+		assert.False(t, store.Allow("a", limit).Allowed)
+		assert.True(t, store.Allow("b", limit).Allowed)
+
+		store.Reset("a")
+		assert.True(t, store.Allow("a", limit).Allowed)
+		assert.Equal(t, 2.0, store.Tokens("unknown", limit))
+	})
+
+	t.Run("should drop least recently used bucket", func(t *testing.T) {
+		store := NewMemoryLimiterStore(2)
+
+		store.Allow("a", limit)
+		store.Allow("b", limit)
+		store.Allow("a", limit)
+		store.Allow("c", limit)
+
+		assert.Equal(t, 2, store.Len())
+		assert.Less(t, store.Tokens("a", limit), 2.0)
+		assert.Equal(t, 2.0, store.Tokens("b", limit))
+		assert.Less(t, store.Tokens("c", limit), 2.0)
+		assert.ElementsMatch(t, []string{"a", "c"}, store.Keys())
+	})
+
+	t.Run("should remove buckets which allow a request on cleanup", func(t *testing.T) {
+		store := NewMemoryLimiterStore(10)
+		store.Allow("a", limit)
+		store.Allow("a", limit)
+		store.Allow("b", limit)
+
+		store.Cleanup()
+
+		assert.Equal(t, []string{"a"}, store.Keys())
+		assert.Less(t, store.Tokens("a", limit), 1.0)
+	})
+}
+
+func TestSharedLimiterStore(t *testing.T) {
+	limit := Limit{TokenRate: 1, BurstSize: 2}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newReplica := func(backend LimiterBackend) *sharedLimiterStore {
+		store := NewSharedLimiterStore(backend).(*sharedLimiterStore)
+		store.now = func() time.Time { return now }
+		return store
+	}
+
+	t.Run("should share buckets between replicas", func(t *testing.T) {
+		backend := newFakeLimiterBackend()
+		replica1 := newReplica(backend)
+		replica2 := newReplica(backend)
+
+		assert.True(t, replica1.Allow("a", limit).Allowed)
+		assert.True(t, replica2.Allow("a", limit).Allowed)
+		assert.False(t, replica1.Allow("a", limit).Allowed)
+		assert.Equal(t, 0.0, replica2.Tokens("a", limit))
+		assert.Equal(t, 2*time.Second, backend.ttls["a"])
+
+		now = now.Add(1500 * time.Millisecond)
+		assert.Equal(t, 1.5, replica2.Tokens("a", limit))
+		assert.True(t, replica2.Allow("a", limit).Allowed)
+		assert.Equal(t, []string{"a"}, replica1.Keys())
+
+		replica1.Reset("a")
+		assert.Equal(t, 0, replica2.Len())
+	})
+
+	t.Run("should retry on concurrent updates", func(t *testing.T) {
+		backend := newFakeLimiterBackend()
+		backend.conflict = 2
+		store := newReplica(backend)
+
+		assert.True(t, store.Allow("a", limit).Allowed)
+		assert.Equal(t, 1.0, store.Tokens("a", limit))
+	})
+
+	t.Run("should allow requests if backend fails", func(t *testing.T) {
+		backend := newFakeLimiterBackend()
+		backend.err = errors.New("connection refused")
+		store := newReplica(backend)
+
+		for i := 0; i < 3; i++ {
+			assert.True(t, store.Allow("a", limit).Allowed)
+		}
+		assert.Equal(t, 0, store.Len())
+	})
+}
+
+func TestThrottlingHandler_ownStore(t *testing.T) {
+	configuration := Configuration{LimiterTokenRate: 1, LimiterBurstSize: 1}
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	handler1 := NewThrottlingHandler(context.TODO(), configuration, target)
+	handler2 := NewThrottlingHandler(context.TODO(), configuration, target)
+
+	request := func(handler http.Handler) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), _ServiceAccountAuthContextKey, true))
+		req.Header.Set(_HttpHeaderXForwardedFor, "10.0.0.1")
+		req.SetBasicAuth("service_account_a_b", "wrong")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, request(handler1))
+	require.Equal(t, http.StatusTooManyRequests, request(handler1))
+	assert.Equal(t, http.StatusUnauthorized, request(handler2))
+}
+
+func TestNewLimiterStore(t *testing.T) {
+	assert.IsType(t, &memoryLimiterStore{}, newLimiterStore(Configuration{}))
+	assert.Equal(t, _DefaultLimiterMaxEntries, newLimiterStore(Configuration{}).(*memoryLimiterStore).maxEntries)
+	assert.IsType(t, &sharedLimiterStore{}, newLimiterStore(Configuration{LimiterBackend: newFakeLimiterBackend()}))
+}
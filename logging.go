@@ -1,24 +1,41 @@
 package carp
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
-	"os"
 )
 
+// LogFormatJson is the value of log-format which selects the structured JSON log backend.
+const LogFormatJson = "json"
+
 var log = logging.MustGetLogger("carp")
 
 func prepareLogger(configuration Configuration) error {
-	backend := logging.NewLogBackend(os.Stderr, "", 0)
-
-	var format = logging.MustStringFormatter(configuration.LoggingFormat)
-	formatter := logging.NewBackendFormatter(backend, format)
+	var backend logging.Backend
+	if configuration.LoggingFormat == LogFormatJson {
+		backend = newJsonLogBackend(os.Stderr)
+	} else {
+		format := logging.DefaultFormatter
+		if configuration.LoggingFormat != "" {
+			format = logging.MustStringFormatter(configuration.LoggingFormat)
+		}
+		backend = logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), format)
+	}
 
 	level, err := convertLogLevel(configuration.LogLevel)
 	if err != nil {
 		return errors.Wrap(err, "could not prepare logger")
 	}
-	backendLeveled := logging.AddModuleLevel(formatter)
+	backendLeveled := logging.AddModuleLevel(backend)
 	backendLeveled.SetLevel(level, "")
 
 	logging.SetBackend(backendLeveled)
@@ -34,3 +51,144 @@ func convertLogLevel(logLevel string) (logging.Level, error) {
 		return logging.LogLevel(logLevel)
 	}
 }
+
+// logFields are the structured fields of a log entry for a request.
+type logFields struct {
+	RequestId string        `json:"request_id,omitempty"`
+	Username  string        `json:"username,omitempty"`
+	ClientIp  string        `json:"client_ip,omitempty"`
+	Path      string        `json:"path,omitempty"`
+	Status    int           `json:"status,omitempty"`
+	Duration  time.Duration `json:"-"`
+}
+
+// logEntry is a log message with structured fields. The text backends render the fields as key=value pairs after
+// the message, the JSON backend renders them as separate fields.
+type logEntry struct {
+	message string
+	fields  logFields
+}
+
+func (e logEntry) String() string {
+	var builder strings.Builder
+	builder.WriteString(e.message)
+
+	appendField := func(key string, value string) {
+		if value != "" {
+			builder.WriteString(" " + key + "=" + value)
+		}
+	}
+
+	appendField("request_id", e.fields.RequestId)
+	appendField("username", e.fields.Username)
+	appendField("client_ip", e.fields.ClientIp)
+	appendField("path", e.fields.Path)
+	if e.fields.Status != 0 {
+		appendField("status", fmt.Sprintf("%d", e.fields.Status))
+	}
+	if e.fields.Duration != 0 {
+		appendField("duration", e.fields.Duration.String())
+	}
+
+	return builder.String()
+}
+
+// requestLogger logs entries with the structured fields of a request.
+type requestLogger struct {
+	fields logFields
+}
+
+// newRequestLogger creates a requestLogger with the fields of the request. The path is taken from the request
+// as it was received, so the logger must be created before the request is rewritten for the target.
+func newRequestLogger(r *http.Request) requestLogger {
+	return requestLogger{fields: logFields{
+		RequestId: requestIdFromRequest(r),
+		ClientIp:  ClientIP(r),
+		Path:      r.URL.Path,
+	}}
+}
+
+func (l requestLogger) withUsername(username string) requestLogger {
+	l.fields.Username = username
+	return l
+}
+
+func (l requestLogger) withStatus(status int) requestLogger {
+	l.fields.Status = status
+	return l
+}
+
+func (l requestLogger) withDuration(duration time.Duration) requestLogger {
+	l.fields.Duration = duration
+	return l
+}
+
+func (l requestLogger) debug(message string) {
+	log.Debugf("%s", logEntry{message: message, fields: l.fields})
+}
+
+func (l requestLogger) info(message string) {
+	log.Infof("%s", logEntry{message: message, fields: l.fields})
+}
+
+func (l requestLogger) error(message string) {
+	log.Errorf("%s", logEntry{message: message, fields: l.fields})
+}
+
+// jsonLogBackend writes every record as one JSON object per line.
+type jsonLogBackend struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newJsonLogBackend(out io.Writer) *jsonLogBackend {
+	return &jsonLogBackend{out: out}
+}
+
+type jsonLogRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Module  string `json:"module"`
+	Message string `json:"message"`
+	logFields
+	DurationMs *float64 `json:"duration,omitempty"`
+}
+
+func (b *jsonLogBackend) Log(level logging.Level, _ int, record *logging.Record) error {
+	jsonRecord := jsonLogRecord{
+		Time:   record.Time.Format(time.RFC3339Nano),
+		Level:  level.String(),
+		Module: record.Module,
+	}
+
+	if entry, ok := recordLogEntry(record); ok {
+		jsonRecord.Message = entry.message
+		jsonRecord.logFields = entry.fields
+		if entry.fields.Duration != 0 {
+			durationMs := milliseconds(entry.fields.Duration)
+			jsonRecord.DurationMs = &durationMs
+		}
+	} else {
+		jsonRecord.Message = record.Message()
+	}
+
+	data, err := json.Marshal(jsonRecord)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log record: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, err = b.out.Write(append(data, '\n'))
+	return err
+}
+
+func recordLogEntry(record *logging.Record) (logEntry, bool) {
+	if len(record.Args) != 1 {
+		return logEntry{}, false
+	}
+
+	entry, ok := record.Args[0].(logEntry)
+	return entry, ok
+}
@@ -0,0 +1,67 @@
+package carp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonLogBackend(t *testing.T) {
+	t.Run("should log request entry with structured fields", func(t *testing.T) {
+		logBuf := new(bytes.Buffer)
+		logging.SetBackend(newJsonLogBackend(logBuf))
+
+		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		r = r.WithContext(context.WithValue(r.Context(), _RequestIdContextKey, "abc-123"))
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set(_HttpHeaderXForwardedFor, "10.0.0.1, 127.0.0.1")
+
+		newRequestLogger(r).withUsername("tricia").withStatus(http.StatusOK).withDuration(1500 * time.Microsecond).info("Forwarding request")
+
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(logBuf.Bytes(), &record))
+		assert.Equal(t, "INFO", record["level"])
+		assert.Equal(t, "carp", record["module"])
+		assert.Equal(t, "Forwarding request", record["message"])
+		assert.Equal(t, "abc-123", record["request_id"])
+		assert.Equal(t, "tricia", record["username"])
+		assert.Equal(t, "10.0.0.1", record["client_ip"])
+		assert.Equal(t, "/foo/bar", record["path"])
+		assert.Equal(t, float64(200), record["status"])
+		assert.Equal(t, 1.5, record["duration"])
+		assert.NotEmpty(t, record["time"])
+	})
+
+	t.Run("should log plain message", func(t *testing.T) {
+		logBuf := new(bytes.Buffer)
+		logging.SetBackend(newJsonLogBackend(logBuf))
+
+		log.Warningf("something %s", "happened")
+
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(logBuf.Bytes(), &record))
+		assert.Equal(t, "WARNING", record["level"])
+		assert.Equal(t, "something happened", record["message"])
+		assert.NotContains(t, record, "username")
+		assert.NotContains(t, record, "duration")
+	})
+}
+
+func TestLogEntry_String(t *testing.T) {
+	entry := logEntry{message: "Throttle request", fields: logFields{
+		Username: "arthur",
+		ClientIp: "10.0.0.1",
+		Path:     "/foo",
+		Status:   http.StatusTooManyRequests,
+	}}
+
+	assert.Equal(t, "Throttle request username=arthur client_ip=10.0.0.1 path=/foo status=429", entry.String())
+}
@@ -0,0 +1,149 @@
+package carp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cloudogu/go-cas"
+)
+
+const _GatewayCookieName = "_carp_gateway"
+
+// LoginRequiredResponse is the JSON body of XHR and fetch requests which require a CAS login.
+type LoginRequiredResponse struct {
+	Status   int    `json:"status"`
+	Message  string `json:"message"`
+	LoginUrl string `json:"loginUrl"`
+}
+
+// IsXhrRequest checks whether the request was sent by a script (XHR or fetch) instead of a top-level navigation of
+// the browser. Such requests can not follow a redirect to the CAS login page.
+func IsXhrRequest(req *http.Request) bool {
+	if strings.EqualFold(req.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+
+	if mode := req.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		// navigations, subresources like images, scripts and stylesheets and websockets follow the redirect
+		return (mode == "cors" || mode == "same-origin") && req.Header.Get("Sec-Fetch-Dest") == "empty"
+	}
+
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// redirectToLogin redirects top-level navigations to the CAS login page. XHR and fetch requests get status code 401
+// with a LoginRequiredResponse instead.
+func redirectToLogin(w http.ResponseWriter, req *http.Request) {
+	if !IsXhrRequest(req) {
+		cas.RedirectToLogin(w, req)
+		return
+	}
+
+	loginUrl, err := casLoginUrl(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	err = json.NewEncoder(w).Encode(LoginRequiredResponse{
+		Status:   http.StatusUnauthorized,
+		Message:  "authentication required",
+		LoginUrl: loginUrl.String(),
+	})
+	if err != nil {
+		log.Errorf("failed to write login required response: %s", err.Error())
+	}
+}
+
+// gatewayAttempted checks whether the browser was already sent to the CAS login in gateway mode, so that an
+// anonymous user is not redirected on every request.
+func gatewayAttempted(req *http.Request) bool {
+	_, err := req.Cookie(_GatewayCookieName)
+	return err == nil
+}
+
+// isGatewayMethod checks whether the request can be redirected through the CAS gateway without losing its body.
+func isGatewayMethod(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// redirectToGatewayLogin redirects the request to the CAS login in gateway mode. CAS redirects back with a ticket if
+// the user has a CAS session and without a ticket otherwise.
+func redirectToGatewayLogin(w http.ResponseWriter, req *http.Request) {
+	loginUrl, err := casLoginUrl(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query := loginUrl.Query()
+	query.Set("gateway", "true")
+	loginUrl.RawQuery = query.Encode()
+
+	// the cookie lives as long as the browser session, so that anonymous users are sent to CAS only once
+	http.SetCookie(w, &http.Cookie{
+		Name:     _GatewayCookieName,
+		Value:    "1",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, loginUrl.String(), http.StatusFound)
+}
+
+// clearGatewayCookie expires the gateway cookie of an authenticated user, so that the next anonymous visit of an
+// optional route checks the CAS session again.
+func clearGatewayCookie(w http.ResponseWriter, req *http.Request) {
+	if !gatewayAttempted(req) {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     _GatewayCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// casLoginUrl returns the CAS login url with the request as service. The url is taken from the redirect of the CAS
+// client, so that the service matches the one of the ticket validation.
+func casLoginUrl(req *http.Request) (*url.URL, error) {
+	location := &locationRecorder{header: http.Header{}}
+	cas.RedirectToLogin(location, req)
+	if location.statusCode != http.StatusFound {
+		return nil, fmt.Errorf("cas: failed to create login url")
+	}
+
+	loginUrl, err := url.Parse(location.header.Get("Location"))
+	if err != nil {
+		return nil, fmt.Errorf("cas: failed to parse login url: %w", err)
+	}
+
+	return loginUrl, nil
+}
+
+// locationRecorder records the redirect of the CAS client.
+type locationRecorder struct {
+	header     http.Header
+	statusCode int
+}
+
+func (l *locationRecorder) Header() http.Header {
+	return l.header
+}
+
+func (l *locationRecorder) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (l *locationRecorder) WriteHeader(statusCode int) {
+	l.statusCode = statusCode
+}
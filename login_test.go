@@ -0,0 +1,97 @@
+package carp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsXhrRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"top-level navigation", map[string]string{"Accept": "text/html,application/xhtml+xml", "Sec-Fetch-Mode": "navigate"}, false},
+		{"old browser navigation", map[string]string{"Accept": "*/*"}, false},
+		{"XMLHttpRequest", map[string]string{"X-Requested-With": "XMLHttpRequest"}, true},
+		{"fetch", map[string]string{"Sec-Fetch-Mode": "cors", "Sec-Fetch-Dest": "empty"}, true},
+		{"same-origin fetch", map[string]string{"Sec-Fetch-Mode": "same-origin", "Sec-Fetch-Dest": "empty"}, true},
+		{"image", map[string]string{"Accept": "image/avif,image/webp,*/*", "Sec-Fetch-Mode": "no-cors", "Sec-Fetch-Dest": "image"}, false},
+		{"script", map[string]string{"Sec-Fetch-Mode": "no-cors", "Sec-Fetch-Dest": "script"}, false},
+		{"module script", map[string]string{"Sec-Fetch-Mode": "cors", "Sec-Fetch-Dest": "script"}, false},
+		{"websocket", map[string]string{"Sec-Fetch-Mode": "websocket", "Sec-Fetch-Dest": "websocket"}, false},
+		{"json", map[string]string{"Accept": "application/json"}, true},
+		{"json and html", map[string]string{"Accept": "text/html, application/json"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			assert.Equal(t, tt.want, IsXhrRequest(r))
+		})
+	}
+}
+
+func TestRedirectToLogin(t *testing.T) {
+	configuration := validTestConfiguration(t)
+	configuration.CasUrl = "https://cas.example.com/cas"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := createHandlersForConfig(ctx, configuration, newHandlerState())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	get := func(headers map[string]string) *http.Response {
+		req, lErr := http.NewRequest(http.MethodGet, server.URL+"/app/api/items", nil)
+		require.NoError(t, lErr)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, lErr := client.Do(req)
+		require.NoError(t, lErr)
+		return resp
+	}
+
+	t.Run("should return 401 with login url for fetch requests", func(t *testing.T) {
+		resp := get(map[string]string{"Sec-Fetch-Mode": "cors", "Sec-Fetch-Dest": "empty", "Accept": "application/json"})
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var body LoginRequiredResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, http.StatusUnauthorized, body.Status)
+		loginUrl, err := url.Parse(body.LoginUrl)
+		require.NoError(t, err)
+		assert.Equal(t, "cas.example.com", loginUrl.Host)
+		assert.Equal(t, "/cas/login", loginUrl.Path)
+		assert.Contains(t, loginUrl.Query().Get("service"), "/app/api/items")
+	})
+
+	t.Run("should redirect top-level navigations", func(t *testing.T) {
+		resp := get(map[string]string{"Sec-Fetch-Mode": "navigate", "Accept": "text/html"})
+		_ = resp.Body.Close()
+
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Location"), "https://cas.example.com/cas/login?service=")
+	})
+}
@@ -1,38 +1,270 @@
 package carp
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 )
 
+// LogoutRule defines requests of users which log out of the target. Matching requests are redirected to the CAS
+// logout.
+type LogoutRule struct {
+	// Method matches requests with the http method, e.g. DELETE
+	Method string `yaml:"method"`
+	// PathRegex matches requests whose path matches the regular expression
+	PathRegex string `yaml:"path-regex"`
+	// Query matches requests with all the query parameters; an empty value matches every value of the parameter
+	Query map[string]string `yaml:"query"`
+	// Service is the url CAS redirects to after the logout. Paths are resolved against the service-url.
+	Service string `yaml:"service"`
+	// Forward sends the request to the target first, so that it can end its session
+	Forward bool `yaml:"forward"`
+	// ExpireCookies are expired with the redirect, e.g. the session cookie of the target or _cas_session
+	ExpireCookies []LogoutCookie `yaml:"expire-cookies"`
+}
+
+type logoutRule struct {
+	method        string
+	pathRegex     *regexp.Regexp
+	query         map[string]string
+	logoutUrl     string
+	forward       bool
+	expireCookies []LogoutCookie
+}
+
 type LogoutRedirectionHandler struct {
-	logoutUrl    string
-	delegate     http.Handler
-	logoutMethod string
-	logoutPath   string
+	delegate http.Handler
+	rules    []logoutRule
+	tickets  *ticketStore
 }
 
+// NewLogoutRedirectionHandler creates a handler which redirects requests matching the logout rules of the
+// configuration to the CAS logout and delegates all other requests. Invalid logout rules are logged and the handler
+// delegates every request; use NewLogoutRedirectionHandlerWithRules to get the error.
 func NewLogoutRedirectionHandler(configuration Configuration, delegateHandler http.Handler) http.Handler {
+	handler, err := NewLogoutRedirectionHandlerWithRules(configuration, delegateHandler)
+	if err != nil {
+		log.Errorf("failed to create logout redirection handler, logout requests are not redirected: %s", err.Error())
+		return &LogoutRedirectionHandler{delegate: delegateHandler}
+	}
+	return handler
+}
+
+// NewLogoutRedirectionHandlerWithRules creates a handler like NewLogoutRedirectionHandler, but returns an error for
+// invalid logout rules.
+func NewLogoutRedirectionHandlerWithRules(configuration Configuration, delegateHandler http.Handler) (http.Handler, error) {
+	return newLogoutRedirectionHandler(configuration, delegateHandler, nil)
+}
+
+// newLogoutRedirectionHandler creates a LogoutRedirectionHandler which also ends the sessions of the ticket store
+// whose session cookie is expired by a rule.
+func newLogoutRedirectionHandler(configuration Configuration, delegateHandler http.Handler, tickets *ticketStore) (http.Handler, error) {
+	rules, err := newLogoutRules(configuration)
+	if err != nil {
+		return nil, err
+	}
+
 	return &LogoutRedirectionHandler{
-		logoutUrl:    configuration.CasUrl + "/logout",
-		delegate:     delegateHandler,
-		logoutMethod: configuration.LogoutMethod,
-		logoutPath:   configuration.LogoutPath,
+		delegate: delegateHandler,
+		rules:    rules,
+		tickets:  tickets,
+	}, nil
+}
+
+// newLogoutRules compiles the logout-rules of the configuration. logout-method and logout-path are the first rule,
+// which matches the path by suffix.
+func newLogoutRules(configuration Configuration) ([]logoutRule, error) {
+	var rules []logoutRule
+
+	if configuration.LogoutMethod != "" || configuration.LogoutPath != "" {
+		rule := LogoutRule{Method: configuration.LogoutMethod}
+		if configuration.LogoutPath != "" {
+			rule.PathRegex = regexp.QuoteMeta(configuration.LogoutPath) + "$"
+		}
+
+		compiled, err := newLogoutRule(configuration, rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logout-path: %w", err)
+		}
+		rules = append(rules, compiled)
+	}
+
+	for i, rule := range configuration.LogoutRules {
+		compiled, err := newLogoutRule(configuration, rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logout-rules[%d]: %w", i, err)
+		}
+		rules = append(rules, compiled)
+	}
+
+	return rules, nil
+}
+
+func newLogoutRule(configuration Configuration, rule LogoutRule) (logoutRule, error) {
+	compiled := logoutRule{
+		method:        rule.Method,
+		query:         rule.Query,
+		logoutUrl:     configuration.CasUrl + "/logout",
+		forward:       rule.Forward,
+		expireCookies: rule.ExpireCookies,
+	}
+
+	if rule.PathRegex != "" {
+		regex, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return logoutRule{}, fmt.Errorf("invalid path-regex: %w", err)
+		}
+		compiled.pathRegex = regex
+	}
+
+	if rule.Service != "" {
+		service, err := resolveLogoutService(configuration.ServiceUrl, rule.Service)
+		if err != nil {
+			return logoutRule{}, err
+		}
+		compiled.logoutUrl += "?" + url.Values{"service": {service}}.Encode()
+	}
+
+	return compiled, nil
+}
+
+func resolveLogoutService(serviceUrl string, service string) (string, error) {
+	parsed, err := url.Parse(service)
+	if err != nil {
+		return "", fmt.Errorf("invalid service: %w", err)
+	}
+
+	if parsed.IsAbs() {
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return "", fmt.Errorf("service must use scheme http or https: %s", service)
+		}
+		return parsed.String(), nil
+	}
+
+	base, err := url.Parse(serviceUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid service-url: %w", err)
+	}
+	return base.ResolveReference(parsed).String(), nil
+}
+
+func (rule logoutRule) matches(r *http.Request) bool {
+	if rule.method != "" && r.Method != rule.method {
+		return false
 	}
+
+	if rule.pathRegex != nil && !rule.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+
+	query := r.URL.Query()
+	for key, value := range rule.query {
+		if !query.Has(key) || (value != "" && query.Get(key) != value) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (h *LogoutRedirectionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.isLogoutRequest(r) {
-		log.Infof("Detected logout request; redirecting to %s", h.logoutUrl)
-		http.Redirect(w, r, h.logoutUrl, http.StatusSeeOther)
+	rule, ok := h.ruleFor(r)
+	if !ok {
+		h.delegate.ServeHTTP(w, r)
+		return
+	}
+
+	logger := newRequestLogger(r)
+
+	if rule.forward {
+		forwarded := &logoutResponseWriter{header: http.Header{}}
+		h.delegate.ServeHTTP(forwarded, r)
+		logger.withStatus(forwarded.statusCode).debug("Forwarded logout request to target")
+
+		// the target may clear its own cookies
+		for _, cookie := range forwarded.header.Values("Set-Cookie") {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+	}
+
+	expireCookies(w, rule.expireCookies)
+	h.endSessionIfExpired(r, rule.expireCookies)
+
+	logger.info("Detected logout request; redirecting to CAS logout")
+	http.Redirect(w, r, rule.logoutUrl, http.StatusSeeOther)
+}
+
+func (h *LogoutRedirectionHandler) ruleFor(r *http.Request) (logoutRule, bool) {
+	for _, rule := range h.rules {
+		if rule.matches(r) {
+			return rule, true
+		}
+	}
+	return logoutRule{}, false
+}
+
+// endSessionIfExpired deletes the ticket of the CAS session, if its session cookie is expired, so that the session
+// can not be used anymore by a copy of the cookie.
+func (h *LogoutRedirectionHandler) endSessionIfExpired(r *http.Request, cookies []LogoutCookie) {
+	if h.tickets == nil {
 		return
 	}
 
-	h.delegate.ServeHTTP(w, r)
+	for _, cookie := range cookies {
+		if cookie.Name != _CasSessionCookieName {
+			continue
+		}
+
+		if session, err := r.Cookie(_CasSessionCookieName); err == nil {
+			h.tickets.invalidateCookie(session.Value)
+		}
+	}
+}
+
+// logoutResponseWriter keeps the headers of the response of the target to a forwarded logout request and discards
+// its body, so that the redirect to the CAS logout can be sent instead.
+type logoutResponseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (w *logoutResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *logoutResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return len(data), nil
 }
 
-func (h *LogoutRedirectionHandler) isLogoutRequest(r *http.Request) bool {
-	return (h.logoutMethod != "" || h.logoutPath != "") &&
-		(h.logoutMethod == "" || r.Method == h.logoutMethod) &&
-		(h.logoutPath == "" || h.logoutPath != "" && strings.HasSuffix(r.URL.Path, h.logoutPath))
+func (w *logoutResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func validateLogoutRules(configuration Configuration) []error {
+	var errs []error
+
+	for i, rule := range configuration.LogoutRules {
+		if rule.Method == "" && rule.PathRegex == "" && len(rule.Query) == 0 {
+			errs = append(errs, fmt.Errorf("logout-rules[%d]: at least one of method, path-regex and query is required", i))
+		}
+
+		if strings.ContainsAny(rule.Method, " \t/") {
+			errs = append(errs, fmt.Errorf("logout-rules[%d]: invalid method: %s", i, rule.Method))
+		}
+
+		if _, err := newLogoutRule(configuration, rule); err != nil {
+			errs = append(errs, fmt.Errorf("logout-rules[%d]: %w", i, err))
+		}
+
+		errs = append(errs, validateLogoutCookies(fmt.Sprintf("logout-rules[%d].expire-cookies", i), rule.ExpireCookies)...)
+	}
+
+	return errs
 }
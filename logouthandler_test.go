@@ -1,11 +1,13 @@
 package carp
 
 import (
+	"github.com/cloudogu/go-cas"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockDelegate struct{}
@@ -91,3 +93,114 @@ func createSut(configuration Configuration, t *testing.T) http.Handler {
 	handler := MockDelegate{}
 	return NewLogoutRedirectionHandler(configuration, handler)
 }
+
+func TestShouldDelegateAllRequestsForInvalidLogoutRule(t *testing.T) {
+	configuration := Configuration{
+		CasUrl:      "/cas",
+		LogoutRules: []LogoutRule{{PathRegex: "("}},
+	}
+	_, err := NewLogoutRedirectionHandlerWithRules(configuration, MockDelegate{})
+	assert.ErrorContains(t, err, "invalid logout-rules[0]")
+
+	redirectionHandler := createSut(configuration, t)
+	recorder := httptest.NewRecorder()
+	redirectionHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/(", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestShouldRedirectForMatchingLogoutRuleWithService(t *testing.T) {
+	configuration := Configuration{
+		CasUrl:     "/cas",
+		ServiceUrl: "https://dogu.example.com/nexus/",
+		LogoutRules: []LogoutRule{
+			{Method: http.MethodPost, PathRegex: "^/nexus/logout$", Service: "https://other.example.com/"},
+			{PathRegex: "^/nexus/session$", Service: "welcome"},
+		},
+	}
+	redirectionHandler := createSut(configuration, t)
+
+	recorder := httptest.NewRecorder()
+	redirectionHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/nexus/logout", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	redirectionHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/nexus/logout", nil))
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.Equal(t, "/cas/logout?service=https%3A%2F%2Fother.example.com%2F", recorder.Header().Get("Location"))
+
+	recorder = httptest.NewRecorder()
+	redirectionHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/nexus/session", nil))
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.Equal(t, "/cas/logout?service=https%3A%2F%2Fdogu.example.com%2Fnexus%2Fwelcome", recorder.Header().Get("Location"))
+}
+
+func TestShouldMatchQueryOfLogoutRule(t *testing.T) {
+	configuration := Configuration{
+		CasUrl:      "/cas",
+		LogoutRules: []LogoutRule{{PathRegex: "^/app$", Query: map[string]string{"action": "logout", "token": ""}}},
+	}
+	redirectionHandler := createSut(configuration, t)
+
+	for target, expected := range map[string]int{
+		"/app?action=logout&token=1": http.StatusSeeOther,
+		"/app?action=logout&token=":  http.StatusSeeOther,
+		"/app?action=logout":         http.StatusOK,
+		"/app?action=login&token=1":  http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		redirectionHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, expected, recorder.Code, target)
+	}
+}
+
+func TestShouldForwardLogoutRequestBeforeRedirect(t *testing.T) {
+	configuration := Configuration{
+		CasUrl: "/cas",
+		LogoutRules: []LogoutRule{{
+			PathRegex:     "^/logout$",
+			Forward:       true,
+			ExpireCookies: []LogoutCookie{{Name: "remember", Path: "/app"}},
+		}},
+	}
+	var forwarded bool
+	delegate := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", MaxAge: -1})
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("logged out"))
+	})
+	redirectionHandler, err := NewLogoutRedirectionHandlerWithRules(configuration, delegate)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	redirectionHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/logout", nil))
+
+	assert.True(t, forwarded)
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.Equal(t, "/cas/logout", recorder.Header().Get("Location"))
+	assert.NotContains(t, recorder.Body.String(), "logged out")
+	assert.Equal(t, []string{"JSESSIONID=; Max-Age=0", "remember=; Path=/app; Max-Age=0"}, recorder.Header().Values("Set-Cookie"))
+}
+
+func TestShouldEndCasSessionWithExpiredSessionCookie(t *testing.T) {
+	configuration := Configuration{
+		CasUrl:      "/cas",
+		LogoutRules: []LogoutRule{{PathRegex: "^/logout$", ExpireCookies: []LogoutCookie{{Name: _CasSessionCookieName}}}},
+	}
+	tickets := newTicketStore(time.Hour)
+	assert.NoError(t, tickets.Write("ST-1", &cas.AuthenticationResponse{User: "tricia"}))
+	tickets.bindSession("ST-1", "session-1")
+	redirectionHandler, err := newLogoutRedirectionHandler(configuration, MockDelegate{}, tickets)
+	assert.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/logout", nil)
+	request.AddCookie(&http.Cookie{Name: _CasSessionCookieName, Value: "session-1"})
+	recorder := httptest.NewRecorder()
+	redirectionHandler.ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+	assert.Equal(t, []string{"_cas_session=; Path=/; Max-Age=0"}, recorder.Header().Values("Set-Cookie"))
+	_, err = tickets.Read("ST-1")
+	assert.ErrorIs(t, err, cas.ErrInvalidTicket)
+}
@@ -0,0 +1,184 @@
+package carp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const _MetricsContextKey = "Metrics"
+
+const (
+	stageDoguRest   = "dogu-rest"
+	stageThrottling = "throttling"
+	stageCas        = "cas"
+	stageProxy      = "proxy"
+)
+
+const (
+	casResultRedirect      = "redirect"
+	casResultAuthenticated = "authenticated"
+	casResultAnonymous     = "anonymous"
+)
+
+// Metrics contains the prometheus metrics of the handler chain.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	stageRequests           *prometheus.CounterVec
+	casRequests             *prometheus.CounterVec
+	serviceAccountBypasses  prometheus.Counter
+	throttledRequests       prometheus.Counter
+	bans                    prometheus.Counter
+	userReplications        prometheus.Counter
+	userReplicationFailures prometheus.Counter
+	upstreamDuration        *prometheus.HistogramVec
+	throttlingClients       func() int
+}
+
+// NewMetrics creates the metrics of the handler chain in a new registry.
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		stageRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "carp_stage_requests_total",
+			Help: "Number of requests which reached a stage of the handler chain.",
+		}, []string{"stage"}),
+		casRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "carp_cas_requests_total",
+			Help: "Number of requests which reached the proxy stage by result of the CAS authentication.",
+		}, []string{"result"}),
+		serviceAccountBypasses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carp_service_account_bypasses_total",
+			Help: "Number of service-account-requests which bypassed the CAS authentication.",
+		}),
+		throttledRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carp_throttled_requests_total",
+			Help: "Number of requests which were rejected by the throttling with status code 429.",
+		}),
+		bans: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carp_throttling_bans_total",
+			Help: "Number of clients which were banned after repeated throttling.",
+		}),
+		userReplications: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carp_user_replications_total",
+			Help: "Number of calls of the UserReplicator.",
+		}),
+		userReplicationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "carp_user_replication_failures_total",
+			Help: "Number of failed calls of the UserReplicator.",
+		}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "carp_upstream_request_duration_seconds",
+			Help:    "Duration of the requests forwarded to the target.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code"}),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.stageRequests,
+		metrics.casRequests,
+		metrics.serviceAccountBypasses,
+		metrics.throttledRequests,
+		metrics.bans,
+		metrics.userReplications,
+		metrics.userReplicationFailures,
+		metrics.upstreamDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "carp_throttling_clients",
+			Help: "Number of clients in the throttling store.",
+		}, func() float64 {
+			if metrics.throttlingClients == nil {
+				return 0
+			}
+			return float64(metrics.throttlingClients())
+		}),
+	)
+
+	return metrics
+}
+
+// NewMetricsHandler creates a handler which answers the metrics endpoint itself, if a metrics-path is configured
+// and no admin-port serves it, and delegates all other requests to the given handler. The metrics are added to the context of the delegated
+// requests, so that the handlers of the chain can record them.
+func NewMetricsHandler(configuration Configuration, metrics *Metrics, handler http.Handler) http.Handler {
+	metricsPath := configuration.MetricsPath
+	if configuration.AdminPort != 0 {
+		// the metrics are served by the admin API, so that they are not exposed on the public port
+		metricsPath = ""
+	}
+	metricsEndpoint := promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if metricsPath != "" && request.URL.Path == metricsPath {
+			metricsEndpoint.ServeHTTP(writer, request)
+			return
+		}
+
+		ctx := context.WithValue(request.Context(), _MetricsContextKey, metrics)
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// metricsFromRequest returns the metrics of the request. The result is nil if the request has no metrics; all
+// methods of Metrics can be called on nil.
+func metricsFromRequest(r *http.Request) *Metrics {
+	metrics, _ := r.Context().Value(_MetricsContextKey).(*Metrics)
+	return metrics
+}
+
+func (m *Metrics) countStage(stage string) {
+	if m == nil {
+		return
+	}
+	m.stageRequests.WithLabelValues(stage).Inc()
+}
+
+func (m *Metrics) countCasResult(result string) {
+	if m == nil {
+		return
+	}
+	m.casRequests.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) countServiceAccountBypass() {
+	if m == nil {
+		return
+	}
+	m.serviceAccountBypasses.Inc()
+}
+
+func (m *Metrics) countThrottledRequest() {
+	if m == nil {
+		return
+	}
+	m.throttledRequests.Inc()
+}
+
+func (m *Metrics) countBan() {
+	if m == nil {
+		return
+	}
+	m.bans.Inc()
+}
+
+func (m *Metrics) countUserReplication(err error) {
+	if m == nil {
+		return
+	}
+	m.userReplications.Inc()
+	if err != nil {
+		m.userReplicationFailures.Inc()
+	}
+}
+
+func (m *Metrics) observeUpstream(statusCode int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.upstreamDuration.WithLabelValues(strconv.Itoa(statusCode)).Observe(duration.Seconds())
+}
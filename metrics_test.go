@@ -0,0 +1,139 @@
+package carp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	scrape := func(t *testing.T, server *httptest.Server) string {
+		resp, err := server.Client().Get(server.URL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("should expose metrics of the handler chain", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer backend.Close()
+
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		configuration.ServiceAccountNameRegex = "^service_account_.*$"
+		configuration.LimiterTokenRate = 1
+		configuration.LimiterBurstSize = 1
+		configuration.MetricsPath = "/metrics"
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := createHandlersForConfig(ctx, configuration, newHandlerState())
+		require.NoError(t, err)
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		for i := 0; i < 2; i++ {
+			req, lErr := http.NewRequest(http.MethodGet, server.URL+"/foo", nil)
+			require.NoError(t, lErr)
+			req.SetBasicAuth("service_account_foo", "wrong")
+			req.Header.Set(_HttpHeaderXForwardedFor, "metricsIP")
+			resp, lErr := server.Client().Do(req)
+			require.NoError(t, lErr)
+			_ = resp.Body.Close()
+		}
+
+		body := scrape(t, server)
+
+		assert.Contains(t, body, `carp_stage_requests_total{stage="dogu-rest"} 2`)
+		assert.Contains(t, body, `carp_stage_requests_total{stage="throttling"} 2`)
+		assert.Contains(t, body, `carp_stage_requests_total{stage="cas"} 1`)
+		assert.Contains(t, body, `carp_stage_requests_total{stage="proxy"} 1`)
+		assert.Contains(t, body, `carp_service_account_bypasses_total 1`)
+		assert.Contains(t, body, `carp_throttled_requests_total 1`)
+		assert.Contains(t, body, `carp_cas_requests_total{result="anonymous"} 1`)
+		assert.Contains(t, body, `carp_upstream_request_duration_seconds_count{code="401"} 1`)
+		assert.Contains(t, body, `carp_throttling_clients 1`)
+	})
+
+	t.Run("should count user replications", func(t *testing.T) {
+		metrics := NewMetrics()
+		handler := NewMetricsHandler(Configuration{MetricsPath: "/metrics"}, metrics, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			metricsFromRequest(r).countUserReplication(nil)
+			metricsFromRequest(r).countUserReplication(assert.AnError)
+		}))
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		resp, err := server.Client().Get(server.URL + "/foo")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		body := scrape(t, server)
+
+		assert.Contains(t, body, "carp_user_replications_total 2")
+		assert.Contains(t, body, "carp_user_replication_failures_total 1")
+	})
+
+	t.Run("should use configured metrics path", func(t *testing.T) {
+		delegated := false
+		handler := NewMetricsHandler(Configuration{MetricsPath: "/carp/metrics"}, NewMetrics(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delegated = true
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/carp/metrics", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "carp_throttling_clients")
+		assert.False(t, delegated)
+	})
+
+	t.Run("should delegate metrics path with admin-port", func(t *testing.T) {
+		delegated := false
+		handler := NewMetricsHandler(Configuration{MetricsPath: "/metrics", AdminPort: 8081}, NewMetrics(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delegated = true
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		assert.True(t, delegated)
+	})
+
+	t.Run("should delegate metrics path without configured metrics path", func(t *testing.T) {
+		delegated := false
+		handler := NewMetricsHandler(Configuration{}, NewMetrics(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delegated = true
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		assert.True(t, delegated)
+		assert.NotContains(t, w.Body.String(), "carp_throttling_clients")
+	})
+
+	t.Run("should ignore missing metrics in request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+
+		assert.NotPanics(t, func() {
+			metricsFromRequest(r).countStage(stageProxy)
+			metricsFromRequest(r).countThrottledRequest()
+		})
+	})
+}
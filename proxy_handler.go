@@ -1,20 +1,25 @@
 package carp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
+	"time"
 
-	"github.com/cloudogu/go-cas"
 	"github.com/vulcand/oxy/forward"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ProxyHandler struct {
-	target *url.URL
-	fwd    *forward.Forwarder
-	config Configuration
+	target          *url.URL
+	fwd             *forward.Forwarder
+	config          Configuration
+	assertionSigner *identityAssertionSigner
+	accessRules     *accessRules
+	authRoutes      *authRoutes
+	classifier      RequestClassifier
 }
 
 func NewProxyHandler(configuration Configuration) (*ProxyHandler, error) {
@@ -28,42 +33,127 @@ func NewProxyHandler(configuration Configuration) (*ProxyHandler, error) {
 		return nil, errors.Join(fmt.Errorf("failed to create forward: %w", err))
 	}
 
+	assertionSigner, err := newIdentityAssertionSigner(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity assertion signer: %w", err)
+	}
+
+	rules, err := newAccessRules(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := newAuthRoutes(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	classifier, err := newRequestClassifier(configuration)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ProxyHandler{
-		config: configuration,
-		target: target,
-		fwd:    fwd,
+		config:          configuration,
+		target:          target,
+		fwd:             fwd,
+		assertionSigner: assertionSigner,
+		accessRules:     rules,
+		authRoutes:      routes,
+		classifier:      classifier,
 	}, nil
 }
 
 func (ph *ProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if cas.IsAuthenticated(req) {
+	metricsFromRequest(req).countStage(stageProxy)
+	stripAttributeHeaders(req.Header, ph.config.AttributeHeaders)
+	if ph.assertionSigner != nil {
+		req.Header.Del(ph.assertionSigner.header)
+	}
+
+	policy := ph.authRoutes.policyFor(req)
+	if policy == AuthPolicyPublic {
+		newRequestLogger(req).debug("Forwarding request to public route")
+		ph.handleAnonymousRequest(w, req)
+		return
+	}
+
+	if casIsAuthenticated(req) {
 		ph.handleAuthenticatedBrowserRequest(w, req)
 		return
 	}
 
-	log.Debugf("Found unauthenticated request %s...", req.URL.String())
+	newRequestLogger(req).debug("Found unauthenticated request")
+
+	if policy == AuthPolicyOptional {
+		ph.handleOptionalRequest(w, req)
+		return
+	}
+
+	if !isBrowserRequest(ph.classifier, req) && !IsServiceAccountAuthentication(req) && ph.accessRules.restricts(req) {
+		ph.handleRestrictedRestRequest(w, req)
+		return
+	}
+
+	if ph.config.ForwardUnauthenticatedRESTRequests && !isBrowserRequest(ph.classifier, req) {
+		ph.handleAnonymousRequest(w, req)
+		return
+	}
 
-	if ph.config.ForwardUnauthenticatedRESTRequests && !IsBrowserRequest(req) {
-		ph.handleRestRequest(w, req)
+	if policy == authPolicyResource && isBrowserRequest(ph.classifier, req) {
+		ph.handleResourceRequest(w, req)
 		return
 	}
 
 	ph.handleUnauthenticatedBrowserRequest(w, req)
 }
 
+// handleOptionalRequest sends top-level GET navigations of browsers once to the CAS login in gateway mode, so that users with a CAS session are
+// forwarded with their identity. All other requests are forwarded anonymously; requests with a body would lose it.
+func (ph *ProxyHandler) handleOptionalRequest(w http.ResponseWriter, req *http.Request) {
+	if isGatewayMethod(req) && isBrowserRequest(ph.classifier, req) && !IsXhrRequest(req) && !gatewayAttempted(req) {
+		newRequestLogger(req).debug("Redirect request of optional route to CAS gateway")
+		metricsFromRequest(req).countCasResult(casResultRedirect)
+		redirectToGatewayLogin(w, req)
+		return
+	}
+
+	ph.handleAnonymousRequest(w, req)
+}
+
 func (ph *ProxyHandler) handleAuthenticatedBrowserRequest(w http.ResponseWriter, req *http.Request) {
-	log.Debugf("Found CAS-authenticated request %s...", req.URL.String())
+	username := casUsername(req)
+	requestInfoFromRequest(req).setUsername(username)
+	logger := newRequestLogger(req).withUsername(username)
+	logger.debug("Found CAS-authenticated request")
 
-	username := cas.Username(req)
-	if cas.IsFirstAuthenticatedRequest(req) {
+	if casIsFirstAuthenticatedRequest(req) {
 		if err := ph.replicateUser(req, username); err != nil {
-			log.Error(err.Error())
+			logger.error(err.Error())
 		}
 	}
+
+	if !ph.accessRules.isAllowed(req, UserAttibutes(casAttributes(req))) {
+		logger.withStatus(http.StatusForbidden).info("Access denied by access-rules")
+		ph.accessRules.writeAccessDenied(w, req)
+		return
+	}
 	req.Header.Set(ph.config.PrincipalHeader, username)
+	setAttributeHeaders(req.Header, ph.config.AttributeHeaders, UserAttibutes(casAttributes(req)))
+	if ph.assertionSigner != nil {
+		assertion, err := ph.assertionSigner.sign(username, UserAttibutes(casAttributes(req)), time.Now())
+		if err != nil {
+			logger.error(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		req.Header.Set(ph.assertionSigner.header, assertion)
+	}
+	clearGatewayCookie(w, req)
 	req.URL = ph.target
-	log.Infof("Forwarding request %s for user %s...", req.URL.String(), username)
-	ph.fwd.ServeHTTP(w, req)
+	logger.info("Forwarding request")
+	metricsFromRequest(req).countCasResult(casResultAuthenticated)
+	ph.forward(w, req, logger)
 }
 
 func (ph *ProxyHandler) replicateUser(req *http.Request, username string) error {
@@ -71,8 +161,13 @@ func (ph *ProxyHandler) replicateUser(req *http.Request, username string) error
 		return nil
 	}
 
-	attributes := cas.Attributes(req)
+	_, span := startSpan(req.Context(), spanNameUserReplication)
+	defer span.End()
+
+	attributes := casAttributes(req)
 	err := ph.config.UserReplicator(username, UserAttibutes(attributes))
+	metricsFromRequest(req).countUserReplication(err)
+	endSpanWithStatus(span, 0, err)
 	if err != nil {
 		return fmt.Errorf("failed to replicate user: %w", err)
 	}
@@ -81,43 +176,96 @@ func (ph *ProxyHandler) replicateUser(req *http.Request, username string) error
 }
 
 func (ph *ProxyHandler) handleUnauthenticatedBrowserRequest(w http.ResponseWriter, req *http.Request) {
-	resourcePath := ph.config.ResourcePath
-	baseUrl := ph.config.BaseUrl
-	isResourceRequestWithoutAuth := IsBrowserRequest(req) && resourcePath != "" && baseUrl != "" && isRequestToResource(req, resourcePath)
-	if isResourceRequestWithoutAuth {
-		response, err := http.Get(baseUrl + req.URL.String())
-		if err != nil {
-			log.Errorf("failed to request resource to test for status code: %s", err.Error())
-		}
+	// redirect the not-authenticated-browser-request to the CAS login page
+	newRequestLogger(req).info("Redirect request to CAS")
+	metricsFromRequest(req).countCasResult(casResultRedirect)
+	redirectToLogin(w, req)
+}
 
-		if response.StatusCode >= 400 {
-			// resource is unavailable
-			// redirect not authenticated browser request to cas login page
-			log.Debugf("Redirect resource-request %s to CAS...", req.URL.String())
-			cas.RedirectToLogin(w, req)
-			return
-		}
+// handleRestrictedRestRequest rejects REST requests without CAS authentication to paths of access-rules, which are
+// otherwise forwarded anonymously with forward-unauthenticated-rest-requests.
+func (ph *ProxyHandler) handleRestrictedRestRequest(w http.ResponseWriter, req *http.Request) {
+	newRequestLogger(req).withStatus(http.StatusUnauthorized).info("Reject unauthenticated request to path of access-rules")
+	w.Header().Set("WWW-Authenticate", `Basic realm="CAS Protected Area"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// handleResourceRequest delivers resources of the resource-path anonymously, if the target delivers them without
+// authentication, and redirects to the CAS login otherwise.
+func (ph *ProxyHandler) handleResourceRequest(w http.ResponseWriter, req *http.Request) {
+	logger := newRequestLogger(req)
+	statusCode, err := probeResource(req.Context(), ph.config.BaseUrl+req.URL.String())
+	if err != nil {
+		logger.error(fmt.Sprintf("failed to request resource to test for status code: %s", err.Error()))
+	}
 
-		log.Infof("Delivering resource %s on anonymous request...", req.URL.String())
-		req.URL = ph.target
-		ph.fwd.ServeHTTP(w, req)
+	if err != nil || statusCode >= 400 {
+		// resource is unavailable
+		// redirect not authenticated browser request to cas login page
+		logger.debug("Redirect resource-request to CAS")
+		metricsFromRequest(req).countCasResult(casResultRedirect)
+		redirectToLogin(w, req)
 		return
 	}
 
-	// redirect the not-authenticated-browser-request to the CAS login page
-	log.Infof("Redirect request %s to CAS...", req.URL.String())
-	cas.RedirectToLogin(w, req)
-	return
+	logger.info("Delivering resource on anonymous request")
+	req.URL = ph.target
+	metricsFromRequest(req).countCasResult(casResultAnonymous)
+	ph.forward(w, req, logger)
 }
 
-// forwards REST request for potential local user authentication
+// forwards the request without identity, e.g. a REST request for potential local user authentication
 // remove rut auth header to prevent unwanted access if set
-func (ph *ProxyHandler) handleRestRequest(w http.ResponseWriter, req *http.Request) {
+func (ph *ProxyHandler) handleAnonymousRequest(w http.ResponseWriter, req *http.Request) {
+	logger := newRequestLogger(req)
 	req.Header.Del(ph.config.PrincipalHeader)
 	req.URL = ph.target
-	ph.fwd.ServeHTTP(w, req)
+	metricsFromRequest(req).countCasResult(casResultAnonymous)
+	ph.forward(w, req, logger)
+}
+
+// forward forwards the request to the target and records the duration of the upstream request
+func (ph *ProxyHandler) forward(w http.ResponseWriter, req *http.Request, logger requestLogger) {
+	statusWriter := &statusResponseWriter{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+	}
+
+	ctx, span := startSpan(req.Context(), spanNameUpstream, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	req = req.WithContext(ctx)
+	injectTraceContext(ctx, req)
+
+	start := time.Now()
+	ph.fwd.ServeHTTP(statusWriter, req)
+	duration := time.Since(start)
+	endSpanWithStatus(span, statusWriter.statusCode, nil)
+
+	metricsFromRequest(req).observeUpstream(statusWriter.statusCode, duration)
+	requestInfoFromRequest(req).setUpstreamDuration(duration)
+	logger.withStatus(statusWriter.statusCode).withDuration(duration).debug("Forwarded request to target")
 }
 
-func isRequestToResource(req *http.Request, resourcePath string) bool {
-	return strings.Contains(req.URL.Path, resourcePath)
+// probeResource requests the resource anonymously to test whether it is available without authentication and
+// returns the status code of the response
+func probeResource(ctx context.Context, resourceUrl string) (int, error) {
+	ctx, span := startSpan(ctx, spanNameResourceProbe, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	probe, err := http.NewRequestWithContext(ctx, http.MethodGet, resourceUrl, nil)
+	if err != nil {
+		endSpanWithStatus(span, 0, err)
+		return 0, err
+	}
+	injectTraceContext(ctx, probe)
+
+	response, err := http.DefaultClient.Do(probe)
+	if err != nil {
+		endSpanWithStatus(span, 0, err)
+		return 0, err
+	}
+	defer response.Body.Close()
+	endSpanWithStatus(span, response.StatusCode, nil)
+
+	return response.StatusCode, nil
 }
@@ -2,6 +2,7 @@ package carp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/op/go-logging"
 	"github.com/stretchr/testify/assert"
@@ -65,6 +66,34 @@ func TestProxyHandler_ServeHTTP(t *testing.T) {
 		assert.Equal(t, 312, w.Code)
 	})
 
+	t.Run("should reject unauthenticated rest request to path of access-rules", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(312)
+		}))
+		defer srv.Close()
+
+		ph, err := NewProxyHandler(Configuration{
+			ForwardUnauthenticatedRESTRequests: true,
+			Target:                             srv.URL,
+			AccessRules:                        []AccessRule{{PathPrefix: "/foo/", Groups: []string{"admins"}}},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		ph.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo/bar", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `Basic realm="CAS Protected Area"`, w.Header().Get("WWW-Authenticate"))
+
+		w = httptest.NewRecorder()
+		ph.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+		assert.Equal(t, 312, w.Code)
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		ph.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), _ServiceAccountAuthContextKey, true)))
+		assert.Equal(t, 312, w.Code)
+	})
+
 	t.Run("should handle unauthenticated browser-request", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
@@ -104,7 +133,7 @@ func TestProxyHandler_ServeHTTP(t *testing.T) {
 		ph.ServeHTTP(w, r)
 
 		assert.Equal(t, 204, w.Code)
-		assert.Contains(t, logBuf.String(), "Delivering resource /foo/bar on anonymous request...")
+		assert.Contains(t, logBuf.String(), "Delivering resource on anonymous request client_ip=192.0.2.1 path=/foo/bar")
 	})
 
 	t.Run("should handle unauthenticated browser-request with redirect to login", func(t *testing.T) {
@@ -135,7 +164,33 @@ func TestProxyHandler_ServeHTTP(t *testing.T) {
 
 		// 500 because there is no cas-client, but for this test it is ok
 		assert.Equal(t, 500, w.Code)
-		assert.Contains(t, logBuf.String(), "Redirect resource-request /foo/bar to CAS...")
+		assert.Contains(t, logBuf.String(), "Redirect resource-request to CAS client_ip=192.0.2.1 path=/foo/bar")
+	})
+
+	t.Run("should redirect unauthenticated browser-request to login for unreachable resource", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		r.Header.Set("User-Agent", "mozilla")
+
+		logBuf := new(bytes.Buffer)
+		logging.SetBackend(logging.NewLogBackend(logBuf, "", 0))
+
+		unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		unreachable.Close()
+
+		ph, err := NewProxyHandler(Configuration{
+			Target:       unreachable.URL,
+			ResourcePath: "/foo/bar",
+			BaseUrl:      unreachable.URL + "/test",
+		})
+		require.NoError(t, err)
+
+		require.NotPanics(t, func() { ph.ServeHTTP(w, r) })
+
+		// 500 because there is no cas-client, but for this test it is ok
+		assert.Equal(t, 500, w.Code)
+		assert.Contains(t, logBuf.String(), "failed to request resource to test for status code")
+		assert.Contains(t, logBuf.String(), "Redirect resource-request to CAS client_ip=192.0.2.1 path=/foo/bar")
 	})
 
 	t.Run("should handle unauthenticated non-browser-request with redirect to login", func(t *testing.T) {
@@ -165,7 +220,7 @@ func TestProxyHandler_ServeHTTP(t *testing.T) {
 
 		// 500 because there is no cas-client, but for this test it is ok
 		assert.Equal(t, 500, w.Code)
-		assert.Contains(t, logBuf.String(), "Redirect request /foo/bar to CAS...")
+		assert.Contains(t, logBuf.String(), "Redirect request to CAS client_ip=192.0.2.1 path=/foo/bar")
 	})
 }
 
@@ -249,4 +304,22 @@ func TestProxyHandler_handleAuthenticatedBrowserRequest(t *testing.T) {
 		assert.Equal(t, 200, w.Code)
 		assert.Contains(t, logBuf.String(), "Forwarding request")
 	})
+
+	t.Run("should clear gateway cookie of authenticated browser-request", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+		defer srv.Close()
+
+		ph, err := NewProxyHandler(Configuration{PrincipalHeader: "MyUserHeader", Target: srv.URL})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+		r.AddCookie(&http.Cookie{Name: _GatewayCookieName, Value: "1"})
+		ph.handleAuthenticatedBrowserRequest(w, r)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Header().Values("Set-Cookie"), "_carp_gateway=; Path=/; Max-Age=0; HttpOnly; SameSite=Lax")
+	})
 }
@@ -0,0 +1,66 @@
+package carp
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	_HttpHeaderRetryAfter         = "Retry-After"
+	_HttpHeaderRateLimitLimit     = "RateLimit-Limit"
+	_HttpHeaderRateLimitRemaining = "RateLimit-Remaining"
+	_HttpHeaderRateLimitReset     = "RateLimit-Reset"
+)
+
+// ThrottledResponse is the JSON body of throttled requests if limiter-json-response is set.
+type ThrottledResponse struct {
+	Status     int    `json:"status"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+// setRateLimitHeaders sets the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the IETF draft
+// "RateLimit header fields for HTTP". Reset is the number of seconds until the bucket is full again.
+func setRateLimitHeaders(header http.Header, result LimiterResult, limit Limit) {
+	remaining := int(math.Floor(result.Remaining))
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	header.Set(_HttpHeaderRateLimitLimit, strconv.Itoa(limit.BurstSize))
+	header.Set(_HttpHeaderRateLimitRemaining, strconv.Itoa(remaining))
+	header.Set(_HttpHeaderRateLimitReset, strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+// writeThrottled answers a throttled request with status code 429 and the number of seconds until the next token is
+// available in the Retry-After header.
+func writeThrottled(w http.ResponseWriter, result LimiterResult, jsonResponse bool) {
+	retryAfter := ceilSeconds(result.RetryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set(_HttpHeaderRetryAfter, strconv.Itoa(retryAfter))
+
+	if !jsonResponse {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	err := json.NewEncoder(w).Encode(ThrottledResponse{
+		Status:     http.StatusTooManyRequests,
+		Message:    "too many requests",
+		RetryAfter: retryAfter,
+	})
+	if err != nil {
+		log.Errorf("failed to write throttled response: %s", err.Error())
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,79 @@
+package carp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottlingHandler_rateLimitHeaders(t *testing.T) {
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	request := func(handler http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), _ServiceAccountAuthContextKey, true))
+		req.SetBasicAuth("service_account_a_b", "wrong")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("should set rate limit headers and Retry-After", func(t *testing.T) {
+		handler := NewThrottlingHandler(context.TODO(), Configuration{LimiterTokenRate: 1, LimiterBurstSize: 2}, target)
+
+		first := request(handler)
+		assert.Equal(t, http.StatusUnauthorized, first.Code)
+		assert.Equal(t, "2", first.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "1", first.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "1", first.Header().Get("RateLimit-Reset"))
+		assert.Empty(t, first.Header().Get("Retry-After"))
+
+		request(handler)
+		throttled := request(handler)
+		assert.Equal(t, http.StatusTooManyRequests, throttled.Code)
+		assert.Equal(t, "0", throttled.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "2", throttled.Header().Get("RateLimit-Reset"))
+		assert.Equal(t, "1", throttled.Header().Get("Retry-After"))
+		assert.Equal(t, "Too Many Requests\n", throttled.Body.String())
+	})
+
+	t.Run("should write json body", func(t *testing.T) {
+		handler := NewThrottlingHandler(context.TODO(), Configuration{LimiterTokenRate: 1, LimiterBurstSize: 1, LimiterJsonResponse: true}, target)
+
+		request(handler)
+		throttled := request(handler)
+
+		assert.Equal(t, http.StatusTooManyRequests, throttled.Code)
+		assert.Equal(t, "application/json", throttled.Header().Get("Content-Type"))
+		var body ThrottledResponse
+		require.NoError(t, json.Unmarshal(throttled.Body.Bytes(), &body))
+		assert.Equal(t, ThrottledResponse{Status: http.StatusTooManyRequests, Message: "too many requests", RetryAfter: 1}, body)
+	})
+}
+
+func TestMemoryLimiterStore_retryAfter(t *testing.T) {
+	store := NewMemoryLimiterStore(10)
+	limit := Limit{TokenRate: 2, BurstSize: 1}
+
+	require.True(t, store.Allow("a", limit).Allowed)
+	result := store.Allow("a", limit)
+
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 500*time.Millisecond, result.RetryAfter, float64(10*time.Millisecond))
+	assert.InDelta(t, 500*time.Millisecond, result.Reset, float64(10*time.Millisecond))
+}
+
+func TestLimiterResultFor(t *testing.T) {
+	limit := Limit{TokenRate: 2, BurstSize: 4}
+
+	assert.Equal(t, LimiterResult{Allowed: false, Remaining: 0.5, RetryAfter: 250 * time.Millisecond, Reset: 1750 * time.Millisecond}, limiterResultFor(0.5, limit))
+	assert.Equal(t, LimiterResult{Allowed: true, Remaining: 4}, limiterResultFor(4, limit))
+}
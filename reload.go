@@ -0,0 +1,167 @@
+package carp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reload validates the given configuration, builds a new handler chain for it and swaps it in atomically.
+// Authenticated CAS sessions and throttling state are kept. If the configuration is invalid, the current
+// configuration stays active. The returned keys name changed configuration values which can not be applied
+// without a restart.
+func (s *Server) Reload(configuration Configuration) ([]string, error) {
+	if err := configuration.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if s.shuttingDown {
+		return nil, errors.New("server is shutting down")
+	}
+
+	current := s.chain.Load()
+
+	chain, err := s.buildHandlerChain(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create handlers for configuration: %w", err)
+	}
+
+	s.chain.Store(chain)
+	current.cancel()
+	s.state.removeUnusedCasClients(configuration)
+
+	restartRequired := restartRequiredChanges(current.configuration, configuration)
+	for _, key := range restartRequired {
+		log.Warningf("Changed configuration value %s requires a restart to take effect", key)
+	}
+
+	log.Info("Reloaded configuration")
+
+	return restartRequired, nil
+}
+
+// ReloadConfiguration reads the configuration file and the environment again and reloads the server with the result.
+// Values which can not be set in the configuration file (e.g. the UserReplicator) are taken over from the current
+// configuration.
+func (s *Server) ReloadConfiguration() ([]string, error) {
+	configuration, sources, err := readConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+
+	current := s.chain.Load().configuration
+	configuration.UserReplicator = current.UserReplicator
+	configuration.ResponseModifier = current.ResponseModifier
+	configuration.RequestClassifier = current.RequestClassifier
+	configuration.LimiterBackend = current.LimiterBackend
+
+	restartRequired, err := s.Reload(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = prepareLogger(configuration); err != nil {
+		log.Errorf("failed to prepare logger for reloaded configuration: %s", err.Error())
+	}
+	logEffectiveConfiguration(configuration, sources)
+
+	return restartRequired, nil
+}
+
+// Configuration returns the currently active configuration.
+func (s *Server) Configuration() Configuration {
+	return s.chain.Load().configuration
+}
+
+func restartRequiredChanges(current Configuration, reloaded Configuration) []string {
+	var keys []string
+
+	if current.Port != reloaded.Port {
+		keys = append(keys, "port")
+	}
+
+	if current.ConfigReloadInterval != reloaded.ConfigReloadInterval {
+		keys = append(keys, "config-reload-interval")
+	}
+
+	if current.ConfigReloadOnSighup != reloaded.ConfigReloadOnSighup {
+		keys = append(keys, "config-reload-on-sighup")
+	}
+
+	if current.LimiterMaxEntries != reloaded.LimiterMaxEntries {
+		keys = append(keys, "limiter-max-entries")
+	}
+
+	if current.LimiterBanSnapshotFile != reloaded.LimiterBanSnapshotFile {
+		keys = append(keys, "limiter-ban-snapshot-file")
+	}
+
+	if current.CasSessionLifetime != reloaded.CasSessionLifetime {
+		keys = append(keys, "cas-session-lifetime")
+	}
+
+	if current.AdminPort != reloaded.AdminPort {
+		keys = append(keys, "admin-port")
+	}
+
+	return keys
+}
+
+// watchConfiguration reloads the configuration when the process receives SIGHUP or the configuration file changes.
+func (s *Server) watchConfiguration(ctx context.Context, configuration Configuration, path string, lastModified time.Time) {
+	signals := make(chan os.Signal, 1)
+	if configuration.ConfigReloadOnSighup {
+		log.Info("Reload configuration on SIGHUP")
+		signal.Notify(signals, syscall.SIGHUP)
+		defer signal.Stop(signals)
+	}
+
+	var fileChanges <-chan time.Time
+	if configuration.ConfigReloadInterval > 0 {
+		log.Infof("Watch configuration file %s for changes every %d seconds", path, configuration.ConfigReloadInterval)
+		ticker := time.NewTicker(time.Duration(configuration.ConfigReloadInterval) * time.Second)
+		defer ticker.Stop()
+		fileChanges = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("Context done - stop configuration watcher")
+			return
+		case <-signals:
+			log.Info("Received SIGHUP - reload configuration")
+			s.reloadConfigurationAndLog()
+		case <-fileChanges:
+			modified := fileModificationTime(path)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+
+			log.Infof("Configuration file %s changed - reload configuration", path)
+			s.reloadConfigurationAndLog()
+		}
+	}
+}
+
+func (s *Server) reloadConfigurationAndLog() {
+	if _, err := s.ReloadConfiguration(); err != nil {
+		log.Errorf("Rejected configuration reload, keeping current configuration: %s", err.Error())
+	}
+}
+
+func fileModificationTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
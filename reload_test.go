@@ -0,0 +1,215 @@
+package carp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Reload(t *testing.T) {
+	newBackend := func(t *testing.T, statusCode int) *httptest.Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(statusCode)
+		}))
+		t.Cleanup(backend.Close)
+		return backend
+	}
+
+	serveRequest := func(srv *Server) int {
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+		return w.Code
+	}
+
+	t.Run("should swap handler chain", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		configuration.Target = newBackend(t, http.StatusCreated).URL
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+		require.Equal(t, http.StatusCreated, serveRequest(srv))
+
+		configuration.Target = newBackend(t, http.StatusAccepted).URL
+		restartRequired, err := srv.Reload(configuration)
+
+		require.NoError(t, err)
+		assert.Empty(t, restartRequired)
+		assert.Equal(t, http.StatusAccepted, serveRequest(srv))
+		assert.Equal(t, configuration.Target, srv.Configuration().Target)
+	})
+
+	t.Run("should keep current configuration for invalid reload", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		configuration.Target = newBackend(t, http.StatusCreated).URL
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+
+		invalid := configuration
+		invalid.Target = ""
+		_, err = srv.Reload(invalid)
+
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "invalid configuration: target-url is required")
+		assert.Equal(t, http.StatusCreated, serveRequest(srv))
+		assert.Equal(t, configuration.Target, srv.Configuration().Target)
+	})
+
+	t.Run("should report changes which require a restart", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+
+		configuration.Port++
+		restartRequired, err := srv.Reload(configuration)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"port"}, restartRequired)
+	})
+
+	t.Run("should keep cas clients with sessions", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+
+		clients := srv.state.casClients[newCasClientKey(configuration)]
+		require.NotNil(t, clients)
+
+		configuration.PrincipalHeader = "X-Other-Header"
+		_, err = srv.Reload(configuration)
+		require.NoError(t, err)
+
+		assert.Same(t, clients, srv.state.casClients[newCasClientKey(configuration)])
+	})
+
+	t.Run("should replace cas clients for changed cas configuration", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+
+		configuration.CasUrl = "https://other.example.com/cas"
+		_, err = srv.Reload(configuration)
+		require.NoError(t, err)
+
+		assert.Len(t, srv.state.casClients, 1)
+		assert.NotNil(t, srv.state.casClients[newCasClientKey(configuration)])
+	})
+
+	t.Run("should keep access log output for requests of replaced chain", func(t *testing.T) {
+		logFile := filepath.Join(t.TempDir(), "access.log")
+		configuration := validTestConfiguration(t)
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		configuration.Target = newBackend(t, http.StatusCreated).URL
+		configuration.AccessLogFormat = "{{.RequestUri}} {{.Status}}"
+		configuration.AccessLogOutput = AccessLogOutputFile
+		configuration.AccessLogFile = logFile
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+		replaced := srv.chain.Load().handler
+
+		configuration.PrincipalHeader = "X-Other-Header"
+		_, err = srv.Reload(configuration)
+		require.NoError(t, err)
+
+		replaced.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/replaced", nil))
+		srv.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/current", nil))
+
+		data, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		assert.Equal(t, "/replaced 201\n/current 201\n", string(data))
+		assert.Len(t, srv.state.accessLogOutputs, 1)
+	})
+
+	t.Run("should reject reload after shutdown", func(t *testing.T) {
+		configuration := validTestConfiguration(t)
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		require.NoError(t, srv.Shutdown(context.Background()))
+
+		_, err = srv.Reload(configuration)
+
+		require.ErrorContains(t, err, "server is shutting down")
+	})
+}
+
+func TestServer_ReloadConfiguration(t *testing.T) {
+	writeConfig := func(t *testing.T, path string, port int, principalHeader string) {
+		content := fmt.Sprintf(`cas-url: https://cas.example.com/cas
+service-url: https://dogu.example.com/dogu
+target-url: http://localhost:8080
+principal-header: %s
+port: %d
+config-reload-interval: 1
+`, principalHeader, port)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+
+	t.Run("should reload configuration on file change", func(t *testing.T) {
+		confPath := filepath.Join(t.TempDir(), "carp.yml")
+		oldArgs := os.Args
+		os.Args = []string{"carp", confPath}
+		defer func() { os.Args = oldArgs }()
+
+		configuration := validTestConfiguration(t)
+		writeConfig(t, confPath, configuration.Port, "X-First")
+		configuration, _, err := readConfiguration()
+		require.NoError(t, err)
+		replicator := func(username string, attributes UserAttibutes) error { return nil }
+		configuration.UserReplicator = replicator
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		require.NoError(t, srv.Start(context.Background()))
+		defer srv.Shutdown(context.Background())
+
+		writeConfig(t, confPath, configuration.Port, "X-Second")
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(confPath, future, future))
+
+		assert.Eventually(t, func() bool {
+			return srv.Configuration().PrincipalHeader == "X-Second"
+		}, 5*time.Second, 100*time.Millisecond)
+		assert.NotNil(t, srv.Configuration().UserReplicator)
+	})
+
+	t.Run("should reject invalid configuration file", func(t *testing.T) {
+		confPath := filepath.Join(t.TempDir(), "carp.yml")
+		oldArgs := os.Args
+		os.Args = []string{"carp", confPath}
+		defer func() { os.Args = oldArgs }()
+
+		configuration := validTestConfiguration(t)
+		writeConfig(t, confPath, 0, "X-First")
+
+		srv, err := NewServer(configuration)
+		require.NoError(t, err)
+		defer srv.Shutdown(context.Background())
+
+		_, err = srv.ReloadConfiguration()
+
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "port must be between 1 and 65535: 0")
+		assert.Equal(t, configuration.PrincipalHeader, srv.Configuration().PrincipalHeader)
+	})
+}
@@ -0,0 +1,151 @@
+package carp
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// RequestClass decides whether a request is authenticated by the CAS browser flow or the CAS REST flow.
+type RequestClass string
+
+const (
+	RequestClassBrowser RequestClass = "browser"
+	RequestClassRest    RequestClass = "rest"
+)
+
+// RequestClassifier classifies requests as browser or REST requests. A custom implementation can be set in the
+// Configuration; otherwise the rule-based classifier of the request-classification-rules is used.
+type RequestClassifier interface {
+	Classify(r *http.Request) RequestClass
+}
+
+// RequestClassificationRule classifies the requests which match all of its conditions. Empty conditions match
+// every request.
+type RequestClassificationRule struct {
+	UserAgentRegex string `yaml:"user-agent-regex"`
+	AcceptRegex    string `yaml:"accept-regex"`
+	PathPrefix     string `yaml:"path-prefix"`
+	PathRegex      string `yaml:"path-regex"`
+	// Authorization matches requests with (true) or without (false) an Authorization header
+	Authorization *bool        `yaml:"authorization"`
+	Class         RequestClass `yaml:"class"`
+}
+
+type requestClassificationRule struct {
+	RequestClassificationRule
+	userAgentRegex *regexp.Regexp
+	acceptRegex    *regexp.Regexp
+	pattern        pathPattern
+}
+
+type ruleBasedRequestClassifier struct {
+	rules []requestClassificationRule
+}
+
+// NewRuleBasedRequestClassifier creates a classifier which classifies a request by the first matching rule. Requests
+// which match no rule are browser requests if their User-Agent contains "mozilla" or "opera".
+func NewRuleBasedRequestClassifier(rules []RequestClassificationRule) (RequestClassifier, error) {
+	classifier := &ruleBasedRequestClassifier{}
+
+	for i, rule := range rules {
+		compiled := requestClassificationRule{RequestClassificationRule: rule}
+
+		var err error
+		if compiled.userAgentRegex, err = compileOptionalRegex(rule.UserAgentRegex); err != nil {
+			return nil, fmt.Errorf("invalid user-agent-regex of request-classification-rules[%d]: %w", i, err)
+		}
+		if compiled.acceptRegex, err = compileOptionalRegex(rule.AcceptRegex); err != nil {
+			return nil, fmt.Errorf("invalid accept-regex of request-classification-rules[%d]: %w", i, err)
+		}
+		if compiled.pattern, err = newPathPattern(rule.PathPrefix, rule.PathRegex); err != nil {
+			return nil, fmt.Errorf("invalid request-classification-rules[%d]: %w", i, err)
+		}
+
+		classifier.rules = append(classifier.rules, compiled)
+	}
+
+	return classifier, nil
+}
+
+func compileOptionalRegex(rawRegex string) (*regexp.Regexp, error) {
+	if rawRegex == "" {
+		return nil, nil
+	}
+	return regexp.Compile(rawRegex)
+}
+
+func (c *ruleBasedRequestClassifier) Classify(r *http.Request) RequestClass {
+	for _, rule := range c.rules {
+		if rule.matches(r) {
+			return rule.Class
+		}
+	}
+
+	return userAgentRequestClassifier{}.Classify(r)
+}
+
+func (rule requestClassificationRule) matches(r *http.Request) bool {
+	if rule.userAgentRegex != nil && !rule.userAgentRegex.MatchString(r.UserAgent()) {
+		return false
+	}
+
+	if rule.acceptRegex != nil && !rule.acceptRegex.MatchString(r.Header.Get("Accept")) {
+		return false
+	}
+
+	if !rule.pattern.matches(r.URL.Path) {
+		return false
+	}
+
+	if rule.Authorization != nil && *rule.Authorization != (r.Header.Get("Authorization") != "") {
+		return false
+	}
+
+	return true
+}
+
+// userAgentRequestClassifier classifies requests whose User-Agent contains "mozilla" or "opera" as browser requests.
+type userAgentRequestClassifier struct{}
+
+func (userAgentRequestClassifier) Classify(r *http.Request) RequestClass {
+	if isBrowserUserAgent(r.Header.Get("User-Agent")) {
+		return RequestClassBrowser
+	}
+	return RequestClassRest
+}
+
+// newRequestClassifier returns the RequestClassifier of the configuration or the rule-based classifier of the
+// request-classification-rules.
+func newRequestClassifier(configuration Configuration) (RequestClassifier, error) {
+	if configuration.RequestClassifier != nil {
+		return configuration.RequestClassifier, nil
+	}
+
+	return NewRuleBasedRequestClassifier(configuration.RequestClassificationRules)
+}
+
+// isBrowserRequest checks whether the classifier classifies the request as browser request. CAS single logout
+// requests are always handled by the browser flow.
+func isBrowserRequest(classifier RequestClassifier, r *http.Request) bool {
+	return classifier.Classify(r) == RequestClassBrowser || isSingleLogoutRequest(r)
+}
+
+func validateRequestClassificationRules(configuration Configuration) []error {
+	var errs []error
+
+	for i, rule := range configuration.RequestClassificationRules {
+		if rule.Class != RequestClassBrowser && rule.Class != RequestClassRest {
+			errs = append(errs, fmt.Errorf("request-classification-rules[%d]: class must be browser or rest: %s", i, rule.Class))
+		}
+		if rule.PathPrefix != "" && rule.PathRegex != "" {
+			errs = append(errs, fmt.Errorf("request-classification-rules[%d]: only one of path-prefix and path-regex must be set", i))
+		}
+	}
+
+	if _, err := NewRuleBasedRequestClassifier(configuration.RequestClassificationRules); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
@@ -0,0 +1,84 @@
+package carp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleBasedRequestClassifier_Classify(t *testing.T) {
+	withAuthorization := true
+	classifier, err := NewRuleBasedRequestClassifier([]RequestClassificationRule{
+		{UserAgentRegex: "(?i)electron", Class: RequestClassRest},
+		{PathPrefix: "/nexus/service/", Authorization: &withAuthorization, Class: RequestClassRest},
+		{AcceptRegex: "text/html", Class: RequestClassBrowser},
+	})
+	require.NoError(t, err)
+
+	classify := func(path string, headers map[string]string) RequestClass {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return classifier.Classify(req)
+	}
+
+	assert.Equal(t, RequestClassRest, classify("/", map[string]string{"User-Agent": "Mozilla/5.0 Electron/30.0"}))
+	assert.Equal(t, RequestClassRest, classify("/nexus/service/rest", map[string]string{"User-Agent": "Mozilla/5.0", "Authorization": "Basic dTpw"}))
+	assert.Equal(t, RequestClassBrowser, classify("/nexus/service/rest", map[string]string{"User-Agent": "Mozilla/5.0"}))
+	assert.Equal(t, RequestClassBrowser, classify("/", map[string]string{"User-Agent": "curl/8.0", "Accept": "text/html"}))
+	// requests which match no rule are classified by their user agent
+	assert.Equal(t, RequestClassBrowser, classify("/", map[string]string{"User-Agent": "Opera/9.80"}))
+	assert.Equal(t, RequestClassRest, classify("/", map[string]string{"User-Agent": "curl/8.0"}))
+}
+
+func TestNewRuleBasedRequestClassifier_invalidRegex(t *testing.T) {
+	_, err := NewRuleBasedRequestClassifier([]RequestClassificationRule{{AcceptRegex: "(", Class: RequestClassRest}})
+
+	assert.ErrorContains(t, err, "invalid accept-regex of request-classification-rules[0]")
+}
+
+type staticRequestClassifier RequestClass
+
+func (c staticRequestClassifier) Classify(*http.Request) RequestClass {
+	return RequestClass(c)
+}
+
+func TestCasRequestHandler_usesRequestClassifier(t *testing.T) {
+	req := httptest.NewRequest(http.MethodDelete, "/x", nil)
+
+	recorder := httptest.NewRecorder()
+	requestHandler, err := NewCasRequestHandler(Configuration{
+		LogoutMethod:      http.MethodDelete,
+		CasUrl:            "/cas",
+		RequestClassifier: staticRequestClassifier(RequestClassBrowser),
+	}, MockDelegate{})
+	require.NoError(t, err)
+
+	requestHandler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusSeeOther, recorder.Code)
+}
+
+func TestNewDoguRestHandler_usesRequestClassifier(t *testing.T) {
+	serviceAccountAuth := true
+	handler, err := NewDoguRestHandler(Configuration{
+		ServiceAccountNameRegex:            "^service_account_",
+		ForwardUnauthenticatedRESTRequests: true,
+		RequestClassifier:                  staticRequestClassifier(RequestClassBrowser),
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceAccountAuth = IsServiceAccountAuthentication(r)
+	}))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.SetBasicAuth("service_account_a_b", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the classifier makes the request a browser request which never bypasses CAS
+	assert.False(t, serviceAccountAuth)
+}
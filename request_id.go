@@ -0,0 +1,67 @@
+package carp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const _DefaultRequestIdHeader = "X-Request-ID"
+
+const _RequestIdContextKey = "RequestId"
+
+// _MaxRequestIdLength limits the length of accepted request ids, longer ids are replaced by a generated one.
+const _MaxRequestIdLength = 128
+
+// NewRequestIdHandler creates a handler which accepts the request id of the incoming request or generates a new one.
+// The request id is added to the context, set on the request so that it is forwarded to the target and echoed in
+// the response.
+func NewRequestIdHandler(configuration Configuration, handler http.Handler) http.Handler {
+	header := valueOrDefault(configuration.RequestIdHeader, _DefaultRequestIdHeader)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestId := request.Header.Get(header)
+		if !isValidRequestId(requestId) {
+			requestId = generateRequestId()
+		}
+
+		request.Header.Set(header, requestId)
+		writer.Header().Set(header, requestId)
+		requestInfoFromRequest(request).setRequestId(requestId)
+
+		ctx := context.WithValue(request.Context(), _RequestIdContextKey, requestId)
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// requestIdFromRequest returns the request id of the request or an empty string if the request has none.
+func requestIdFromRequest(r *http.Request) string {
+	requestId, _ := r.Context().Value(_RequestIdContextKey).(string)
+	return requestId
+}
+
+// isValidRequestId accepts only printable ASCII characters without spaces, so that a request id cannot break
+// log lines or headers.
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > _MaxRequestIdLength {
+		return false
+	}
+
+	for i := 0; i < len(requestId); i++ {
+		if requestId[i] <= ' ' || requestId[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func generateRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Errorf("failed to generate request id: %s", err.Error())
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
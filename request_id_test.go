@@ -0,0 +1,161 @@
+package carp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIdHandler(t *testing.T) {
+	serve := func(configuration Configuration, r *http.Request) (*httptest.ResponseRecorder, *http.Request) {
+		var delegated *http.Request
+		handler := NewRequestIdHandler(configuration, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delegated = r
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w, delegated
+	}
+
+	t.Run("should accept incoming request id", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		r.Header.Set("X-Request-ID", "abc-123")
+
+		w, delegated := serve(Configuration{}, r)
+
+		assert.Equal(t, "abc-123", requestIdFromRequest(delegated))
+		assert.Equal(t, "abc-123", delegated.Header.Get("X-Request-ID"))
+		assert.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("should generate request id", func(t *testing.T) {
+		w, delegated := serve(Configuration{}, httptest.NewRequest(http.MethodGet, "/foo", nil))
+
+		requestId := requestIdFromRequest(delegated)
+		assert.Len(t, requestId, 32)
+		assert.Equal(t, requestId, delegated.Header.Get("X-Request-ID"))
+		assert.Equal(t, requestId, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("should replace invalid request id", func(t *testing.T) {
+		for _, requestId := range []string{"abc 123", "abc\x00", strings.Repeat("a", 129)} {
+			r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			r.Header.Set("X-Request-ID", requestId)
+
+			_, delegated := serve(Configuration{}, r)
+
+			assert.Len(t, requestIdFromRequest(delegated), 32)
+		}
+	})
+
+	t.Run("should use configured header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+		r.Header.Set("X-Correlation-ID", "abc-123")
+
+		w, delegated := serve(Configuration{RequestIdHeader: "X-Correlation-ID"}, r)
+
+		assert.Equal(t, "abc-123", requestIdFromRequest(delegated))
+		assert.Equal(t, "abc-123", w.Header().Get("X-Correlation-ID"))
+		assert.Empty(t, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("should propagate request id to target and cas", func(t *testing.T) {
+		var mu sync.Mutex
+		var targetRequestId, casRequestId, casRestRequestId string
+
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			targetRequestId = r.Header.Get("X-Request-ID")
+		}))
+		defer backend.Close()
+
+		casServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.HasSuffix(r.URL.Path, "/serviceValidate") {
+				casRequestId = r.Header.Get("X-Request-ID")
+			}
+			if strings.HasSuffix(r.URL.Path, "/v1/tickets") {
+				casRestRequestId = r.Header.Get("X-Request-ID")
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer casServer.Close()
+
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.CasUrl = casServer.URL + "/cas"
+		configuration.ForwardUnauthenticatedRESTRequests = true
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handler, err := createHandlersForConfig(ctx, configuration, newHandlerState())
+		require.NoError(t, err)
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		client := server.Client()
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/foo", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Request-ID", "rest-request")
+		req.SetBasicAuth("alice", "secret")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		req, err = http.NewRequest(http.MethodGet, server.URL+"/foo?ticket=ST-1", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Request-ID", "browser-request")
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, "rest-request", targetRequestId)
+		assert.Equal(t, "rest-request", casRestRequestId)
+		assert.Equal(t, "browser-request", casRequestId)
+		assert.Equal(t, "browser-request", resp.Header.Get("X-Request-ID"))
+	})
+}
+
+func TestCasTicketTransport(t *testing.T) {
+	t.Run("should add request id only to requests of tracked tickets", func(t *testing.T) {
+		var received []string
+		casServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = append(received, r.Header.Get("X-Request-ID"))
+		}))
+		defer casServer.Close()
+
+		transport := &casTicketTransport{base: http.DefaultTransport}
+		client := &http.Client{Transport: transport}
+
+		ctx := context.WithValue(context.Background(), _RequestIdContextKey, "abc-123")
+		untrack := transport.trackTicket(ctx, "ST-1", "X-Request-ID")
+		for _, ticket := range []string{"ST-1", "ST-2"} {
+			resp, err := client.Get(casServer.URL + "/p3/serviceValidate?ticket=" + ticket)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+		}
+		untrack()
+		resp, err := client.Get(casServer.URL + "/p3/serviceValidate?ticket=ST-1")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		assert.Equal(t, []string{"abc-123", "", ""}, received)
+	})
+}
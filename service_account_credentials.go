@@ -0,0 +1,244 @@
+package carp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const _ServiceAccountRejectedContextKey = "ServiceAccountRejected"
+
+// _CredentialsCheckInterval is the minimum interval between two checks of the credentials file for changes.
+const _CredentialsCheckInterval = time.Second
+
+const (
+	_CredentialsCacheDuration        = 10 * time.Second
+	_CredentialsCacheCleanupInterval = time.Minute
+)
+
+// _UnknownUserBcryptHash is compared against the password of unknown users, so that unknown and known users can not
+// be told apart by the response time.
+const _UnknownUserBcryptHash = "$2a$10$Uyx6YoBsnqeQwEjw7pqys.jBU3mV2oy6TpRVn0ig160slPob2v0S6"
+
+// isServiceAccountRejected reports whether the dogu rest handler rejected the service account credentials of the
+// request.
+func isServiceAccountRejected(r *http.Request) bool {
+	rejected, _ := r.Context().Value(_ServiceAccountRejectedContextKey).(bool)
+	return rejected
+}
+
+func writeServiceAccountCredentialsRejected(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="carp"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// serviceAccountCredentials verifies passwords of service accounts against an htpasswd-style file with bcrypt or
+// argon2 hashes. The file is read again when it changes. Successful verifications are cached by credentials for 10
+// seconds, so that bursts of requests do not compute a password hash each.
+type serviceAccountCredentials struct {
+	path     string
+	verified *cache.Cache
+
+	mu          sync.Mutex
+	hashes      map[string]string
+	modified    time.Time
+	lastChecked time.Time
+}
+
+func newServiceAccountCredentials(configuration Configuration) (*serviceAccountCredentials, error) {
+	if configuration.ServiceAccountCredentialsFile == "" {
+		return nil, nil
+	}
+
+	credentials := &serviceAccountCredentials{
+		path:     configuration.ServiceAccountCredentialsFile,
+		verified: cache.New(_CredentialsCacheDuration, _CredentialsCacheCleanupInterval),
+	}
+	if err := credentials.load(); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (c *serviceAccountCredentials) load() error {
+	modified := fileModificationTime(c.path)
+
+	hashes, err := readCredentialsFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	c.hashes = hashes
+	c.modified = modified
+
+	return nil
+}
+
+// readCredentialsFile reads and parses the credentials file without verifying any hashes.
+func readCredentialsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service-account-credentials-file %s: %w", path, err)
+	}
+
+	hashes, err := parseCredentials(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service-account-credentials-file %s: %w", path, err)
+	}
+
+	return hashes, nil
+}
+
+// reloadIfChanged reads the file again if its modification time changed. If the changed file is invalid, the
+// current credentials are kept.
+func (c *serviceAccountCredentials) reloadIfChanged(now time.Time) {
+	if now.Sub(c.lastChecked) < _CredentialsCheckInterval {
+		return
+	}
+	c.lastChecked = now
+
+	if fileModificationTime(c.path).Equal(c.modified) {
+		return
+	}
+
+	if err := c.load(); err != nil {
+		log.Errorf("Rejected reload of service account credentials, keeping current credentials: %s", err.Error())
+		return
+	}
+
+	// passwords of the previous file must be verified again
+	c.verified.Flush()
+	log.Infof("Reloaded service account credentials from %s", c.path)
+}
+
+// verify checks the password of the user. Without a credentials file every password is accepted and checked by the
+// target.
+func (c *serviceAccountCredentials) verify(username string, password string) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	c.reloadIfChanged(time.Now())
+	hash, ok := c.hashes[username]
+	c.mu.Unlock()
+
+	key := credentialsKey(username, password)
+	if _, found := c.verified.Get(key); found {
+		return true
+	}
+
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(_UnknownUserBcryptHash), []byte(password))
+		return false
+	}
+
+	if !verifyPasswordHash(hash, password) {
+		return false
+	}
+
+	c.verified.SetDefault(key, true)
+	return true
+}
+
+// parseCredentials parses lines of the form username:hash. Empty lines and lines starting with # are ignored.
+func parseCredentials(data []byte) (map[string]string, error) {
+	hashes := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, found := strings.Cut(line, ":")
+		if !found || username == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", lineNumber)
+		}
+
+		if !isBcryptHash(hash) && !isArgon2Hash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash of user %s, only bcrypt and argon2 are supported", lineNumber, username)
+		}
+
+		hashes[username] = hash
+	}
+
+	return hashes, scanner.Err()
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func isArgon2Hash(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$") || strings.HasPrefix(hash, "$argon2i$")
+}
+
+func verifyPasswordHash(hash string, password string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	matches, err := verifyArgon2Hash(hash, password)
+	if err != nil {
+		log.Errorf("failed to verify argon2 hash: %s", err.Error())
+		return false
+	}
+	return matches
+}
+
+// verifyArgon2Hash verifies a hash in the encoding of the reference implementation, e.g.
+// $argon2id$v=19$m=65536,t=3,p=4$c2FsdA$aGFzaA
+func verifyArgon2Hash(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, errors.New("invalid argon2 hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("invalid argon2 version: %w", err)
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 key: %w", err)
+	}
+
+	var derived []byte
+	if parts[1] == "argon2id" {
+		derived = argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	} else {
+		derived = argon2.Key([]byte(password), salt, iterations, memory, parallelism, uint32(len(key)))
+	}
+
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
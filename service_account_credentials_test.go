@@ -0,0 +1,185 @@
+package carp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func writeCredentialsFile(t *testing.T, path string, content string, modified time.Time) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	require.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+func TestServiceAccountCredentials_verify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := fmt.Sprintf("# service accounts\nservice_account_a_b:%s\n\nservice_account_c_d:%s\n",
+		bcryptHash(t, "bcrypt-secret"), argon2idHash("argon2-secret"))
+	writeCredentialsFile(t, path, content, time.Now().Add(-time.Hour))
+
+	credentials, err := newServiceAccountCredentials(Configuration{ServiceAccountCredentialsFile: path})
+	require.NoError(t, err)
+
+	assert.True(t, credentials.verify("service_account_a_b", "bcrypt-secret"))
+	assert.False(t, credentials.verify("service_account_a_b", "wrong"))
+	assert.True(t, credentials.verify("service_account_c_d", "argon2-secret"))
+	assert.False(t, credentials.verify("service_account_c_d", "wrong"))
+	assert.False(t, credentials.verify("service_account_unknown", "bcrypt-secret"))
+
+	var noCredentials *serviceAccountCredentials
+	assert.True(t, noCredentials.verify("service_account_a_b", "anything"))
+}
+
+func TestServiceAccountCredentials_reloadOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeCredentialsFile(t, path, "service_account_a_b:"+bcryptHash(t, "old"), time.Now().Add(-time.Hour))
+
+	credentials, err := newServiceAccountCredentials(Configuration{ServiceAccountCredentialsFile: path})
+	require.NoError(t, err)
+	require.True(t, credentials.verify("service_account_a_b", "old"))
+
+	writeCredentialsFile(t, path, "service_account_a_b:"+bcryptHash(t, "new"), time.Now().Add(-time.Minute))
+	credentials.lastChecked = time.Time{}
+
+	assert.True(t, credentials.verify("service_account_a_b", "new"))
+	assert.False(t, credentials.verify("service_account_a_b", "old"))
+
+	// invalid files are rejected and the current credentials are kept
+	writeCredentialsFile(t, path, "service_account_a_b:plain", time.Now())
+	credentials.lastChecked = time.Time{}
+
+	assert.True(t, credentials.verify("service_account_a_b", "new"))
+}
+
+func TestParseCredentials(t *testing.T) {
+	_, err := parseCredentials([]byte("service_account_a_b:$apr1$abc$def"))
+	assert.ErrorContains(t, err, "line 1: unsupported hash of user service_account_a_b")
+
+	_, err = parseCredentials([]byte("# comment\nservice_account_a_b"))
+	assert.ErrorContains(t, err, "line 2: expected username:hash")
+}
+
+func TestServiceAccountCredentials_handlerChain(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeCredentialsFile(t, path, "service_account_a_b:"+bcryptHash(t, "secret"), time.Now().Add(-time.Hour))
+
+	configuration := Configuration{
+		ServiceAccountNameRegex:            "^service_account_",
+		ServiceAccountCredentialsFile:      path,
+		ForwardUnauthenticatedRESTRequests: true,
+		LimiterTokenRate:                   1,
+		LimiterBurstSize:                   2,
+	}
+
+	var forwarded int
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+	})
+	handler, err := NewDoguRestHandler(configuration, NewThrottlingHandler(context.TODO(), configuration, target))
+	require.NoError(t, err)
+
+	request := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+		req.Header.Set(_HttpHeaderXForwardedFor, "10.0.0.1")
+		req.SetBasicAuth("service_account_a_b", password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, request("secret").Code)
+	assert.Equal(t, 1, forwarded)
+
+	rejected := request("wrong")
+	assert.Equal(t, http.StatusUnauthorized, rejected.Code)
+	assert.Equal(t, `Basic realm="carp"`, rejected.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, request("wrong").Code)
+	// failed attempts use up the tokens of the client
+	assert.Equal(t, http.StatusTooManyRequests, request("wrong").Code)
+	assert.Equal(t, 1, forwarded)
+}
+
+func TestServiceAccountCredentials_verifyBeforeBypass(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeCredentialsFile(t, path, "service_account_a_b:"+bcryptHash(t, "secret"), time.Now().Add(-time.Hour))
+
+	configuration := Configuration{
+		ServiceAccountNameRegex:            "^service_account_",
+		ServiceAccountCredentialsFile:      path,
+		ForwardUnauthenticatedRESTRequests: true,
+	}
+
+	var bypassed, rejected bool
+	handler, err := NewDoguRestHandler(configuration, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bypassed = IsServiceAccountAuthentication(r)
+		rejected = isServiceAccountRejected(r)
+	}))
+	require.NoError(t, err)
+
+	request := func(password string) {
+		req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+		req.SetBasicAuth("service_account_a_b", password)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	t.Run("should bypass CAS for valid credentials without throttling handler", func(t *testing.T) {
+		request("secret")
+
+		assert.True(t, bypassed)
+		assert.False(t, rejected)
+	})
+
+	t.Run("should not bypass CAS for wrong password without throttling handler", func(t *testing.T) {
+		request("wrong")
+
+		assert.False(t, bypassed)
+		assert.True(t, rejected)
+	})
+}
+
+func TestServiceAccountCredentials_cache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeCredentialsFile(t, path, "service_account_a_b:"+bcryptHash(t, "old"), time.Now().Add(-time.Hour))
+	credentials, err := newServiceAccountCredentials(Configuration{ServiceAccountCredentialsFile: path})
+	require.NoError(t, err)
+
+	require.True(t, credentials.verify("service_account_a_b", "old"))
+	require.False(t, credentials.verify("service_account_a_b", "wrong"))
+
+	_, found := credentials.verified.Get(credentialsKey("service_account_a_b", "old"))
+	assert.True(t, found)
+	_, found = credentials.verified.Get(credentialsKey("service_account_a_b", "wrong"))
+	assert.False(t, found, "rejected credentials are not cached")
+
+	// a changed file drops the cached verifications
+	writeCredentialsFile(t, path, "service_account_a_b:"+bcryptHash(t, "new"), time.Now().Add(-time.Minute))
+	credentials.lastChecked = time.Time{}
+
+	assert.False(t, credentials.verify("service_account_a_b", "old"))
+	assert.True(t, credentials.verify("service_account_a_b", "new"))
+}
@@ -0,0 +1,243 @@
+package carp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudogu/go-cas"
+)
+
+// Session is an authenticated CAS browser session.
+type Session struct {
+	// Id identifies the session without revealing its service ticket.
+	Id                 string    `json:"id"`
+	Username           string    `json:"username"`
+	AuthenticationDate time.Time `json:"authenticationDate"`
+}
+
+// _LoggedOutSessionTtl is the time a session which was ended by a single logout is remembered, so that the
+// backend cookies of its browser are cleared on its next request.
+const _LoggedOutSessionTtl = 24 * time.Hour
+
+// _DefaultCasSessionLifetime is the default lifetime of a CAS session in seconds, the default maximum lifetime of a
+// ticket granting ticket in CAS.
+const _DefaultCasSessionLifetime = 28800
+
+// _TicketPruneInterval is the minimum interval between two removals of expired tickets.
+const _TicketPruneInterval = time.Minute
+
+// ticketStore is the cas.TicketStore of the browser client. Every session of the client refers to a validated
+// service ticket in the store, so the store lists the sessions and invalidates them by deleting their ticket.
+// It also maps the tickets to the session cookies of the browsers, which the CAS client keeps to itself. Tickets
+// expire after the lifetime of the CAS session, counted from their authentication date.
+type ticketStore struct {
+	mu         sync.RWMutex
+	tickets    map[string]*cas.AuthenticationResponse
+	expires    map[string]time.Time
+	cookies    map[string]string
+	loggedOut  map[string]time.Time
+	lifetime   time.Duration
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+func newTicketStore(lifetime time.Duration) *ticketStore {
+	return &ticketStore{
+		tickets:   map[string]*cas.AuthenticationResponse{},
+		expires:   map[string]time.Time{},
+		cookies:   map[string]string{},
+		loggedOut: map[string]time.Time{},
+		lifetime:  lifetime,
+		now:       time.Now,
+	}
+}
+
+func (s *ticketStore) Read(id string) (*cas.AuthenticationResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ticket, ok := s.tickets[id]
+	if !ok || s.isExpired(id, s.now()) {
+		return nil, cas.ErrInvalidTicket
+	}
+	return ticket, nil
+}
+
+// Write stores the ticket and removes expired tickets, at most once per _TicketPruneInterval.
+func (s *ticketStore) Write(id string, ticket *cas.AuthenticationResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	authenticated := ticket.AuthenticationDate
+	if authenticated.IsZero() {
+		// CAS 2 does not send the authentication date
+		authenticated = now
+	}
+
+	s.tickets[id] = ticket
+	s.expires[id] = authenticated.Add(s.lifetime)
+
+	if now.Sub(s.lastPruned) >= _TicketPruneInterval {
+		s.lastPruned = now
+		for expiredId := range s.tickets {
+			if s.isExpired(expiredId, now) {
+				s.deleteTicket(expiredId)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ticketStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteTicket(id)
+	return nil
+}
+
+func (s *ticketStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tickets = map[string]*cas.AuthenticationResponse{}
+	s.expires = map[string]time.Time{}
+	s.cookies = map[string]string{}
+	return nil
+}
+
+// isExpired reports whether the CAS session of the ticket is older than the lifetime. The caller must hold the lock.
+func (s *ticketStore) isExpired(id string, now time.Time) bool {
+	return now.After(s.expires[id])
+}
+
+// deleteTicket removes the ticket and its session cookie. The caller must hold the lock.
+func (s *ticketStore) deleteTicket(id string) {
+	delete(s.tickets, id)
+	delete(s.expires, id)
+	delete(s.cookies, id)
+}
+
+// sessions returns all sessions ordered by username.
+func (s *ticketStore) sessions() []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+	sessions := []Session{}
+	for ticket, response := range s.tickets {
+		if s.isExpired(ticket, now) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			Id:                 sessionId(ticket),
+			Username:           response.User,
+			AuthenticationDate: response.AuthenticationDate,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Username != sessions[j].Username {
+			return sessions[i].Username < sessions[j].Username
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions
+}
+
+// invalidate deletes the ticket of the session. The next request of the session is redirected to the CAS login.
+func (s *ticketStore) invalidate(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ticket := range s.tickets {
+		if sessionId(ticket) == id {
+			s.deleteTicket(ticket)
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateCookie deletes the ticket of the session with the given session cookie.
+func (s *ticketStore) invalidateCookie(cookie string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ticket, sessionCookie := range s.cookies {
+		if sessionCookie == cookie {
+			s.deleteTicket(ticket)
+			return true
+		}
+	}
+	return false
+}
+
+// bindSession records the session cookie of the browser which was authenticated with the ticket.
+func (s *ticketStore) bindSession(ticket string, cookie string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tickets[ticket]; ok {
+		s.cookies[ticket] = cookie
+	}
+}
+
+// bindSessions wraps the handler of the CAS client and binds the session cookie to the ticket of every request
+// which was authenticated with a new ticket.
+func (s *ticketStore) bindSessions(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cas.IsFirstAuthenticatedRequest(r) {
+			ticket := r.URL.Query().Get("ticket")
+			// the CAS client adds a new session cookie to the request as well
+			if cookie, err := r.Cookie(_CasSessionCookieName); err == nil && ticket != "" {
+				s.bindSession(ticket, cookie.Value)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// logOut marks the session of the ticket as logged out and returns the username of the ticket. The ticket itself
+// is deleted by the CAS client.
+func (s *ticketStore) logOut(ticket string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response, ok := s.tickets[ticket]
+	if !ok {
+		return "", false
+	}
+
+	now := s.now()
+	for cookie, loggedOut := range s.loggedOut {
+		if now.Sub(loggedOut) > _LoggedOutSessionTtl {
+			delete(s.loggedOut, cookie)
+		}
+	}
+	if cookie, ok := s.cookies[ticket]; ok {
+		s.loggedOut[cookie] = now
+	}
+
+	return response.User, true
+}
+
+// takeLoggedOut reports whether the session of the cookie was logged out and forgets it.
+func (s *ticketStore) takeLoggedOut(cookie string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loggedOut, ok := s.loggedOut[cookie]
+	delete(s.loggedOut, cookie)
+	return ok && s.now().Sub(loggedOut) <= _LoggedOutSessionTtl
+}
+
+func sessionId(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,61 @@
+package carp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudogu/go-cas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTicketStore_expiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	newStore := func() *ticketStore {
+		store := newTicketStore(time.Hour)
+		store.now = func() time.Time { return now }
+		return store
+	}
+
+	t.Run("should expire tickets after the session lifetime", func(t *testing.T) {
+		store := newStore()
+		require.NoError(t, store.Write("ST-1", &cas.AuthenticationResponse{User: "tricia", AuthenticationDate: now.Add(-30 * time.Minute)}))
+		require.NoError(t, store.Write("ST-2", &cas.AuthenticationResponse{User: "arthur", AuthenticationDate: now.Add(-2 * time.Hour)}))
+
+		_, err := store.Read("ST-1")
+		assert.NoError(t, err)
+		_, err = store.Read("ST-2")
+		assert.ErrorIs(t, err, cas.ErrInvalidTicket)
+
+		sessions := store.sessions()
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "tricia", sessions[0].Username)
+	})
+
+	t.Run("should count the lifetime from the write without authentication date", func(t *testing.T) {
+		store := newStore()
+		require.NoError(t, store.Write("ST-1", &cas.AuthenticationResponse{User: "tricia"}))
+
+		store.now = func() time.Time { return now.Add(59 * time.Minute) }
+		_, err := store.Read("ST-1")
+		assert.NoError(t, err)
+
+		store.now = func() time.Time { return now.Add(61 * time.Minute) }
+		_, err = store.Read("ST-1")
+		assert.ErrorIs(t, err, cas.ErrInvalidTicket)
+	})
+
+	t.Run("should remove expired tickets and their cookies on write", func(t *testing.T) {
+		store := newStore()
+		require.NoError(t, store.Write("ST-1", &cas.AuthenticationResponse{User: "tricia", AuthenticationDate: now}))
+		store.cookies["ST-1"] = "cookie-1"
+
+		store.now = func() time.Time { return now.Add(2 * time.Hour) }
+		require.NoError(t, store.Write("ST-2", &cas.AuthenticationResponse{User: "arthur"}))
+
+		assert.NotContains(t, store.tickets, "ST-1")
+		assert.NotContains(t, store.expires, "ST-1")
+		assert.NotContains(t, store.cookies, "ST-1")
+		assert.Contains(t, store.tickets, "ST-2")
+	})
+}
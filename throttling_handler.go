@@ -3,26 +3,81 @@ package carp
 import (
 	"context"
 	"fmt"
-	"golang.org/x/time/rate"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 const _HttpHeaderXForwardedFor = "X-Forwarded-For"
 const _DefaultCleanInterval = 300
 
-var (
-	mu      sync.RWMutex
-	clients = make(map[string]*rate.Limiter)
+const (
+	_ServiceAccountLimiterKeyPrefix = "service-account:"
+	_CasRestLimiterKeyPrefix        = "cas-rest:"
 )
 
+// throttling holds the state of the throttling which survives a rebuild of the handler chain.
+type throttling struct {
+	store LimiterStore
+	bans  *banList
+}
+
+// ThrottlingBucket is the token bucket of a throttling key, e.g. service-account:10.0.0.1:username.
+type ThrottlingBucket struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+}
+
+// buckets returns the buckets of the store ordered by key.
+func (t *throttling) buckets(configuration Configuration) []ThrottlingBucket {
+	buckets := []ThrottlingBucket{}
+	for _, key := range t.store.Keys() {
+		buckets = append(buckets, ThrottlingBucket{Key: key, Tokens: t.store.Tokens(key, limitForKey(configuration, key))})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Key < buckets[j].Key
+	})
+	return buckets
+}
+
+// limitForKey returns the limit of the limiter which created the key.
+func limitForKey(configuration Configuration, key string) Limit {
+	if strings.HasPrefix(key, _CasRestLimiterKeyPrefix) {
+		return Limit{TokenRate: configuration.CasRestLimiterTokenRate, BurstSize: configuration.CasRestLimiterBurstSize}
+	}
+	return Limit{TokenRate: configuration.LimiterTokenRate, BurstSize: configuration.LimiterBurstSize}
+}
+
+// NewThrottlingHandler creates a throttling handler with its own LimiterStore and ban list.
 func NewThrottlingHandler(ctx context.Context, configuration Configuration, handler http.Handler) http.Handler {
-	go startCleanJob(ctx, configuration.LimiterCleanInterval)
+	return newThrottlingHandler(ctx, configuration, handler, &throttling{
+		store: newLimiterStore(configuration),
+		bans:  newBanList(configuration.LimiterBanSnapshotFile, configuration.LimiterMaxEntries),
+	})
+}
+
+// newThrottlingHandler creates a throttling handler which keeps its buckets and bans in the given throttling state.
+func newThrottlingHandler(ctx context.Context, configuration Configuration, handler http.Handler, state *throttling) http.Handler {
+	store := state.store
+	policy := newBanPolicy(configuration)
+	startBackgroundJob(ctx, func(ctx context.Context) {
+		startCleanJob(ctx, configuration.LimiterCleanInterval, state, policy)
+	})
+
+	limit := Limit{TokenRate: configuration.LimiterTokenRate, BurstSize: configuration.LimiterBurstSize}
 
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		if !IsServiceAccountAuthentication(request) {
+		metricsFromRequest(request).countStage(stageThrottling)
+
+		if !IsServiceAccountAuthentication(request) && !isServiceAccountRejected(request) {
+			if configuration.CasRestLimiterTokenRate > 0 {
+				throttleCasRestAuthentication(configuration, state, policy, handler, writer, request)
+				return
+			}
+
 			// no throttling needed -> skip
 			handler.ServeHTTP(writer, request)
 			return
@@ -34,90 +89,99 @@ func NewThrottlingHandler(ctx context.Context, configuration Configuration, hand
 			return
 		}
 
-		log.Debugf("Extracted username for throttling: %s", username)
-
-		// go reverse proxy may add additional IP addresses from localhost. We need to take the right one.
-		forwardedIpAddrRaw := request.Header.Get(_HttpHeaderXForwardedFor)
-		forwardedIpAddresses := strings.Split(forwardedIpAddrRaw, ",")
-		initialForwardedIpAddress := ""
-		if len(forwardedIpAddresses) > 0 {
-			initialForwardedIpAddress = strings.TrimSpace(forwardedIpAddresses[0])
-		}
+		clientIp := ClientIP(request)
 
-		log.Debugf("Extracted ip from %s for throttling: %s", _HttpHeaderXForwardedFor, username)
+		logger := newRequestLogger(request).withUsername(username)
+		logger.debug("Extracted username and ip for throttling")
 
 		statusWriter := &statusResponseWriter{
 			ResponseWriter: writer,
 			statusCode:     http.StatusOK,
 		}
 
-		ipUsernameId := fmt.Sprintf("%s:%s", initialForwardedIpAddress, username)
-		limiter := getOrCreateLimiter(ipUsernameId, configuration.LimiterTokenRate, configuration.LimiterBurstSize)
+		ipUsernameId := fmt.Sprintf("%s%s:%s", _ServiceAccountLimiterKeyPrefix, clientIp, username)
+
+		if state.rejectBanned(statusWriter, request, logger, ipUsernameId, limit, configuration.LimiterJsonResponse) {
+			return
+		}
 
-		if !limiter.Allow() {
-			log.Infof("Throttle request to %s from user %s with ip %s", request.RequestURI, username, initialForwardedIpAddress)
+		result := store.Allow(ipUsernameId, limit)
+		setRateLimitHeaders(writer.Header(), result, limit)
 
-			http.Error(statusWriter, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if !result.Allowed {
+			state.rejectThrottled(statusWriter, request, logger, ipUsernameId, result, policy, configuration.LimiterJsonResponse)
 			return
 		}
 
-		log.Debugf("User %s with IP address %s has %.1f tokens left", username, initialForwardedIpAddress, limiter.Tokens())
+		logger.debug(fmt.Sprintf("Throttling tokens left: %.1f", result.Remaining))
+
+		if isServiceAccountRejected(request) {
+			// the failure costs a token, because the request is not reset
+			logger.withStatus(http.StatusUnauthorized).info("Reject request with invalid service account credentials")
+			writeServiceAccountCredentialsRejected(statusWriter)
+			return
+		}
 
 		handler.ServeHTTP(statusWriter, request)
 
 		if statusWriter.statusCode >= 200 && statusWriter.statusCode < 400 {
-			cleanClient(ipUsernameId)
+			store.Reset(ipUsernameId)
 		}
 
 	})
 }
 
-func getOrCreateLimiter(ip string, limiterTokenRate, limiterBurstSize int) *rate.Limiter {
-	mu.Lock()
-	defer mu.Unlock()
-
-	l, ok := clients[ip]
-	if !ok {
-		l = rate.NewLimiter(rate.Limit(limiterTokenRate), limiterBurstSize)
-		clients[ip] = l
+// rejectBanned answers the request with status code 429 if the key is banned. The rate limit headers announce no
+// remaining tokens until the end of the ban.
+func (t *throttling) rejectBanned(w http.ResponseWriter, r *http.Request, logger requestLogger, key string, limit Limit, jsonResponse bool) bool {
+	remaining, banned := t.bans.bannedFor(key)
+	if !banned {
+		return false
 	}
 
-	return l
-}
-
-func cleanClient(ip string) {
-	mu.Lock()
-	defer mu.Unlock()
+	logger.withStatus(http.StatusTooManyRequests).info("Reject request of banned client")
 
-	delete(clients, ip)
+	metricsFromRequest(r).countThrottledRequest()
+	requestInfoFromRequest(r).setThrottled()
+	result := LimiterResult{Remaining: 0, Reset: remaining, RetryAfter: remaining}
+	setRateLimitHeaders(w.Header(), result, limit)
+	writeThrottled(w, result, jsonResponse)
+	return true
 }
 
-func cleanClients() {
-	mu.Lock()
-	defer mu.Unlock()
+// rejectThrottled answers the request with status code 429 and bans the key if it was throttled too often.
+func (t *throttling) rejectThrottled(w http.ResponseWriter, r *http.Request, logger requestLogger, key string, result LimiterResult, policy banPolicy, jsonResponse bool) {
+	logger.withStatus(http.StatusTooManyRequests).info("Throttle request")
 
-	for client, limiter := range clients {
-		if limiter.Allow() {
-			delete(clients, client)
-		}
+	if duration, banned := t.bans.recordThrottle(key, policy); banned {
+		logger.info(fmt.Sprintf("Ban client for %s after repeated throttling", duration))
+		metricsFromRequest(r).countBan()
+		result.RetryAfter = duration
+		w.Header().Set(_HttpHeaderRateLimitReset, strconv.Itoa(ceilSeconds(duration)))
 	}
+
+	metricsFromRequest(r).countThrottledRequest()
+	requestInfoFromRequest(r).setThrottled()
+	writeThrottled(w, result, jsonResponse)
 }
 
-func startCleanJob(ctx context.Context, cleanInterval int) {
+func startCleanJob(ctx context.Context, cleanInterval int, state *throttling, policy banPolicy) {
 	if cleanInterval == 0 {
 		cleanInterval = _DefaultCleanInterval
 	}
 
-	tick := time.Tick(time.Duration(cleanInterval) * time.Second)
+	ticker := time.NewTicker(time.Duration(cleanInterval) * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Infof("Context done - stop throttling cleanup job")
 			return
-		case <-tick:
+		case <-ticker.C:
 			log.Info("Start cleanup for clients in throttling map")
-			cleanClients()
+			state.store.Cleanup()
+			state.bans.cleanup(policy)
 		}
 	}
 }
@@ -2,6 +2,7 @@ package carp
 
 import (
 	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
@@ -12,12 +13,17 @@ import (
 )
 
 func TestThrottlingHandler(t *testing.T) {
-	limiterConfig := Configuration{LimiterTokenRate: 1, LimiterBurstSize: 2}
+	limiterConfig := Configuration{LimiterTokenRate: 1, LimiterBurstSize: 2, TrustedProxies: []string{"127.0.0.1"}}
 	ctx := context.TODO()
 
+	withClientIp := func(t *testing.T, handler http.Handler) http.Handler {
+		clientIpHandler, err := NewClientIpHandler(limiterConfig, handler)
+		require.NoError(t, err)
+		return clientIpHandler
+	}
+
 	cleanUp := func(server *httptest.Server) {
 		server.Close()
-		clients = make(map[string]*rate.Limiter)
 	}
 
 	t.Run("Throttle too many requests in short time", func(t *testing.T) {
@@ -32,13 +38,13 @@ func TestThrottlingHandler(t *testing.T) {
 			throttlingHandler.ServeHTTP(writer, request)
 		}
 
-		server := httptest.NewServer(ctxHandler)
+		server := httptest.NewServer(withClientIp(t, ctxHandler))
 		defer cleanUp(server)
 
 		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 		require.NoError(t, err)
 
-		req.Header.Set(_HttpHeaderXForwardedFor, "testIP")
+		req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
 		req.SetBasicAuth("test", "test")
 
 		var found bool
@@ -64,13 +70,13 @@ func TestThrottlingHandler(t *testing.T) {
 
 		throttlingHandler := NewThrottlingHandler(ctx, limiterConfig, handler)
 
-		server := httptest.NewServer(throttlingHandler)
+		server := httptest.NewServer(withClientIp(t, throttlingHandler))
 		defer cleanUp(server)
 
 		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 		require.NoError(t, err)
 
-		req.Header.Set(_HttpHeaderXForwardedFor, "testIP")
+		req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
 		req.SetBasicAuth("test", "test")
 
 		for i := 0; i < 5; i++ {
@@ -93,13 +99,13 @@ func TestThrottlingHandler(t *testing.T) {
 			throttlingHandler.ServeHTTP(writer, request)
 		}
 
-		server := httptest.NewServer(ctxHandler)
+		server := httptest.NewServer(withClientIp(t, ctxHandler))
 		defer cleanUp(server)
 
 		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 		require.NoError(t, err)
 
-		req.Header.Set(_HttpHeaderXForwardedFor, "testIP")
+		req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
 
 		resp, lErr := server.Client().Do(req)
 		assert.NoError(t, lErr)
@@ -118,13 +124,13 @@ func TestThrottlingHandler(t *testing.T) {
 			throttlingHandler.ServeHTTP(writer, request)
 		}
 
-		server := httptest.NewServer(ctxHandler)
+		server := httptest.NewServer(withClientIp(t, ctxHandler))
 		defer cleanUp(server)
 
 		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 		require.NoError(t, err)
 
-		req.Header.Set(_HttpHeaderXForwardedFor, "testIP")
+		req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
 		req.SetBasicAuth("test", "test")
 
 		clientCtx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
@@ -166,13 +172,13 @@ func TestThrottlingHandler(t *testing.T) {
 			throttlingHandler.ServeHTTP(writer, request)
 		}
 
-		server := httptest.NewServer(ctxHandler)
+		server := httptest.NewServer(withClientIp(t, ctxHandler))
 		defer cleanUp(server)
 
 		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 		require.NoError(t, err)
 
-		req.Header.Set(_HttpHeaderXForwardedFor, "testIP")
+		req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
 		req.SetBasicAuth("test", "test")
 
 		var found bool
@@ -191,6 +197,60 @@ func TestThrottlingHandler(t *testing.T) {
 		assert.False(t, found)
 	})
 
+	t.Run("Throttle forwarded client ips separately", func(t *testing.T) {
+		var handler http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusUnauthorized)
+		}
+
+		store := NewMemoryLimiterStore(_DefaultLimiterMaxEntries)
+		throttlingHandler := newThrottlingHandler(ctx, limiterConfig, handler, &throttling{store: store, bans: newBanList("", 0)})
+		clientIpHandler := withClientIp(t, throttlingHandler)
+
+		request := func(remoteAddr string, forwardedFor string) int {
+			req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+			req = req.WithContext(context.WithValue(req.Context(), _ServiceAccountAuthContextKey, true))
+			req.RemoteAddr = remoteAddr
+			req.Header.Set(_HttpHeaderXForwardedFor, forwardedFor)
+			req.SetBasicAuth("test", "test")
+			recorder := httptest.NewRecorder()
+			clientIpHandler.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		for i := 0; i < limiterConfig.LimiterBurstSize; i++ {
+			assert.Equal(t, http.StatusUnauthorized, request("127.0.0.1:1234", "198.51.100.1"))
+		}
+		assert.Equal(t, http.StatusTooManyRequests, request("127.0.0.1:1234", "198.51.100.1"))
+		assert.Equal(t, http.StatusUnauthorized, request("127.0.0.1:1234", "198.51.100.2"))
+
+		assert.ElementsMatch(t, []string{"service-account:198.51.100.1:test", "service-account:198.51.100.2:test"}, store.Keys())
+	})
+
+	t.Run("Ignore forwarded header of untrusted peer", func(t *testing.T) {
+		var handler http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusUnauthorized)
+		}
+
+		store := NewMemoryLimiterStore(_DefaultLimiterMaxEntries)
+		throttlingHandler := newThrottlingHandler(ctx, limiterConfig, handler, &throttling{store: store, bans: newBanList("", 0)})
+		clientIpHandler := withClientIp(t, throttlingHandler)
+
+		codes := []int{}
+		for i := 0; i <= limiterConfig.LimiterBurstSize; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/nexus/service/rest", nil)
+			req = req.WithContext(context.WithValue(req.Context(), _ServiceAccountAuthContextKey, true))
+			req.RemoteAddr = "203.0.113.9:1234"
+			req.Header.Set(_HttpHeaderXForwardedFor, fmt.Sprintf("198.51.100.%d", i+1))
+			req.SetBasicAuth("test", "test")
+			recorder := httptest.NewRecorder()
+			clientIpHandler.ServeHTTP(recorder, req)
+			codes = append(codes, recorder.Code)
+		}
+
+		assert.Equal(t, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}, codes)
+		assert.Equal(t, []string{"service-account:203.0.113.9:test"}, store.Keys())
+	})
+
 	t.Run("CleanUp clients", func(t *testing.T) {
 		var handler http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(http.StatusUnauthorized)
@@ -207,20 +267,21 @@ func TestThrottlingHandler(t *testing.T) {
 			LimiterCleanInterval: limiterCleanInterval,
 		}
 
-		throttlingHandler := NewThrottlingHandler(lCtx, config, handler)
+		store := NewMemoryLimiterStore(_DefaultLimiterMaxEntries)
+		throttlingHandler := newThrottlingHandler(lCtx, config, handler, &throttling{store: store, bans: newBanList("", 0)})
 
 		var ctxHandler http.HandlerFunc = func(writer http.ResponseWriter, request *http.Request) {
 			request = request.WithContext(context.WithValue(request.Context(), _ServiceAccountAuthContextKey, true))
 			throttlingHandler.ServeHTTP(writer, request)
 		}
 
-		server := httptest.NewServer(ctxHandler)
+		server := httptest.NewServer(withClientIp(t, ctxHandler))
 		defer cleanUp(server)
 
 		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
 		require.NoError(t, err)
 
-		req.Header.Set(_HttpHeaderXForwardedFor, "testIP")
+		req.Header.Set(_HttpHeaderXForwardedFor, "198.51.100.1")
 		req.SetBasicAuth("test", "test")
 
 		resp, lErr := server.Client().Do(req)
@@ -228,7 +289,7 @@ func TestThrottlingHandler(t *testing.T) {
 		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 
 		// Evaluate cleanup clients
-		require.True(t, len(clients) > 0)
+		require.True(t, store.Len() > 0)
 
 		tick := time.Tick(time.Duration(limiterCleanInterval) * time.Second)
 
@@ -237,7 +298,7 @@ func TestThrottlingHandler(t *testing.T) {
 			case <-lCtx.Done():
 				assert.Fail(t, "Test failed because of timeout")
 			case <-tick:
-				if len(clients) == 0 {
+				if store.Len() == 0 {
 					return
 				}
 			}
@@ -0,0 +1,114 @@
+package carp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	_TracerName                   = "github.com/cloudogu/carp"
+	_DefaultTracingServiceName    = "carp"
+	_TracingShutdownTimeout       = 5 * time.Second
+	spanNameCasTicketValidation   = "cas ticket validation"
+	spanNameCasRestAuthentication = "cas rest authentication"
+	spanNameUserReplication       = "user replication"
+	spanNameResourceProbe         = "resource probe"
+	spanNameUpstream              = "upstream"
+)
+
+// tracePropagator reads and writes the W3C trace context headers.
+var tracePropagator = propagation.TraceContext{}
+
+// NewTracingHandler creates a handler which starts a server span for every request and continues the trace of an
+// incoming traceparent header. The spans are exported over OTLP/HTTP to the configured tracing-endpoint. If no
+// tracing-endpoint is configured, the given handler is returned. The exporter is flushed and stopped when the context
+// is done.
+func NewTracingHandler(ctx context.Context, configuration Configuration, handler http.Handler) (http.Handler, error) {
+	if configuration.TracingEndpoint == "" {
+		log.Info("No tracing-endpoint configured. Not exporting traces.")
+		return handler, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(configuration.TracingEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", valueOrDefault(configuration.TracingServiceName, _DefaultTracingServiceName)),
+		)),
+	)
+
+	startBackgroundJob(ctx, func(ctx context.Context) {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), _TracingShutdownTimeout)
+		defer cancel()
+
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("failed to shutdown tracing: %s", err.Error())
+		}
+	})
+
+	tracer := tracerProvider.Tracer(_TracerName)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := tracePropagator.Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer.Start(ctx, request.Method+" "+request.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("url.path", request.URL.Path),
+				attribute.String("client.address", ClientIP(request)),
+				attribute.String("carp.request_id", requestIdFromRequest(request)),
+			),
+		)
+		defer span.End()
+
+		statusWriter := &statusResponseWriter{
+			ResponseWriter: writer,
+			statusCode:     http.StatusOK,
+		}
+
+		handler.ServeHTTP(statusWriter, request.WithContext(ctx))
+
+		endSpanWithStatus(span, statusWriter.statusCode, nil)
+	}), nil
+}
+
+// startSpan starts a child span of the span in the context. The span is not recorded if the context has no span.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(_TracerName).Start(ctx, name, opts...)
+}
+
+// endSpanWithStatus records the status code and the error of a request in the span. Server errors and errors mark
+// the span as failed.
+func endSpanWithStatus(span trace.Span, statusCode int, err error) {
+	if statusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+}
+
+// injectTraceContext writes the trace context of the context into the headers of the request.
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
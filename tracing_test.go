@@ -0,0 +1,168 @@
+package carp
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStandIn records the spans exported over OTLP/HTTP.
+type collectorStandIn struct {
+	mu    sync.Mutex
+	spans map[string]string
+}
+
+func newCollectorStandIn(t *testing.T) (*collectorStandIn, *httptest.Server) {
+	collector := &collectorStandIn{spans: map[string]string{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		request := &collectortrace.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, request))
+
+		collector.mu.Lock()
+		defer collector.mu.Unlock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				for _, span := range scopeSpans.Spans {
+					collector.spans[span.Name] = hex.EncodeToString(span.TraceId)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		_, _ = w.Write(response)
+	}))
+
+	return collector, server
+}
+
+func (c *collectorStandIn) traceIds() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := map[string]string{}
+	for name, traceId := range c.spans {
+		result[name] = traceId
+	}
+	return result
+}
+
+func TestTracingHandler(t *testing.T) {
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const traceparent = "00-" + traceId + "-00f067aa0ba902b7-01"
+
+	t.Run("should export spans and propagate trace context", func(t *testing.T) {
+		collector, collectorServer := newCollectorStandIn(t)
+		defer collectorServer.Close()
+
+		var mu sync.Mutex
+		var targetTraceparent, casTraceparent, casRestTraceparent string
+
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			targetTraceparent = r.Header.Get("traceparent")
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer backend.Close()
+
+		casServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.URL.Query().Get("ticket") != "" {
+				casTraceparent = r.Header.Get("traceparent")
+			}
+			if strings.HasSuffix(r.URL.Path, "/v1/tickets") {
+				casRestTraceparent = r.Header.Get("traceparent")
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer casServer.Close()
+
+		configuration := validTestConfiguration(t)
+		configuration.Target = backend.URL
+		configuration.CasUrl = casServer.URL + "/cas"
+		configuration.BaseUrl = backend.URL
+		configuration.ResourcePath = "/resources"
+		configuration.ForwardUnauthenticatedRESTRequests = true
+		configuration.TracingEndpoint = collectorServer.URL + "/v1/traces"
+
+		jobs := &backgroundJobs{}
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), _BackgroundJobsContextKey, jobs))
+		defer cancel()
+
+		handler, err := createHandlersForConfig(ctx, configuration, newHandlerState())
+		require.NoError(t, err)
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		client := server.Client()
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		for _, path := range []string{"/foo", "/resources/logo.png?ticket=ST-1"} {
+			req, lErr := http.NewRequest(http.MethodGet, server.URL+path, nil)
+			require.NoError(t, lErr)
+			req.Header.Set("traceparent", traceparent)
+			if path != "/foo" {
+				req.Header.Set("User-Agent", "Mozilla/5.0")
+			} else {
+				req.SetBasicAuth("alice", "secret")
+			}
+			resp, lErr := client.Do(req)
+			require.NoError(t, lErr)
+			_ = resp.Body.Close()
+		}
+
+		cancel()
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer waitCancel()
+		require.NoError(t, jobs.waitContext(waitCtx))
+
+		mu.Lock()
+		assert.Contains(t, targetTraceparent, traceId)
+		assert.NotEqual(t, traceparent, targetTraceparent)
+		assert.Contains(t, casTraceparent, traceId)
+		assert.Contains(t, casRestTraceparent, traceId)
+		mu.Unlock()
+
+		spans := collector.traceIds()
+		assert.Equal(t, traceId, spans["GET /foo"])
+		assert.Equal(t, traceId, spans["GET /resources/logo.png"])
+		assert.Equal(t, traceId, spans[spanNameUpstream])
+		assert.Equal(t, traceId, spans[spanNameCasTicketValidation])
+		assert.Equal(t, traceId, spans[spanNameCasRestAuthentication])
+		assert.Equal(t, traceId, spans[spanNameResourceProbe])
+	})
+
+	t.Run("should return handler without tracing-endpoint", func(t *testing.T) {
+		delegate := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		handler, err := NewTracingHandler(context.Background(), Configuration{}, delegate)
+
+		require.NoError(t, err)
+		assert.NotNil(t, handler)
+	})
+
+	t.Run("should not record spans without server span", func(t *testing.T) {
+		_, span := startSpan(context.Background(), spanNameUpstream)
+		defer span.End()
+
+		assert.False(t, span.IsRecording())
+	})
+}